@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/irootpro/shorturl/internal/url/export"
+	"github.com/irootpro/shorturl/internal/url/service"
+)
+
+const exportUsage = `Usage: shortener export (-link ID | -user ID) [flags]
+
+Writes the clicks or daily counts of a link, or of all links of a user, to
+stdout or the -out file. Storage is configured like the server with -d or
+DATABASE_DSN and -f or FILE_STORAGE_PATH. A file storage is read as it was
+last saved by the server.
+
+`
+
+// runExport implements the export subcommand, it reads the storage directly
+// and needs no running server.
+func runExport(args []string) error {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprint(flags.Output(), exportUsage)
+		flags.PrintDefaults()
+	}
+
+	var cfg service.ConfigVars
+	var linkID, userID, from, to, out string
+	query := export.Query{}
+	flags.StringVar(&linkID, "link", "", "Input link to export")
+	flags.StringVar(&userID, "user", "", "Input user whose links are exported")
+	flags.StringVar(&query.Kind, "kind", export.KindClicks, "Input kind of rows, clicks or daily")
+	flags.StringVar(&query.Format, "format", export.FormatCSV, "Input format, csv or ndjson")
+	flags.StringVar(&from, "from", "", "Input start as date or RFC 3339 time, default 30 days before to")
+	flags.StringVar(&to, "to", "", "Input end as date or RFC 3339 time, default now")
+	flags.StringVar(&out, "out", "", "Input output file, default stdout")
+	flags.StringVar(&cfg.DSN, "d", "", "Input DSN for connetd to datbase")
+	flags.StringVar(&cfg.StoragePath, "f", "", "Input file storage path")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if envDatabaseDSN := os.Getenv("DATABASE_DSN"); envDatabaseDSN != "" {
+		cfg.DSN = envDatabaseDSN
+	}
+	if envFileStorage := os.Getenv("FILE_STORAGE_PATH"); envFileStorage != "" {
+		cfg.StoragePath = envFileStorage
+	}
+
+	if (linkID == "") == (userID == "") {
+		return errors.New("export needs exactly one of -link and -user")
+	}
+	if cfg.DSN == "" && cfg.StoragePath == "" {
+		return errors.New("export needs a database or file storage")
+	}
+
+	var err error
+	query.To = time.Now().UTC()
+	if to != "" {
+		if query.To, err = export.ParseTime(to); err != nil {
+			return fmt.Errorf("invalid to: %s", err.Error())
+		}
+	}
+	query.From = query.To.Add(-30 * 24 * time.Hour)
+	if from != "" {
+		if query.From, err = export.ParseTime(from); err != nil {
+			return fmt.Errorf("invalid from: %s", err.Error())
+		}
+	}
+	if err = query.Validate(); err != nil {
+		return err
+	}
+
+	storage := InitStorage(&cfg)
+	// Closing a file storage saves it, which would overwrite what a
+	// running server saves later, so only the database is closed.
+	if cfg.DSN != "" {
+		defer storage.Close()
+	}
+
+	if linkID != "" {
+		query.LinkIDs = []string{linkID}
+	} else {
+		links, err := storage.GetAll()
+		if err != nil {
+			return err
+		}
+		for _, link := range links {
+			if link.UserID == userID {
+				query.LinkIDs = append(query.LinkIDs, link.ID)
+			}
+		}
+	}
+
+	var w io.Writer = os.Stdout
+	if out != "" {
+		file, err := os.Create(out)
+		if err != nil {
+			return fmt.Errorf("create output: %s", err.Error())
+		}
+		defer file.Close()
+		w = file
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	return export.Write(ctx, w, storage, query)
+}
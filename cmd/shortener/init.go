@@ -1,13 +1,32 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"log"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 
+	"github.com/labstack/echo/v4"
+
+	"github.com/irootpro/shorturl/internal/url/geoip"
 	"github.com/irootpro/shorturl/internal/url/handlers"
+	"github.com/irootpro/shorturl/internal/url/pages"
 	"github.com/irootpro/shorturl/internal/url/service"
 	"github.com/irootpro/shorturl/internal/url/storage"
+	"github.com/irootpro/shorturl/internal/url/useragent"
 )
 
+// accessLogFormat is echo's default access log without remote_ip, client
+// addresses are never written anywhere.
+const accessLogFormat = `{"time":"${time_rfc3339_nano}","id":"${id}","host":"${host}",` +
+	`"method":"${method}","uri":"${uri}","user_agent":"${user_agent}",` +
+	`"status":${status},"error":"${error}","latency":${latency},"latency_human":"${latency_human}",` +
+	`"bytes_in":${bytes_in},"bytes_out":${bytes_out}}` + "\n"
+
 func InitStorage(cfg *service.ConfigVars) handlers.Storage {
 	if cfg.DSN != "" {
 		return storage.NewStorageDB(cfg.DSN)
@@ -23,3 +42,150 @@ func InitStorage(cfg *service.ConfigVars) handlers.Storage {
 	}
 	return storageFile
 }
+
+func InitGeoIP(cfg *service.ConfigVars) *geoip.Reader {
+	if cfg.GeoIPPath == "" {
+		return nil
+	}
+
+	reader, err := geoip.Open(cfg.GeoIPPath)
+	if err != nil {
+		log.Fatal("open geoip database: ", err)
+	}
+	return reader
+}
+
+// InitIPExtractor trusts X-Forwarded-For only from the configured proxies,
+// the client address is taken from the connection otherwise.
+func InitIPExtractor(cfg *service.ConfigVars) echo.IPExtractor {
+	if len(cfg.TrustedProxies) == 0 {
+		return echo.ExtractIPDirect()
+	}
+
+	options := []echo.TrustOption{
+		echo.TrustLoopback(false),
+		echo.TrustLinkLocal(false),
+		echo.TrustPrivateNet(false),
+	}
+	for _, proxy := range cfg.TrustedProxies {
+		if !strings.Contains(proxy, "/") {
+			if strings.Contains(proxy, ":") {
+				proxy += "/128"
+			} else {
+				proxy += "/32"
+			}
+		}
+
+		_, ipNet, err := net.ParseCIDR(proxy)
+		if err != nil {
+			log.Fatal("parse trusted proxy: ", err)
+		}
+		options = append(options, echo.TrustIPRange(ipNet))
+	}
+
+	return echo.ExtractIPFromXFFHeader(options...)
+}
+
+func InitPages(cfg *service.ConfigVars) *pages.Renderer {
+	renderer, err := pages.Load(cfg.PagesDir)
+	if err != nil {
+		log.Fatal("load pages: ", err)
+	}
+	return renderer
+}
+
+// InitUserAgents loads the user agent rules file if one is configured, the
+// built-in rules are used otherwise.
+func InitUserAgents(cfg *service.ConfigVars) *useragent.Classifier {
+	if cfg.UserAgentRules == "" {
+		return useragent.NewClassifier(useragent.DefaultRules())
+	}
+
+	rules, err := useragent.LoadRules(cfg.UserAgentRules)
+	if err != nil {
+		log.Fatal("load user agent rules: ", err)
+	}
+	return useragent.NewClassifier(rules)
+}
+
+// InitSigningKeys activates the configured signing keys. Without keys a
+// random one is used and every identity is lost on restart.
+func InitSigningKeys(cfg *service.ConfigVars) {
+	service.SetSecureCookies(!strings.HasPrefix(cfg.BaseURL, "http://"))
+
+	keys, err := loadSigningKeys(cfg)
+	if err != nil {
+		log.Fatal("load signing keys: ", err)
+	}
+	if len(keys) == 0 {
+		log.Println("no signing keys configured, identities are lost on restart")
+		return
+	}
+
+	if err := service.SetKeys(keys); err != nil {
+		log.Fatal("load signing keys: ", err)
+	}
+}
+
+func loadSigningKeys(cfg *service.ConfigVars) ([]service.SigningKey, error) {
+	if cfg.SigningKeysFile != "" {
+		return service.LoadKeys(cfg.SigningKeysFile)
+	}
+	return service.ParseKeys(cfg.SigningKeys)
+}
+
+// ReloadSigningKeys reads the keys file again on every SIGHUP, a key added
+// at the end signs from then on. A broken file keeps the previous keys.
+func ReloadSigningKeys(ctx context.Context, cfg *service.ConfigVars) {
+	if cfg.SigningKeysFile == "" {
+		return
+	}
+
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	defer signal.Stop(hangup)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hangup:
+			keys, err := service.LoadKeys(cfg.SigningKeysFile)
+			if err == nil {
+				err = service.SetKeys(keys)
+			}
+			if err != nil {
+				log.Println("reload signing keys:", err)
+				continue
+			}
+			fmt.Println("Signing keys reloaded")
+		}
+	}
+}
+
+// ReloadUserAgents reads the rules file again on every SIGHUP, a broken
+// file keeps the previous rules.
+func ReloadUserAgents(ctx context.Context, cfg *service.ConfigVars, classifier *useragent.Classifier) {
+	if cfg.UserAgentRules == "" {
+		return
+	}
+
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	defer signal.Stop(hangup)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hangup:
+			rules, err := useragent.LoadRules(cfg.UserAgentRules)
+			if err != nil {
+				log.Println("reload user agent rules:", err)
+				continue
+			}
+			classifier.SetRules(rules)
+			fmt.Println("User agent rules reloaded")
+		}
+	}
+}
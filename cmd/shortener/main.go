@@ -2,37 +2,125 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
+	"sync"
 	"time"
 
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
 
+	"github.com/irootpro/shorturl/internal/url/clicks"
 	"github.com/irootpro/shorturl/internal/url/handlers"
+	"github.com/irootpro/shorturl/internal/url/jobs"
+	"github.com/irootpro/shorturl/internal/url/live"
 	"github.com/irootpro/shorturl/internal/url/service"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "export" {
+		err := runExport(os.Args[2:])
+		if err != nil && err != flag.ErrHelp {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		return
+	}
+
 	cfg := service.SetVars()
+	InitSigningKeys(cfg)
 	storage := InitStorage(cfg)
 
-	serverHandler := handlers.NewServerHandler(cfg, storage)
+	recorder := clicks.NewRecorder(storage, clicks.DefaultQueueSize)
+	agents := InitUserAgents(cfg)
+	hub := live.NewHub(live.DefaultHistory, live.DefaultBuffer)
+
+	opts := []handlers.Option{
+		handlers.WithPages(InitPages(cfg)),
+		handlers.WithClickRecorder(recorder),
+		handlers.WithUserAgentClassifier(agents),
+		handlers.WithLiveHub(hub),
+	}
+	if geo := InitGeoIP(cfg); geo != nil {
+		defer geo.Close()
+		opts = append(opts, handlers.WithGeoLocator(geo))
+	}
+
+	serverHandler := handlers.NewServerHandler(cfg, storage, opts...)
+
+	jobsCtx, stopJobs := context.WithCancel(context.Background())
+	defer stopJobs()
+	var running sync.WaitGroup
+	for _, job := range []func(){
+		func() { jobs.RunSweeper(jobsCtx, storage, cfg.SweepInterval) },
+		func() { jobs.RunRollup(jobsCtx, storage, cfg.RollupInterval, cfg.ClickRetention) },
+		func() { ReloadUserAgents(jobsCtx, cfg, agents) },
+		func() { ReloadSigningKeys(jobsCtx, cfg) },
+	} {
+		running.Add(1)
+		go func(job func()) {
+			defer running.Done()
+			job()
+		}(job)
+	}
 
 	e := echo.New()
-	e.Use(middleware.Logger())
+	e.IPExtractor = InitIPExtractor(cfg)
+	e.Use(middleware.LoggerWithConfig(middleware.LoggerConfig{Format: accessLogFormat}))
 	e.Use(middleware.Gzip())
 	e.Use(middleware.Decompress())
 
 	e.GET("/:hash", serverHandler.GetURL)
-	e.POST("/", serverHandler.PostURL)
-	e.POST("/api/shorten", serverHandler.PostURLJSON)
-	e.POST("/api/shorten/batch", serverHandler.PostURLsBatchJSON)
-	e.GET("/api/user/urls", serverHandler.GetURLs)
-	e.DELETE("/api/user/urls", serverHandler.RemoveURLs)
+	e.HEAD("/:hash", serverHandler.GetURL)
+	e.GET("/:hash/:item", serverHandler.GetBundleItem)
+	e.POST("/:hash", serverHandler.UnlockURL)
+
+	session := serverHandler.Session()
+	create := handlers.RequireScope(handlers.ScopeCreate)
+	read := handlers.RequireScope(handlers.ScopeRead)
+	remove := handlers.RequireScope(handlers.ScopeDelete)
+	stats := handlers.RequireScope(handlers.ScopeStats)
+
+	e.POST("/", serverHandler.PostURL, session, create)
+	e.POST("/api/shorten", serverHandler.PostURLJSON, session, create)
+	e.POST("/api/shorten/batch", serverHandler.PostURLsBatchJSON, session, create)
+
+	user := e.Group("/api/user", session)
+	user.GET("/urls", serverHandler.GetURLs, read)
+	user.GET("/urls/events", serverHandler.GetAllEvents, stats)
+	user.GET("/urls/export", serverHandler.ExportAll, stats)
+	user.DELETE("/urls", serverHandler.RemoveURLs, remove)
+	user.PUT("/urls/:hash/rules", serverHandler.PutRules, create)
+	user.PUT("/urls/:hash/geo", serverHandler.PutGeoRules, create)
+	user.PUT("/urls/:hash/variants", serverHandler.PutVariants, create)
+	user.PUT("/urls/:hash/languages", serverHandler.PutLanguages, create)
+	user.GET("/urls/:hash/stats", serverHandler.GetStats, stats)
+	user.GET("/urls/:hash/events", serverHandler.GetEvents, stats)
+	user.GET("/urls/:hash/export", serverHandler.ExportLink, stats)
+	user.PUT("/urls/:hash/conversions", serverHandler.PutConversions, create)
+	user.GET("/urls/:hash/conversions", serverHandler.GetConversions, stats)
+	user.POST("/bundles", serverHandler.PostBundle, create)
+	user.GET("/bundles", serverHandler.GetBundles, read)
+	user.GET("/bundles/:code", serverHandler.GetBundle, read)
+	user.PUT("/bundles/:code", serverHandler.PutBundle, create)
+	user.DELETE("/bundles/:code", serverHandler.DeleteBundle, remove)
+	user.POST("/campaigns", serverHandler.PostCampaign, create)
+	user.GET("/campaigns", serverHandler.GetCampaigns, read)
+	user.GET("/campaigns/:code", serverHandler.GetCampaign, read)
+	user.PUT("/campaigns/:code", serverHandler.PutCampaign, create)
+	user.DELETE("/campaigns/:code", serverHandler.DeleteCampaign, remove)
+	user.GET("/campaigns/:code/stats", serverHandler.GetCampaignStats, stats)
+	user.POST("/keys", serverHandler.PostAPIKey)
+	user.GET("/keys", serverHandler.GetAPIKeys)
+	user.DELETE("/keys/:id", serverHandler.DeleteAPIKey)
+
+	e.GET("/conversions/pixel.gif", serverHandler.GetConversionPixel)
+	e.GET("/api/conversions", serverHandler.PostConversion)
+	e.POST("/api/conversions", serverHandler.PostConversion)
 	e.GET("/ping", serverHandler.Ping)
 	go func() {
 		if err := e.Start(cfg.SrvAddr); err != http.ErrServerClosed {
@@ -47,7 +135,22 @@ func main() {
 	defer cancel()
 	defer storage.Close()
 	defer fmt.Println("Server shutdown")
+	// Event streams never finish on their own, closing the hub ends them
+	// so Shutdown does not wait for the timeout.
+	hub.Close()
 	if err := e.Shutdown(ctx); err != nil {
 		e.Logger.Fatal(err)
 	}
+	// The storage is closed by the deferred call above, so queued clicks
+	// have to be written before main returns.
+	if err := recorder.Close(ctx); err != nil {
+		log.Println(err)
+	}
+	if dropped := recorder.Dropped(); dropped > 0 {
+		fmt.Printf("Dropped %d click events\n", dropped)
+	}
+	// A sweep or rollup may still be writing, the storage is closed only
+	// after they return.
+	stopJobs()
+	running.Wait()
 }
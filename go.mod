@@ -6,7 +6,11 @@ require (
 	github.com/google/uuid v1.3.0
 	github.com/labstack/echo/v4 v4.9.1
 	github.com/lib/pq v1.10.7
+	github.com/oschwald/maxminddb-golang v1.10.0
 	github.com/stretchr/testify v1.8.0
+	golang.org/x/crypto v0.1.0
+	golang.org/x/text v0.4.0
+	golang.org/x/time v0.1.0
 )
 
 require (
@@ -20,11 +24,8 @@ require (
 	github.com/rogpeppe/go-internal v1.9.0 // indirect
 	github.com/valyala/bytebufferpool v1.0.0 // indirect
 	github.com/valyala/fasttemplate v1.2.2 // indirect
-	golang.org/x/crypto v0.1.0 // indirect
 	golang.org/x/net v0.1.0 // indirect
 	golang.org/x/sys v0.1.0 // indirect
-	golang.org/x/text v0.4.0 // indirect
-	golang.org/x/time v0.1.0 // indirect
 	gopkg.in/check.v1 v1.0.0-20201130134442-10cb98267c6c // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
@@ -14,6 +14,13 @@ func (e *NotUniqueRecordError) Error() string {
 }
 
 var (
-	ErrDeleteLink   = errors.New("delete link")
-	ErrLinkNotFound = errors.New("link not found")
+	ErrDeleteLink    = errors.New("delete link")
+	ErrLinkNotFound  = errors.New("link not found")
+	ErrLinkNotActive = errors.New("link not active yet")
+	ErrLinkExpired   = errors.New("link expired")
+	ErrLinkExhausted = errors.New("link click limit reached")
+
+	ErrBundleNotFound   = errors.New("bundle not found")
+	ErrCampaignNotFound = errors.New("campaign not found")
+	ErrAPIKeyNotFound   = errors.New("api key not found")
 )
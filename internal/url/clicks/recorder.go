@@ -0,0 +1,132 @@
+package clicks
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/irootpro/shorturl/internal/url/storage"
+)
+
+const (
+	DefaultQueueSize = 10000
+
+	batchSize     = 500
+	flushInterval = time.Second
+	saveTimeout   = 10 * time.Second
+)
+
+type Saver interface {
+	SaveClicks(ctx context.Context, clicks []storage.ClickEvent) error
+}
+
+// Recorder queues click events in memory and writes them to the storage in
+// batches from a single background goroutine. Record never blocks: when the
+// queue is full the event is dropped and counted.
+type Recorder struct {
+	saver   Saver
+	queue   chan storage.ClickEvent
+	done    chan struct{}
+	dropped atomic.Int64
+
+	mu     sync.RWMutex
+	closed bool
+}
+
+func NewRecorder(saver Saver, queueSize int) *Recorder {
+	r := &Recorder{
+		saver: saver,
+		queue: make(chan storage.ClickEvent, queueSize),
+		done:  make(chan struct{}),
+	}
+
+	go r.run()
+
+	return r
+}
+
+func (r *Recorder) Record(event storage.ClickEvent) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if r.closed {
+		r.dropped.Add(1)
+		return false
+	}
+
+	select {
+	case r.queue <- event:
+		return true
+	default:
+		r.dropped.Add(1)
+		return false
+	}
+}
+
+// Dropped returns how many events were lost because the queue was full or
+// the recorder was already closed.
+func (r *Recorder) Dropped() int64 {
+	return r.dropped.Load()
+}
+
+// Close stops accepting events and waits until the queued ones are written
+// or ctx is done.
+func (r *Recorder) Close(ctx context.Context) error {
+	r.mu.Lock()
+	if !r.closed {
+		r.closed = true
+		close(r.queue)
+	}
+	r.mu.Unlock()
+
+	select {
+	case <-r.done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("flush click events: %s", ctx.Err().Error())
+	}
+}
+
+func (r *Recorder) run() {
+	defer close(r.done)
+
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	batch := make([]storage.ClickEvent, 0, batchSize)
+	for {
+		select {
+		case event, ok := <-r.queue:
+			if !ok {
+				r.save(batch)
+				return
+			}
+			batch = append(batch, event)
+			if len(batch) >= batchSize {
+				r.save(batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			if len(batch) != 0 {
+				r.save(batch)
+				batch = batch[:0]
+			}
+		}
+	}
+}
+
+func (r *Recorder) save(batch []storage.ClickEvent) {
+	if len(batch) == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), saveTimeout)
+	defer cancel()
+
+	if err := r.saver.SaveClicks(ctx, batch); err != nil {
+		r.dropped.Add(int64(len(batch)))
+		fmt.Printf("save %d click events: %s\n", len(batch), err.Error())
+	}
+}
@@ -0,0 +1,91 @@
+package clicks
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/irootpro/shorturl/internal/url/storage"
+)
+
+type saverMock struct {
+	mu      sync.Mutex
+	batches [][]storage.ClickEvent
+	block   chan struct{}
+}
+
+func (s *saverMock) SaveClicks(ctx context.Context, clicks []storage.ClickEvent) error {
+	if s.block != nil {
+		<-s.block
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	batch := make([]storage.ClickEvent, len(clicks))
+	copy(batch, clicks)
+	s.batches = append(s.batches, batch)
+	return nil
+}
+
+func (s *saverMock) saved() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var total int
+	for _, batch := range s.batches {
+		total += len(batch)
+	}
+	return total
+}
+
+func TestRecorderFlushesOnClose(t *testing.T) {
+	saver := &saverMock{}
+	recorder := NewRecorder(saver, 10)
+
+	for i := 0; i < 5; i++ {
+		assert.True(t, recorder.Record(storage.ClickEvent{LinkID: "link", Time: time.Now()}))
+	}
+
+	require.NoError(t, recorder.Close(context.Background()))
+	assert.Equal(t, 5, saver.saved())
+	assert.Equal(t, int64(0), recorder.Dropped())
+
+	assert.False(t, recorder.Record(storage.ClickEvent{LinkID: "link"}))
+	assert.Equal(t, int64(1), recorder.Dropped())
+}
+
+func TestRecorderFlushesByInterval(t *testing.T) {
+	saver := &saverMock{}
+	recorder := NewRecorder(saver, 10)
+	defer recorder.Close(context.Background())
+
+	recorder.Record(storage.ClickEvent{LinkID: "link"})
+
+	assert.Eventually(t, func() bool {
+		return saver.saved() == 1
+	}, 3*flushInterval, 10*time.Millisecond)
+}
+
+func TestRecorderDropsWhenFull(t *testing.T) {
+	saver := &saverMock{block: make(chan struct{})}
+	recorder := NewRecorder(saver, 2)
+
+	accepted := 0
+	for i := 0; i < batchSize+10; i++ {
+		if recorder.Record(storage.ClickEvent{LinkID: "link"}) {
+			accepted++
+		}
+	}
+
+	assert.Less(t, accepted, batchSize+10)
+	assert.Equal(t, int64(batchSize+10-accepted), recorder.Dropped())
+
+	close(saver.block)
+	require.NoError(t, recorder.Close(context.Background()))
+	assert.Equal(t, accepted, saver.saved())
+}
@@ -0,0 +1,301 @@
+// Package export writes click events and daily aggregates as CSV or
+// NDJSON. Rows are written as they are read, so memory use does not grow
+// with the size of the export.
+package export
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/irootpro/shorturl/internal/url/storage"
+)
+
+const (
+	FormatCSV    = "csv"
+	FormatNDJSON = "ndjson"
+
+	KindClicks = "clicks"
+	KindDaily  = "daily"
+
+	// flushRows is how many rows are buffered before they are flushed to
+	// the client.
+	flushRows = 256
+)
+
+var (
+	ErrFormat = errors.New("format must be csv or ndjson")
+	ErrKind   = errors.New("kind must be clicks or daily")
+	ErrRange  = errors.New("from must be before to")
+)
+
+// Source is the storage an export reads from.
+type Source interface {
+	EachClick(ctx context.Context, linkIDs []string, from, to time.Time, fn func(storage.ClickEvent) error) error
+	GetClickCounts(ctx context.Context, linkID string, from, to time.Time, period string) ([]storage.ClickCount, error)
+	GetSketches(ctx context.Context, linkID string, from, to time.Time) ([]storage.DailySketch, error)
+}
+
+type Query struct {
+	LinkIDs []string
+	From    time.Time
+	To      time.Time
+	Kind    string
+	Format  string
+}
+
+// Validate fills in the default kind and format. Daily exports cover whole
+// UTC days, their range is widened to the days it overlaps.
+func (q *Query) Validate() error {
+	if q.Kind == "" {
+		q.Kind = KindClicks
+	}
+	if q.Format == "" {
+		q.Format = FormatCSV
+	}
+
+	if q.Kind != KindClicks && q.Kind != KindDaily {
+		return ErrKind
+	}
+	if q.Format != FormatCSV && q.Format != FormatNDJSON {
+		return ErrFormat
+	}
+	if !q.From.Before(q.To) {
+		return ErrRange
+	}
+
+	if q.Kind == KindDaily {
+		q.From = storage.SketchDay(q.From)
+		if day := storage.SketchDay(q.To); day.Before(q.To) {
+			q.To = day.Add(24 * time.Hour)
+		}
+	}
+
+	return nil
+}
+
+// ContentType returns the media type of format.
+func ContentType(format string) string {
+	if format == FormatNDJSON {
+		return "application/x-ndjson"
+	}
+	return "text/csv; charset=utf-8"
+}
+
+// ParseTime reads a plain date as midnight UTC, or an RFC 3339 time.
+func ParseTime(value string) (time.Time, error) {
+	if t, err := time.Parse("2006-01-02", value); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// Click is an exported click event. The visitor hash is left out, it is
+// only meaningful for unique counts inside the service.
+type Click struct {
+	Time      time.Time `json:"time"`
+	LinkID    string    `json:"link_id"`
+	Referrer  string    `json:"referrer"`
+	UserAgent string    `json:"user_agent"`
+	Country   string    `json:"country"`
+	Device    string    `json:"device"`
+	Browser   string    `json:"browser"`
+	OS        string    `json:"os"`
+	Bot       bool      `json:"bot"`
+	Language  string    `json:"language"`
+}
+
+var clickHeader = []string{"time", "link_id", "referrer", "user_agent", "country", "device", "browser", "os", "bot", "language"}
+
+func (v Click) record() []string {
+	return []string{
+		v.Time.UTC().Format(time.RFC3339Nano), v.LinkID, v.Referrer, v.UserAgent,
+		v.Country, v.Device, v.Browser, v.OS, strconv.FormatBool(v.Bot), v.Language,
+	}
+}
+
+// Daily sums the clicks of a link on one UTC day. Clicks leaves out bots,
+// they are counted in BotClicks.
+type Daily struct {
+	Day            string `json:"day"`
+	LinkID         string `json:"link_id"`
+	Clicks         int64  `json:"clicks"`
+	BotClicks      int64  `json:"bot_clicks"`
+	UniqueVisitors int64  `json:"unique_visitors"`
+}
+
+var dailyHeader = []string{"day", "link_id", "clicks", "bot_clicks", "unique_visitors"}
+
+func (v Daily) record() []string {
+	return []string{
+		v.Day, v.LinkID, strconv.FormatInt(v.Clicks, 10),
+		strconv.FormatInt(v.BotClicks, 10), strconv.FormatInt(v.UniqueVisitors, 10),
+	}
+}
+
+type row interface {
+	record() []string
+}
+
+// Write writes the export of a validated query to w. When w is an
+// http.Flusher, rows are flushed as they are written.
+func Write(ctx context.Context, w io.Writer, src Source, q Query) error {
+	out := newEncoder(w, q.Format)
+
+	if q.Kind == KindDaily {
+		if err := out.header(dailyHeader); err != nil {
+			return err
+		}
+		if err := writeDaily(ctx, out, src, q); err != nil {
+			return err
+		}
+		return out.flush()
+	}
+
+	if err := out.header(clickHeader); err != nil {
+		return err
+	}
+	err := src.EachClick(ctx, q.LinkIDs, q.From, q.To, func(v storage.ClickEvent) error {
+		return out.encode(Click{
+			Time:      v.Time,
+			LinkID:    v.LinkID,
+			Referrer:  v.Referrer,
+			UserAgent: v.UserAgent,
+			Country:   v.Country,
+			Device:    v.Device,
+			Browser:   v.Browser,
+			OS:        v.OS,
+			Bot:       v.Bot,
+			Language:  v.Language,
+		})
+	})
+	if err != nil {
+		return err
+	}
+	return out.flush()
+}
+
+// writeDaily reads one link and day at a time, days without clicks are
+// left out.
+func writeDaily(ctx context.Context, out *encoder, src Source, q Query) error {
+	for day := q.From; day.Before(q.To); day = day.Add(24 * time.Hour) {
+		next := day.Add(24 * time.Hour)
+		for _, linkID := range q.LinkIDs {
+			counts, err := src.GetClickCounts(ctx, linkID, day, next, storage.PeriodDay)
+			if err != nil {
+				return err
+			}
+
+			v := Daily{Day: day.Format("2006-01-02"), LinkID: linkID}
+			for _, count := range counts {
+				if count.Bot {
+					v.BotClicks += count.Clicks
+				} else {
+					v.Clicks += count.Clicks
+				}
+			}
+			if v.Clicks == 0 && v.BotClicks == 0 {
+				continue
+			}
+
+			sketches, err := src.GetSketches(ctx, linkID, day, next)
+			if err != nil {
+				return err
+			}
+			for _, sketch := range sketches {
+				if !sketch.Bots {
+					v.UniqueVisitors = sketch.Sketch.Estimate()
+				}
+			}
+
+			if err = out.encode(v); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+type encoder struct {
+	w    io.Writer
+	buf  *bufio.Writer
+	csv  *csv.Writer
+	json *json.Encoder
+	rows int
+}
+
+func newEncoder(w io.Writer, format string) *encoder {
+	e := &encoder{w: w, buf: bufio.NewWriter(w)}
+	if format == FormatNDJSON {
+		e.json = json.NewEncoder(e.buf)
+		e.json.SetEscapeHTML(false)
+	} else {
+		e.csv = csv.NewWriter(e.buf)
+	}
+	return e
+}
+
+func (e *encoder) header(columns []string) error {
+	if e.csv == nil {
+		return nil
+	}
+	if err := e.csv.Write(columns); err != nil {
+		return fmt.Errorf("write header: %s", err.Error())
+	}
+	return nil
+}
+
+func (e *encoder) encode(v row) error {
+	var err error
+	if e.csv != nil {
+		err = e.csv.Write(escapeFormulas(v.record()))
+	} else {
+		err = e.json.Encode(v)
+	}
+	if err != nil {
+		return fmt.Errorf("write row: %s", err.Error())
+	}
+
+	e.rows++
+	if e.rows%flushRows == 0 {
+		return e.flush()
+	}
+	return nil
+}
+
+// escapeFormulas keeps spreadsheets from evaluating cells as formulas.
+// Referrers and user agents are sent by visitors, a cell starting with a
+// formula character is prefixed with a quote so it is shown as text.
+func escapeFormulas(record []string) []string {
+	for i, cell := range record {
+		if cell != "" && strings.ContainsRune("=+-@\t\r", rune(cell[0])) {
+			record[i] = "'" + cell
+		}
+	}
+	return record
+}
+
+func (e *encoder) flush() error {
+	if e.csv != nil {
+		e.csv.Flush()
+		if err := e.csv.Error(); err != nil {
+			return fmt.Errorf("flush rows: %s", err.Error())
+		}
+	}
+	if err := e.buf.Flush(); err != nil {
+		return fmt.Errorf("flush rows: %s", err.Error())
+	}
+	if flusher, ok := e.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	return nil
+}
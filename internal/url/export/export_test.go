@@ -0,0 +1,155 @@
+package export
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/irootpro/shorturl/internal/url/storage"
+)
+
+func visitor(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return hex.EncodeToString(sum[:])
+}
+
+func testSource(t *testing.T) (*storage.StorageMemory, time.Time) {
+	day := time.Date(2026, 3, 2, 0, 0, 0, 0, time.UTC)
+	source := storage.NewStorageMemory()
+	require.NoError(t, source.SaveClicks(context.Background(), []storage.ClickEvent{
+		{Time: day.Add(time.Hour), LinkID: "a", IPHash: visitor("1"), Referrer: "https://news.example.org/, \"quoted\"", Country: "DE", Language: "de"},
+		{Time: day.Add(2 * time.Hour), LinkID: "b", IPHash: visitor("2")},
+		{Time: day.Add(3 * time.Hour), LinkID: "a", IPHash: visitor("1")},
+		{Time: day.Add(4 * time.Hour), LinkID: "a", IPHash: visitor("3"), Bot: true},
+		{Time: day.Add(26 * time.Hour), LinkID: "a", IPHash: visitor("2")},
+		{Time: day.Add(50 * time.Hour), LinkID: "c", IPHash: visitor("4")},
+	}))
+	return source, day
+}
+
+func TestValidate(t *testing.T) {
+	day := time.Date(2026, 3, 2, 0, 0, 0, 0, time.UTC)
+
+	q := Query{From: day.Add(3 * time.Hour), To: day.Add(27 * time.Hour)}
+	require.NoError(t, q.Validate())
+	assert.Equal(t, KindClicks, q.Kind)
+	assert.Equal(t, FormatCSV, q.Format)
+	assert.Equal(t, day.Add(3*time.Hour), q.From)
+
+	q = Query{From: day.Add(3 * time.Hour), To: day.Add(27 * time.Hour), Kind: KindDaily}
+	require.NoError(t, q.Validate())
+	assert.Equal(t, day, q.From)
+	assert.Equal(t, day.Add(48*time.Hour), q.To)
+
+	assert.Equal(t, ErrKind, (&Query{From: day, To: day.Add(time.Hour), Kind: "hourly"}).Validate())
+	assert.Equal(t, ErrFormat, (&Query{From: day, To: day.Add(time.Hour), Format: "xml"}).Validate())
+	assert.Equal(t, ErrRange, (&Query{From: day, To: day}).Validate())
+}
+
+func TestWriteClicks(t *testing.T) {
+	source, day := testSource(t)
+
+	q := Query{LinkIDs: []string{"a", "b"}, From: day, To: day.Add(48 * time.Hour)}
+	require.NoError(t, q.Validate())
+	var out bytes.Buffer
+	require.NoError(t, Write(context.Background(), &out, source, q))
+
+	records, err := csv.NewReader(&out).ReadAll()
+	require.NoError(t, err)
+	require.Len(t, records, 6)
+	assert.Equal(t, clickHeader, records[0])
+	assert.Equal(t, []string{"2026-03-02T01:00:00Z", "a", "https://news.example.org/, \"quoted\"", "", "DE", "", "", "", "false", "de"}, records[1])
+	assert.Equal(t, "b", records[2][1])
+	assert.Equal(t, "true", records[4][8])
+	assert.Equal(t, "2026-03-03T02:00:00Z", records[5][0])
+
+	q.Format = FormatNDJSON
+	out.Reset()
+	require.NoError(t, Write(context.Background(), &out, source, q))
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	require.Len(t, lines, 5)
+	var click Click
+	require.NoError(t, json.Unmarshal([]byte(lines[0]), &click))
+	assert.Equal(t, "a", click.LinkID)
+	assert.Equal(t, "de", click.Language)
+	assert.True(t, day.Add(time.Hour).Equal(click.Time))
+	assert.NotContains(t, out.String(), visitor("1"), "visitor hashes are not exported")
+}
+
+func TestWriteDaily(t *testing.T) {
+	source, day := testSource(t)
+
+	q := Query{LinkIDs: []string{"a", "b"}, From: day, To: day.Add(72 * time.Hour), Kind: KindDaily, Format: FormatNDJSON}
+	require.NoError(t, q.Validate())
+
+	write := func() []Daily {
+		var out bytes.Buffer
+		require.NoError(t, Write(context.Background(), &out, source, q))
+		var rows []Daily
+		decoder := json.NewDecoder(&out)
+		for decoder.More() {
+			var v Daily
+			require.NoError(t, decoder.Decode(&v))
+			rows = append(rows, v)
+		}
+		return rows
+	}
+
+	want := []Daily{
+		{Day: "2026-03-02", LinkID: "a", Clicks: 2, BotClicks: 1, UniqueVisitors: 1},
+		{Day: "2026-03-02", LinkID: "b", Clicks: 1, UniqueVisitors: 1},
+		{Day: "2026-03-03", LinkID: "a", Clicks: 1, UniqueVisitors: 1},
+	}
+	assert.Equal(t, want, write())
+
+	_, err := source.Rollup(context.Background(), day.Add(72*time.Hour))
+	require.NoError(t, err)
+	_, err = source.DeleteClicks(context.Background(), day.Add(72*time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, want, write(), "rolled up clicks export the same")
+
+	q.Format = FormatCSV
+	var out bytes.Buffer
+	require.NoError(t, Write(context.Background(), &out, source, q))
+	assert.Equal(t, "day,link_id,clicks,bot_clicks,unique_visitors\n"+
+		"2026-03-02,a,2,1,1\n2026-03-02,b,1,0,1\n2026-03-03,a,1,0,1\n", out.String())
+}
+
+func TestWriteEscapesFormulas(t *testing.T) {
+	day := time.Date(2026, 3, 2, 0, 0, 0, 0, time.UTC)
+	source := storage.NewStorageMemory()
+	require.NoError(t, source.SaveClicks(context.Background(), []storage.ClickEvent{
+		{Time: day.Add(time.Hour), LinkID: "a", Referrer: "=HYPERLINK(\"https://evil.example\")", UserAgent: "@SUM(1+1)"},
+		{Time: day.Add(2 * time.Hour), LinkID: "a", Referrer: "-2+3", UserAgent: "\tcmd"},
+		{Time: day.Add(3 * time.Hour), LinkID: "a", Referrer: "https://news.example.org/?q=1", UserAgent: "Mozilla/5.0"},
+	}))
+
+	q := Query{LinkIDs: []string{"a"}, From: day, To: day.Add(24 * time.Hour)}
+	require.NoError(t, q.Validate())
+	var buf bytes.Buffer
+	require.NoError(t, Write(context.Background(), &buf, source, q))
+
+	records, err := csv.NewReader(&buf).ReadAll()
+	require.NoError(t, err)
+	require.Len(t, records, 4)
+	assert.Equal(t, []string{"'=HYPERLINK(\"https://evil.example\")", "'@SUM(1+1)"}, records[1][2:4])
+	assert.Equal(t, []string{"'-2+3", "'\tcmd"}, records[2][2:4])
+	assert.Equal(t, []string{"https://news.example.org/?q=1", "Mozilla/5.0"}, records[3][2:4])
+
+	q.Format = FormatNDJSON
+	buf.Reset()
+	require.NoError(t, Write(context.Background(), &buf, source, q))
+	var click Click
+	require.NoError(t, json.NewDecoder(&buf).Decode(&click))
+	assert.Equal(t, "=HYPERLINK(\"https://evil.example\")", click.Referrer, "NDJSON is not escaped")
+}
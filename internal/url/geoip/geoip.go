@@ -0,0 +1,59 @@
+package geoip
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+type Location struct {
+	Country   string
+	Continent string
+}
+
+// record holds the subset of GeoIP2/GeoLite2 Country and City databases
+// used for routing.
+type record struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	Continent struct {
+		Code string `maxminddb:"code"`
+	} `maxminddb:"continent"`
+}
+
+type Reader struct {
+	db *maxminddb.Reader
+}
+
+func Open(path string) (*Reader, error) {
+	db, err := maxminddb.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open geoip database: %s", err.Error())
+	}
+
+	return &Reader{
+		db: db,
+	}, nil
+}
+
+func (r *Reader) Lookup(ip net.IP) (Location, error) {
+	if ip == nil {
+		return Location{}, fmt.Errorf("lookup: invalid ip address")
+	}
+
+	var rec record
+	if err := r.db.Lookup(ip, &rec); err != nil {
+		return Location{}, fmt.Errorf("lookup %s: %s", ip, err.Error())
+	}
+
+	return Location{
+		Country:   rec.Country.ISOCode,
+		Continent: rec.Continent.Code,
+	}, nil
+}
+
+func (r *Reader) Close() error {
+	return r.db.Close()
+}
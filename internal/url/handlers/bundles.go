@@ -0,0 +1,257 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+
+	apiError "github.com/irootpro/shorturl/internal/error"
+	"github.com/irootpro/shorturl/internal/url/storage"
+	"github.com/irootpro/shorturl/internal/url/usecases"
+)
+
+var bundleThemes = map[string]bool{
+	"":      true,
+	"light": true,
+	"dark":  true,
+}
+
+type BundleRequest struct {
+	Title       string              `json:"title"`
+	Description string              `json:"description,omitempty"`
+	Theme       string              `json:"theme,omitempty"`
+	Items       []BundleItemRequest `json:"items"`
+}
+
+type BundleItemRequest struct {
+	Title string `json:"title"`
+	URL   string `json:"url"`
+}
+
+type bundlePage struct {
+	storage.Bundle
+	ItemURLs []string
+}
+
+func (r BundleRequest) validate() error {
+	if r.Title == "" {
+		return errors.New("bundle title is required")
+	}
+	if !bundleThemes[r.Theme] {
+		return fmt.Errorf("unknown theme %q", r.Theme)
+	}
+	if len(r.Items) == 0 {
+		return errors.New("bundle items are required")
+	}
+	for _, item := range r.Items {
+		if item.Title == "" || item.URL == "" {
+			return errors.New("bundle item title and url are required")
+		}
+	}
+	return nil
+}
+
+func (h *ServerHandler) bundleResponse(bundle storage.Bundle) storage.Bundle {
+	bundle.ShortURL = fmt.Sprintf("%s/%s", h.cfg.BaseURL, bundle.ID)
+	bundle.UserID = ""
+	return bundle
+}
+
+// ownBundle loads the bundle from the code parameter if it belongs to the
+// caller, other users' bundles are reported as missing.
+func (h *ServerHandler) ownBundle(c echo.Context) (storage.Bundle, error) {
+	userID, ok := h.currentUser(c)
+	if !ok {
+		return storage.Bundle{}, apiError.ErrBundleNotFound
+	}
+
+	bundle, err := h.storage.GetBundle(c.Param("code"))
+	if err != nil {
+		return storage.Bundle{}, err
+	}
+	if bundle.UserID != userID {
+		return storage.Bundle{}, apiError.ErrBundleNotFound
+	}
+
+	return bundle, nil
+}
+
+func bundleError(c echo.Context, err error) error {
+	if errors.Is(err, apiError.ErrBundleNotFound) {
+		return c.String(http.StatusNotFound, "bundle not found")
+	}
+	fmt.Printf("bundle: %s", err.Error())
+	return c.String(http.StatusInternalServerError, "")
+}
+
+func itemsFromRequest(request []BundleItemRequest, previous []storage.BundleItem) []storage.BundleItem {
+	clicks := make(map[string]int64)
+	for _, item := range previous {
+		clicks[item.URL] += item.Clicks
+	}
+
+	items := make([]storage.BundleItem, 0, len(request))
+	for _, item := range request {
+		items = append(items, storage.BundleItem{
+			Title:  item.Title,
+			URL:    item.URL,
+			Clicks: clicks[item.URL],
+		})
+		delete(clicks, item.URL)
+	}
+	return items
+}
+
+func (h *ServerHandler) PostBundle(c echo.Context) error {
+	userID := h.sessionUser(c).ID
+
+	var request BundleRequest
+	if err := c.Bind(&request); err != nil {
+		return c.String(http.StatusBadRequest, "error read bundle from request")
+	}
+
+	if err := request.validate(); err != nil {
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+
+	code, err := usecases.GenerateCode()
+	if err != nil {
+		return c.String(http.StatusInternalServerError, "")
+	}
+
+	bundle := storage.Bundle{
+		ID:          code,
+		UserID:      userID,
+		Title:       request.Title,
+		Description: request.Description,
+		Theme:       request.Theme,
+		Items:       itemsFromRequest(request.Items, nil),
+	}
+
+	if err := h.storage.PutBundle(bundle); err != nil {
+		return bundleError(c, err)
+	}
+
+	return c.JSON(http.StatusCreated, h.bundleResponse(bundle))
+}
+
+func (h *ServerHandler) GetBundles(c echo.Context) error {
+	userID, ok := h.currentUser(c)
+	if !ok {
+		return c.NoContent(http.StatusNoContent)
+	}
+
+	bundles, err := h.storage.GetBundles(userID)
+	if err != nil {
+		return bundleError(c, err)
+	}
+
+	if len(bundles) == 0 {
+		return c.NoContent(http.StatusNoContent)
+	}
+
+	for i := range bundles {
+		bundles[i] = h.bundleResponse(bundles[i])
+	}
+
+	return c.JSON(http.StatusOK, bundles)
+}
+
+func (h *ServerHandler) GetBundle(c echo.Context) error {
+	bundle, err := h.ownBundle(c)
+	if err != nil {
+		return bundleError(c, err)
+	}
+
+	return c.JSON(http.StatusOK, h.bundleResponse(bundle))
+}
+
+func (h *ServerHandler) PutBundle(c echo.Context) error {
+	bundle, err := h.ownBundle(c)
+	if err != nil {
+		return bundleError(c, err)
+	}
+
+	var request BundleRequest
+	if err := c.Bind(&request); err != nil {
+		return c.String(http.StatusBadRequest, "error read bundle from request")
+	}
+
+	if err := request.validate(); err != nil {
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+
+	// The clicks are taken over from the locked bundle, not the one read
+	// above, so visits in between are kept.
+	err = h.storage.ModifyBundle(bundle.ID, func(stored *storage.Bundle) error {
+		stored.Title = request.Title
+		stored.Description = request.Description
+		stored.Theme = request.Theme
+		stored.Items = itemsFromRequest(request.Items, stored.Items)
+		bundle = *stored
+		return nil
+	})
+	if err != nil {
+		return bundleError(c, err)
+	}
+
+	return c.JSON(http.StatusOK, h.bundleResponse(bundle))
+}
+
+func (h *ServerHandler) DeleteBundle(c echo.Context) error {
+	bundle, err := h.ownBundle(c)
+	if err != nil {
+		return bundleError(c, err)
+	}
+
+	if err := h.storage.DeleteBundle(bundle.ID); err != nil {
+		return bundleError(c, err)
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// renderBundle serves the landing page of a bundle, items link to
+// GetBundleItem so their clicks are counted.
+func (h *ServerHandler) renderBundle(c echo.Context, bundle storage.Bundle) error {
+	page := bundlePage{Bundle: bundle}
+	for i := range bundle.Items {
+		page.ItemURLs = append(page.ItemURLs, fmt.Sprintf("/%s/%d", bundle.ID, i))
+	}
+
+	body, err := h.pages.Render("bundle.html", page)
+	if err != nil {
+		fmt.Printf("render bundle: %s", err.Error())
+		return c.String(http.StatusInternalServerError, "")
+	}
+
+	return c.HTMLBlob(http.StatusOK, body)
+}
+
+func (h *ServerHandler) GetBundleItem(c echo.Context) error {
+	bundle, err := h.storage.GetBundle(c.Param("hash"))
+	if err != nil {
+		if errors.Is(err, apiError.ErrBundleNotFound) {
+			return h.linkError(c, apiError.ErrLinkNotFound)
+		}
+		return h.linkError(c, err)
+	}
+
+	item, err := strconv.Atoi(c.Param("item"))
+	if err != nil || item < 0 || item >= len(bundle.Items) {
+		return h.linkError(c, apiError.ErrLinkNotFound)
+	}
+
+	if c.Request().Method != http.MethodHead {
+		if err := h.storage.IncrementBundleItemClicks(bundle.ID, item); err != nil {
+			fmt.Printf("count bundle item click: %s", err.Error())
+		}
+	}
+
+	c.Response().Header().Set(echo.HeaderCacheControl, "private, no-store")
+	c.Response().Header().Set("Location", bundle.Items[item].URL)
+	return c.String(http.StatusTemporaryRedirect, "")
+}
@@ -0,0 +1,85 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/irootpro/shorturl/internal/url/storage"
+)
+
+// redirectMaxAge is the freshness of a 307 redirect. The redirect is
+// temporary, so caches may keep it only briefly; the link can be changed or
+// deleted by its owner at any time.
+const redirectMaxAge = 5 * time.Minute
+
+// setRedirectCache emits caching headers for a redirect of link. Redirects
+// that depend on the client or count clicks must never be served by shared
+// caches, others are cacheable until the link expires.
+//
+// Caching and click analytics exclude each other: a redirect served from a
+// cache never reaches the server and is a lost click. The shortener binary
+// always records clicks, so it sends "private, no-cache" for every redirect
+// and CDNs revalidate each one. The public max-age only applies to handlers
+// built without a click recorder and live hub.
+func (h *ServerHandler) setRedirectCache(c echo.Context, link storage.LinkEntity, now time.Time) {
+	header := c.Response().Header()
+
+	if isPersonalized(link) {
+		header.Set(echo.HeaderCacheControl, "private, no-store")
+		return
+	}
+
+	if h.clicks != nil || h.live != nil {
+		header.Set(echo.HeaderCacheControl, "private, no-cache")
+		return
+	}
+
+	maxAge := redirectMaxAge
+	if link.ExpiresAt != nil {
+		if untilExpiry := link.ExpiresAt.Sub(now); untilExpiry < maxAge {
+			maxAge = untilExpiry
+		}
+	}
+	if maxAge <= 0 {
+		header.Set(echo.HeaderCacheControl, "no-cache")
+		return
+	}
+
+	header.Set(echo.HeaderCacheControl, fmt.Sprintf("public, max-age=%d", int(maxAge.Seconds())))
+	header.Set("Expires", now.Add(maxAge).UTC().Format(http.TimeFormat))
+}
+
+func isPersonalized(link storage.LinkEntity) bool {
+	return len(link.Rules) != 0 ||
+		len(link.GeoRules) != 0 ||
+		len(link.Variants) != 0 ||
+		len(link.Languages) != 0 ||
+		link.MaxClicks > 0 ||
+		link.PasswordHash != "" ||
+		link.CampaignID != "" ||
+		link.Conversions != nil
+}
+
+// etag returns a strong entity tag of a response body.
+func etag(body []byte) string {
+	sum := sha256.Sum256(body)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// etagMatches implements the If-None-Match comparison, weak tags compare
+// equal to strong ones for GET requests.
+func etagMatches(ifNoneMatch, tag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == tag {
+			return true
+		}
+	}
+	return false
+}
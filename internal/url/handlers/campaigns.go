@@ -0,0 +1,332 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+
+	"github.com/labstack/echo/v4"
+
+	apiError "github.com/irootpro/shorturl/internal/error"
+	"github.com/irootpro/shorturl/internal/url/stats"
+	"github.com/irootpro/shorturl/internal/url/storage"
+	"github.com/irootpro/shorturl/internal/url/usecases"
+)
+
+// CampaignRequest creates or replaces a campaign. Links are short link IDs
+// of the caller, on update a missing links field keeps the members.
+type CampaignRequest struct {
+	Name        string            `json:"name"`
+	Description string            `json:"description,omitempty"`
+	Params      map[string]string `json:"params,omitempty"`
+	Links       []string          `json:"links"`
+}
+
+// CampaignReport is the stats report over all member links with the clicks
+// of each link.
+type CampaignReport struct {
+	stats.Report
+	CampaignID string          `json:"campaign_id"`
+	Links      []CampaignClick `json:"links"`
+}
+
+type CampaignClick struct {
+	LinkID   string `json:"link_id"`
+	ShortURL string `json:"short_url"`
+	Clicks   int64  `json:"clicks"`
+}
+
+func (r CampaignRequest) validate() error {
+	if r.Name == "" {
+		return errors.New("campaign name is required")
+	}
+	for key := range r.Params {
+		if key == "" {
+			return errors.New("campaign param names must not be empty")
+		}
+	}
+	return nil
+}
+
+func (h *ServerHandler) campaignResponse(campaign storage.Campaign) storage.Campaign {
+	campaign.UserID = ""
+	if campaign.Links == nil {
+		campaign.Links = []string{}
+	}
+	return campaign
+}
+
+// ownCampaign loads the campaign from the code parameter if it belongs to
+// the caller, other users' campaigns are reported as missing.
+func (h *ServerHandler) ownCampaign(c echo.Context) (storage.Campaign, error) {
+	userID, ok := h.currentUser(c)
+	if !ok {
+		return storage.Campaign{}, apiError.ErrCampaignNotFound
+	}
+
+	campaign, err := h.storage.GetCampaign(c.Param("code"))
+	if err != nil {
+		return storage.Campaign{}, err
+	}
+	if campaign.UserID != userID {
+		return storage.Campaign{}, apiError.ErrCampaignNotFound
+	}
+
+	return campaign, nil
+}
+
+func campaignError(c echo.Context, err error) error {
+	if errors.Is(err, apiError.ErrCampaignNotFound) {
+		return c.String(http.StatusNotFound, "campaign not found")
+	}
+	fmt.Printf("campaign: %s", err.Error())
+	return c.String(http.StatusInternalServerError, "")
+}
+
+// checkCampaignLinks makes sure every link exists and belongs to userID.
+func (h *ServerHandler) checkCampaignLinks(userID string, linkIDs []string) error {
+	for _, id := range linkIDs {
+		link, err := h.storage.GetLink(id)
+		if errors.Is(err, apiError.ErrLinkNotFound) || errors.Is(err, apiError.ErrDeleteLink) || (err == nil && link.UserID != userID) {
+			return fmt.Errorf("link %s not found", id)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (h *ServerHandler) PostCampaign(c echo.Context) error {
+	userID := h.sessionUser(c).ID
+
+	var request CampaignRequest
+	if err := c.Bind(&request); err != nil {
+		return c.String(http.StatusBadRequest, "error read campaign from request")
+	}
+
+	if err := request.validate(); err != nil {
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+
+	if err := h.checkCampaignLinks(userID, request.Links); err != nil {
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+
+	code, err := usecases.GenerateCode()
+	if err != nil {
+		return c.String(http.StatusInternalServerError, "")
+	}
+
+	campaign := storage.Campaign{
+		ID:          code,
+		UserID:      userID,
+		Name:        request.Name,
+		Description: request.Description,
+		Params:      request.Params,
+	}
+
+	if err := h.storage.PutCampaign(campaign); err != nil {
+		return campaignError(c, err)
+	}
+
+	if err := h.storage.SetCampaignLinks(campaign.ID, request.Links); err != nil {
+		return campaignError(c, err)
+	}
+
+	if campaign, err = h.storage.GetCampaign(campaign.ID); err != nil {
+		return campaignError(c, err)
+	}
+
+	return c.JSON(http.StatusCreated, h.campaignResponse(campaign))
+}
+
+func (h *ServerHandler) GetCampaigns(c echo.Context) error {
+	userID, ok := h.currentUser(c)
+	if !ok {
+		return c.NoContent(http.StatusNoContent)
+	}
+
+	campaigns, err := h.storage.GetCampaigns(userID)
+	if err != nil {
+		return campaignError(c, err)
+	}
+
+	if len(campaigns) == 0 {
+		return c.NoContent(http.StatusNoContent)
+	}
+
+	for i := range campaigns {
+		campaigns[i] = h.campaignResponse(campaigns[i])
+	}
+
+	return c.JSON(http.StatusOK, campaigns)
+}
+
+func (h *ServerHandler) GetCampaign(c echo.Context) error {
+	campaign, err := h.ownCampaign(c)
+	if err != nil {
+		return campaignError(c, err)
+	}
+
+	return c.JSON(http.StatusOK, h.campaignResponse(campaign))
+}
+
+func (h *ServerHandler) PutCampaign(c echo.Context) error {
+	campaign, err := h.ownCampaign(c)
+	if err != nil {
+		return campaignError(c, err)
+	}
+
+	var request CampaignRequest
+	if err := c.Bind(&request); err != nil {
+		return c.String(http.StatusBadRequest, "error read campaign from request")
+	}
+
+	if err := request.validate(); err != nil {
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+
+	if err := h.checkCampaignLinks(campaign.UserID, request.Links); err != nil {
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+
+	campaign.Name = request.Name
+	campaign.Description = request.Description
+	campaign.Params = request.Params
+
+	if err := h.storage.UpdateCampaign(campaign); err != nil {
+		return campaignError(c, err)
+	}
+
+	if request.Links != nil {
+		if err := h.storage.SetCampaignLinks(campaign.ID, request.Links); err != nil {
+			return campaignError(c, err)
+		}
+	}
+
+	if campaign, err = h.storage.GetCampaign(campaign.ID); err != nil {
+		return campaignError(c, err)
+	}
+
+	return c.JSON(http.StatusOK, h.campaignResponse(campaign))
+}
+
+// DeleteCampaign removes the campaign, its links keep working without the
+// campaign params.
+func (h *ServerHandler) DeleteCampaign(c echo.Context) error {
+	campaign, err := h.ownCampaign(c)
+	if err != nil {
+		return campaignError(c, err)
+	}
+
+	if err := h.storage.DeleteCampaign(campaign.ID); err != nil {
+		return campaignError(c, err)
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// GetCampaignStats reports the clicks of all member links together, with
+// the same parameters as GetStats, and the clicks of each link.
+func (h *ServerHandler) GetCampaignStats(c echo.Context) error {
+	campaign, err := h.ownCampaign(c)
+	if err != nil {
+		return campaignError(c, err)
+	}
+
+	query, err := statsQuery(c)
+	if err != nil {
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+
+	var counts []storage.ClickCount
+	var sketches []storage.DailySketch
+	perLink := make([]CampaignClick, 0, len(campaign.Links))
+	for _, linkID := range campaign.Links {
+		linkCounts, err := h.storage.GetClickCounts(c.Request().Context(), linkID, query.From, query.To, query.Period())
+		if err != nil {
+			fmt.Printf("campaign stats: %s", err.Error())
+			return c.String(http.StatusInternalServerError, "")
+		}
+
+		linkSketches, err := h.storage.GetSketches(c.Request().Context(), linkID, query.From, query.To)
+		if err != nil {
+			fmt.Printf("campaign stats: %s", err.Error())
+			return c.String(http.StatusInternalServerError, "")
+		}
+
+		clicks := CampaignClick{LinkID: linkID, ShortURL: fmt.Sprintf("%s/%s", h.cfg.BaseURL, linkID)}
+		for _, count := range linkCounts {
+			if !count.Bot || query.IncludeBots {
+				clicks.Clicks += count.Clicks
+			}
+		}
+
+		counts = append(counts, linkCounts...)
+		sketches = append(sketches, linkSketches...)
+		perLink = append(perLink, clicks)
+	}
+
+	sort.SliceStable(perLink, func(i, j int) bool {
+		return perLink[i].Clicks > perLink[j].Clicks
+	})
+
+	return c.JSON(http.StatusOK, CampaignReport{
+		Report:     h.statsReport(counts, sketches, query),
+		CampaignID: campaign.ID,
+		Links:      perLink,
+	})
+}
+
+// withCampaignParams adds the params of the link's campaign to destination.
+// Params the destination sets itself are kept, the campaign only fills in
+// defaults. A campaign that cannot be read leaves the destination as is.
+func (h *ServerHandler) withCampaignParams(link storage.LinkEntity, destination string) string {
+	if link.CampaignID == "" {
+		return destination
+	}
+
+	campaign, err := h.storage.GetCampaign(link.CampaignID)
+	if err != nil {
+		if !errors.Is(err, apiError.ErrCampaignNotFound) {
+			fmt.Printf("campaign params: %s", err.Error())
+		}
+		return destination
+	}
+
+	return appendParams(destination, campaign.Params)
+}
+
+// appendParams adds params missing from rawURL after its own query, which
+// is left untouched.
+func appendParams(rawURL string, params map[string]string) string {
+	if len(params) == 0 {
+		return rawURL
+	}
+
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+
+	existing := parsed.Query()
+	extra := url.Values{}
+	for key, value := range params {
+		if _, ok := existing[key]; !ok {
+			extra.Set(key, value)
+		}
+	}
+	if len(extra) == 0 {
+		return rawURL
+	}
+
+	if parsed.RawQuery == "" {
+		parsed.RawQuery = extra.Encode()
+	} else {
+		parsed.RawQuery += "&" + extra.Encode()
+	}
+	return parsed.String()
+}
@@ -0,0 +1,78 @@
+package handlers
+
+import (
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/irootpro/shorturl/internal/url/live"
+	"github.com/irootpro/shorturl/internal/url/storage"
+	"github.com/irootpro/shorturl/internal/url/useragent"
+)
+
+type ClickRecorder interface {
+	Record(event storage.ClickEvent) bool
+}
+
+func WithUserAgentClassifier(classifier *useragent.Classifier) Option {
+	return func(h *ServerHandler) {
+		h.agents = classifier
+	}
+}
+
+func WithClickRecorder(recorder ClickRecorder) Option {
+	return func(h *ServerHandler) {
+		h.clicks = recorder
+	}
+}
+
+// recordClick hands the redirect over to the click pipeline and the live
+// event stream. It must stay cheap: the recorder drops events and the hub
+// drops slow subscribers instead of blocking the redirect.
+func (h *ServerHandler) recordClick(c echo.Context, link storage.LinkEntity) {
+	if (h.clicks == nil && h.live == nil) || c.Request().Method == http.MethodHead {
+		return
+	}
+
+	agent := h.userAgent(c)
+	event := storage.ClickEvent{
+		Time:      time.Now().UTC(),
+		LinkID:    link.ID,
+		Referrer:  c.Request().Referer(),
+		UserAgent: c.Request().UserAgent(),
+		Device:    agent.Device,
+		Browser:   agent.Browser,
+		OS:        agent.OS,
+		Bot:       agent.Bot,
+	}
+	event.Language, _ = c.Get(languageKey).(string)
+
+	if h.geo != nil {
+		if location, err := h.geo.Lookup(net.ParseIP(c.RealIP())); err == nil {
+			event.Country = location.Country
+		}
+	}
+
+	h.privacy.Apply(c.Request(), c.RealIP(), &event)
+
+	if h.clicks != nil {
+		h.clicks.Record(event)
+	}
+
+	if h.live != nil {
+		h.live.Publish(live.Event{
+			UserID:   link.UserID,
+			LinkID:   link.ID,
+			Time:     event.Time,
+			Referrer: event.Referrer,
+			Country:  event.Country,
+			Device:   event.Device,
+			Browser:  event.Browser,
+			OS:       event.OS,
+			Language: event.Language,
+			Bot:      event.Bot,
+		})
+	}
+}
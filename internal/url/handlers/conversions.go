@@ -0,0 +1,283 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/irootpro/shorturl/internal/url/service"
+	"github.com/irootpro/shorturl/internal/url/storage"
+)
+
+const (
+	// clickIDParam is the default query parameter and the cookie the click
+	// ID is passed in.
+	clickIDParam = "click_id"
+	// conversionWindow is how long after the click a conversion counts.
+	conversionWindow = 30 * 24 * time.Hour
+)
+
+var (
+	errClickID        = errors.New("invalid click id")
+	errClickIDExpired = errors.New("click id expired")
+)
+
+// transparentGIF is a 1x1 transparent GIF served by the conversion pixel.
+var transparentGIF = []byte{
+	0x47, 0x49, 0x46, 0x38, 0x39, 0x61, 0x01, 0x00, 0x01, 0x00, 0x80, 0x00, 0x00, 0x00, 0x00, 0x00,
+	0xff, 0xff, 0xff, 0x21, 0xf9, 0x04, 0x01, 0x00, 0x00, 0x00, 0x00, 0x2c, 0x00, 0x00, 0x00, 0x00,
+	0x01, 0x00, 0x01, 0x00, 0x00, 0x02, 0x02, 0x44, 0x01, 0x00, 0x3b,
+}
+
+// ConversionReport compares the clicks of a link with the conversions of
+// those clicks, per UTC day of the click. Bot clicks are not counted.
+type ConversionReport struct {
+	LinkID      string          `json:"link_id"`
+	From        time.Time       `json:"from"`
+	To          time.Time       `json:"to"`
+	Clicks      int64           `json:"clicks"`
+	Conversions int64           `json:"conversions"`
+	Rate        float64         `json:"rate"`
+	Days        []ConversionDay `json:"days"`
+}
+
+type ConversionDay struct {
+	Day         time.Time `json:"day"`
+	Clicks      int64     `json:"clicks"`
+	Conversions int64     `json:"conversions"`
+	Rate        float64   `json:"rate"`
+}
+
+type ConversionResponse struct {
+	ClickID string `json:"click_id"`
+	LinkID  string `json:"link_id"`
+	Status  string `json:"status"`
+}
+
+func validateConversions(tracking *storage.ConversionTracking) error {
+	if tracking == nil {
+		return nil
+	}
+	if tracking.Mode != storage.ClickIDQuery && tracking.Mode != storage.ClickIDCookie {
+		return fmt.Errorf("conversion mode must be %q or %q", storage.ClickIDQuery, storage.ClickIDCookie)
+	}
+	return nil
+}
+
+// PutConversions turns click IDs on for the link, an empty body or null
+// turns them off.
+func (h *ServerHandler) PutConversions(c echo.Context) error {
+	var tracking *storage.ConversionTracking
+	if c.Request().ContentLength != 0 {
+		if err := c.Bind(&tracking); err != nil {
+			return c.String(http.StatusBadRequest, "error read conversions from request")
+		}
+	}
+
+	if err := validateConversions(tracking); err != nil {
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+	if tracking != nil && tracking.Param == "" {
+		tracking.Param = clickIDParam
+	}
+
+	return h.updateLink(c, func(link *storage.LinkEntity) interface{} {
+		link.Conversions = tracking
+		return link.Conversions
+	})
+}
+
+// withClickID issues a click ID for a redirect of a link with conversion
+// tracking and passes it on as configured. HEAD requests are not clicks
+// and get none.
+func (h *ServerHandler) withClickID(c echo.Context, link storage.LinkEntity, destination string, now time.Time) string {
+	if link.Conversions == nil || c.Request().Method == http.MethodHead {
+		return destination
+	}
+
+	clickID := service.NewClickID(link.ID, now)
+	if link.Conversions.Mode == storage.ClickIDCookie {
+		cookie := &http.Cookie{
+			Name:     clickIDParam,
+			Value:    clickID,
+			Path:     "/",
+			Expires:  now.Add(conversionWindow),
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		}
+		// The pixel is loaded from the landing page, another site, so the
+		// cookie has to be sent with cross-site requests.
+		if strings.HasPrefix(h.cfg.BaseURL, "https://") {
+			cookie.SameSite = http.SameSiteNoneMode
+			cookie.Secure = true
+		}
+		c.SetCookie(cookie)
+		return destination
+	}
+
+	param := link.Conversions.Param
+	if param == "" {
+		param = clickIDParam
+	}
+	return appendParams(destination, map[string]string{param: clickID})
+}
+
+// recordConversion checks clickID and saves its conversion, it reports
+// whether the click had not converted before.
+func (h *ServerHandler) recordConversion(c echo.Context, clickID, source string) (storage.Conversion, bool, error) {
+	linkID, clickedAt, ok := service.ParseClickID(clickID)
+	if !ok {
+		return storage.Conversion{}, false, errClickID
+	}
+
+	now := time.Now()
+	if now.Sub(clickedAt) > conversionWindow {
+		return storage.Conversion{}, false, errClickIDExpired
+	}
+
+	conversion := storage.Conversion{
+		ClickID:     clickID,
+		LinkID:      linkID,
+		ClickedAt:   clickedAt,
+		ConvertedAt: now.UTC(),
+		Source:      source,
+	}
+	created, err := h.storage.SaveConversion(c.Request().Context(), conversion)
+	return conversion, created, err
+}
+
+// GetConversionPixel records a conversion for the click ID in the click_id
+// parameter or cookie. It always answers with the pixel, so a broken ID
+// does not show up as a broken image on the landing page.
+func (h *ServerHandler) GetConversionPixel(c echo.Context) error {
+	clickID := c.QueryParam(clickIDParam)
+	if clickID == "" {
+		if cookie, err := c.Cookie(clickIDParam); err == nil {
+			clickID = cookie.Value
+		}
+	}
+
+	if clickID != "" {
+		if _, _, err := h.recordConversion(c, clickID, storage.ConversionPixel); err != nil &&
+			!errors.Is(err, errClickID) && !errors.Is(err, errClickIDExpired) {
+			fmt.Printf("conversion pixel: %s", err.Error())
+		}
+	}
+
+	c.Response().Header().Set(echo.HeaderCacheControl, "no-store")
+	return c.Blob(http.StatusOK, "image/gif", transparentGIF)
+}
+
+// PostConversion is the server-to-server postback, it records a conversion
+// for the click_id form or query parameter. Repeated postbacks of a click
+// are accepted and counted once.
+func (h *ServerHandler) PostConversion(c echo.Context) error {
+	clickID := c.FormValue(clickIDParam)
+	if clickID == "" {
+		return c.String(http.StatusBadRequest, "click_id is required")
+	}
+
+	conversion, created, err := h.recordConversion(c, clickID, storage.ConversionPostback)
+	if err != nil {
+		if errors.Is(err, errClickID) || errors.Is(err, errClickIDExpired) {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+		fmt.Printf("conversion postback: %s", err.Error())
+		return c.String(http.StatusInternalServerError, "")
+	}
+
+	response := ConversionResponse{ClickID: conversion.ClickID, LinkID: conversion.LinkID, Status: "recorded"}
+	if !created {
+		response.Status = "duplicate"
+		return c.JSON(http.StatusOK, response)
+	}
+	return c.JSON(http.StatusCreated, response)
+}
+
+// GetConversions reports clicks, conversions and conversion rate of one
+// link to its owner. from and to are dates or RFC 3339 times, the range is
+// widened to whole UTC days.
+func (h *ServerHandler) GetConversions(c echo.Context) error {
+	link, err := h.ownLink(c)
+	if err != nil {
+		return ownLinkError(c, err)
+	}
+
+	to := time.Now()
+	if value := c.QueryParam("to"); value != "" {
+		if to, err = parseStatsTime(value, time.UTC); err != nil {
+			return c.String(http.StatusBadRequest, fmt.Sprintf("invalid to: %s", err.Error()))
+		}
+	}
+
+	from := to.Add(-defaultStatsRange)
+	if value := c.QueryParam("from"); value != "" {
+		if from, err = parseStatsTime(value, time.UTC); err != nil {
+			return c.String(http.StatusBadRequest, fmt.Sprintf("invalid from: %s", err.Error()))
+		}
+	}
+
+	from = storage.SketchDay(from)
+	if day := storage.SketchDay(to); day.Before(to) {
+		to = day.Add(24 * time.Hour)
+	}
+	if !from.Before(to) {
+		return c.String(http.StatusBadRequest, "from must be before to")
+	}
+
+	counts, err := h.storage.GetClickCounts(c.Request().Context(), link.ID, from, to, storage.PeriodDay)
+	if err != nil {
+		fmt.Printf("conversions: %s", err.Error())
+		return c.String(http.StatusInternalServerError, "")
+	}
+
+	conversions, err := h.storage.GetConversionCounts(c.Request().Context(), link.ID, from, to)
+	if err != nil {
+		fmt.Printf("conversions: %s", err.Error())
+		return c.String(http.StatusInternalServerError, "")
+	}
+
+	days := make(map[int64]*ConversionDay)
+	day := func(t time.Time) *ConversionDay {
+		t = storage.SketchDay(t)
+		if days[t.Unix()] == nil {
+			days[t.Unix()] = &ConversionDay{Day: t}
+		}
+		return days[t.Unix()]
+	}
+
+	report := ConversionReport{LinkID: link.ID, From: from, To: to, Days: make([]ConversionDay, 0)}
+	for _, count := range counts {
+		if !count.Bot {
+			day(count.Start).Clicks += count.Clicks
+			report.Clicks += count.Clicks
+		}
+	}
+	for _, count := range conversions {
+		day(count.Day).Conversions += count.Conversions
+		report.Conversions += count.Conversions
+	}
+
+	for _, v := range days {
+		v.Rate = conversionRate(v.Conversions, v.Clicks)
+		report.Days = append(report.Days, *v)
+	}
+	sort.Slice(report.Days, func(i, j int) bool {
+		return report.Days[i].Day.Before(report.Days[j].Day)
+	})
+	report.Rate = conversionRate(report.Conversions, report.Clicks)
+
+	return c.JSON(http.StatusOK, report)
+}
+
+func conversionRate(conversions, clicks int64) float64 {
+	if clicks == 0 {
+		return 0
+	}
+	return float64(conversions) / float64(clicks)
+}
@@ -0,0 +1,109 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+
+	apiError "github.com/irootpro/shorturl/internal/error"
+)
+
+type ErrorResponse struct {
+	Status  int    `json:"status"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+type errorPage struct {
+	Status  int
+	Code    string
+	Message string
+	ID      string
+}
+
+// linkError answers a failed short link lookup. API clients asking for JSON
+// get an ErrorResponse, browsers get the 404/410 pages and everyone else the
+// plain text answers the service has always given.
+func (h *ServerHandler) linkError(c echo.Context, err error) error {
+	var response ErrorResponse
+	var plain string
+
+	switch {
+	case errors.Is(err, apiError.ErrLinkNotFound):
+		if h.cfg.NotFoundRedirect != "" {
+			return c.Redirect(http.StatusTemporaryRedirect, h.cfg.NotFoundRedirect)
+		}
+		response = ErrorResponse{Status: http.StatusNotFound, Code: "link_not_found", Message: "link not found"}
+		plain = response.Message
+	case errors.Is(err, apiError.ErrLinkNotActive):
+		response = ErrorResponse{Status: http.StatusNotFound, Code: "link_not_active", Message: "link not active yet"}
+		plain = response.Message
+	case errors.Is(err, apiError.ErrDeleteLink):
+		response = ErrorResponse{Status: http.StatusGone, Code: "link_deleted", Message: "link deleted"}
+	case errors.Is(err, apiError.ErrLinkExpired):
+		response = ErrorResponse{Status: http.StatusGone, Code: "link_expired", Message: "link expired"}
+		plain = response.Message
+	case errors.Is(err, apiError.ErrLinkExhausted):
+		response = ErrorResponse{Status: http.StatusGone, Code: "link_exhausted", Message: apiError.ErrLinkExhausted.Error()}
+		plain = response.Message
+	default:
+		fmt.Printf("get link: %s", err.Error())
+		return c.String(http.StatusInternalServerError, "")
+	}
+
+	switch negotiate(c.Request().Header.Get(echo.HeaderAccept), echo.MIMEApplicationJSON, echo.MIMETextHTML) {
+	case echo.MIMEApplicationJSON:
+		return c.JSON(response.Status, response)
+	case echo.MIMETextHTML:
+		body, err := h.pages.Render(strconv.Itoa(response.Status)+".html", errorPage{
+			Status:  response.Status,
+			Code:    response.Code,
+			Message: response.Message,
+			ID:      c.Param("hash"),
+		})
+		if err != nil {
+			fmt.Printf("render error page: %s", err.Error())
+			return c.String(response.Status, plain)
+		}
+		return c.HTMLBlob(response.Status, body)
+	}
+
+	if plain == "" {
+		c.Response().WriteHeader(response.Status)
+		return nil
+	}
+	return c.String(response.Status, plain)
+}
+
+// negotiate returns the offer with the highest quality in the Accept header,
+// or an empty string when none of them is acceptable. Wildcards are ignored
+// so clients that accept anything keep getting plain text.
+func negotiate(accept string, offers ...string) string {
+	best, bestQuality := "", 0.0
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+
+		quality := 1.0
+		for _, param := range strings.Split(params, ";") {
+			name, value, ok := strings.Cut(strings.TrimSpace(param), "=")
+			if ok && strings.TrimSpace(name) == "q" {
+				if q, err := strconv.ParseFloat(strings.TrimSpace(value), 64); err == nil {
+					quality = q
+				}
+			}
+		}
+
+		for _, offer := range offers {
+			if mediaType == offer && quality > bestQuality {
+				best, bestQuality = offer, quality
+			}
+		}
+	}
+
+	return best
+}
@@ -0,0 +1,109 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/irootpro/shorturl/internal/url/live"
+)
+
+// sseHeartbeat keeps idle streams open through proxies that close silent
+// connections.
+var sseHeartbeat = 15 * time.Second
+
+func WithLiveHub(hub *live.Hub) Option {
+	return func(h *ServerHandler) {
+		h.live = hub
+	}
+}
+
+// GetEvents streams the clicks of one link to its owner.
+func (h *ServerHandler) GetEvents(c echo.Context) error {
+	link, err := h.ownLink(c)
+	if err != nil {
+		return ownLinkError(c, err)
+	}
+
+	return h.streamEvents(c, link.UserID, link.ID)
+}
+
+// GetAllEvents streams the clicks of all links of the caller.
+func (h *ServerHandler) GetAllEvents(c echo.Context) error {
+	userID, ok := h.currentUser(c)
+	if !ok {
+		return c.String(http.StatusUnauthorized, "")
+	}
+
+	return h.streamEvents(c, userID, "")
+}
+
+// streamEvents writes Server-Sent Events until the client goes away or the
+// hub drops the subscription. Clients reconnecting with Last-Event-ID get
+// the events they missed if the hub still has them, new clients only get
+// events from now on.
+func (h *ServerHandler) streamEvents(c echo.Context, userID, linkID string) error {
+	if h.live == nil {
+		return c.String(http.StatusServiceUnavailable, "live events are disabled")
+	}
+
+	lastID := live.Latest
+	if id, err := strconv.ParseUint(c.Request().Header.Get("Last-Event-ID"), 10, 64); err == nil {
+		lastID = id
+	}
+	sub, missed := h.live.Subscribe(userID, linkID, lastID)
+	defer h.live.Unsubscribe(sub)
+
+	header := c.Response().Header()
+	header.Set(echo.HeaderContentType, "text/event-stream")
+	header.Set(echo.HeaderCacheControl, "no-cache")
+	header.Set("X-Accel-Buffering", "no")
+	c.Response().WriteHeader(http.StatusOK)
+	c.Response().Flush()
+
+	for _, event := range missed {
+		if err := writeEvent(c, event); err != nil {
+			return nil
+		}
+	}
+
+	heartbeat := time.NewTicker(sseHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-c.Request().Context().Done():
+			return nil
+		case event, ok := <-sub.C:
+			if !ok {
+				return nil
+			}
+			if err := writeEvent(c, event); err != nil {
+				return nil
+			}
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(c.Response(), ": heartbeat\n\n"); err != nil {
+				return nil
+			}
+			c.Response().Flush()
+		}
+	}
+}
+
+func writeEvent(c echo.Context, event live.Event) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	if _, err = fmt.Fprintf(c.Response(), "id: %d\nevent: click\ndata: %s\n\n", event.ID, data); err != nil {
+		return err
+	}
+	c.Response().Flush()
+
+	return nil
+}
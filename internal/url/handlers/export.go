@@ -0,0 +1,91 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/irootpro/shorturl/internal/url/export"
+)
+
+// ExportLink streams the clicks or daily counts of one link to its owner.
+func (h *ServerHandler) ExportLink(c echo.Context) error {
+	link, err := h.ownLink(c)
+	if err != nil {
+		return ownLinkError(c, err)
+	}
+
+	return h.writeExport(c, []string{link.ID}, "link")
+}
+
+// ExportAll streams the clicks or daily counts of all links of the caller.
+func (h *ServerHandler) ExportAll(c echo.Context) error {
+	userID, ok := h.currentUser(c)
+	if !ok {
+		return c.String(http.StatusUnauthorized, "")
+	}
+
+	links, err := h.storage.GetAll()
+	if err != nil {
+		fmt.Printf("export: %s", err.Error())
+		return c.String(http.StatusInternalServerError, "")
+	}
+
+	linkIDs := []string{}
+	for _, link := range links {
+		if link.UserID == userID {
+			linkIDs = append(linkIDs, link.ID)
+		}
+	}
+
+	return h.writeExport(c, linkIDs, "links")
+}
+
+// writeExport reads kind, format, from and to. Once rows are being sent the
+// status cannot change any more, errors then only end the response early.
+func (h *ServerHandler) writeExport(c echo.Context, linkIDs []string, name string) error {
+	query, err := exportQuery(c)
+	if err != nil {
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+	query.LinkIDs = linkIDs
+
+	header := c.Response().Header()
+	header.Set(echo.HeaderContentType, export.ContentType(query.Format))
+	header.Set(echo.HeaderContentDisposition, fmt.Sprintf("attachment; filename=%q", name+"-"+query.Kind+"."+query.Format))
+	header.Set(echo.HeaderCacheControl, "private, no-cache")
+	c.Response().WriteHeader(http.StatusOK)
+
+	if err = export.Write(c.Request().Context(), c.Response(), h.storage, query); err != nil {
+		fmt.Printf("export: %s", err.Error())
+	}
+	return nil
+}
+
+// exportQuery defaults to the clicks of the last 30 days as CSV. Times are
+// RFC 3339 or plain dates, dates are midnight UTC.
+func exportQuery(c echo.Context) (export.Query, error) {
+	query := export.Query{
+		Kind:   c.QueryParam("kind"),
+		Format: c.QueryParam("format"),
+	}
+
+	var err error
+	query.To = time.Now().UTC()
+	if to := c.QueryParam("to"); to != "" {
+		if query.To, err = export.ParseTime(to); err != nil {
+			return query, fmt.Errorf("invalid to: %s", err.Error())
+		}
+	}
+
+	query.From = query.To.Add(-defaultStatsRange)
+	if from := c.QueryParam("from"); from != "" {
+		if query.From, err = export.ParseTime(from); err != nil {
+			return query, fmt.Errorf("invalid from: %s", err.Error())
+		}
+	}
+
+	return query, query.Validate()
+}
@@ -6,43 +6,135 @@ import (
 	"errors"
 	"fmt"
 	apiError "github.com/irootpro/shorturl/internal/error"
+	"github.com/irootpro/shorturl/internal/url/live"
+	"github.com/irootpro/shorturl/internal/url/pages"
+	"github.com/irootpro/shorturl/internal/url/privacy"
 	"github.com/irootpro/shorturl/internal/url/service"
 	"github.com/irootpro/shorturl/internal/url/storage"
 	"github.com/irootpro/shorturl/internal/url/usecases"
+	"github.com/irootpro/shorturl/internal/url/useragent"
 	"github.com/labstack/echo/v4"
 	"io"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
 	"time"
 )
 
 type RequestPOST struct {
-	URL string `json:"url"`
+	URL           string                      `json:"url"`
+	Interstitial  bool                        `json:"interstitial,omitempty"`
+	OGTitle       string                      `json:"og_title,omitempty"`
+	OGDescription string                      `json:"og_description,omitempty"`
+	OGImage       string                      `json:"og_image,omitempty"`
+	Rules         []storage.RoutingRule       `json:"rules,omitempty"`
+	GeoRules      []storage.GeoRule           `json:"geo_rules,omitempty"`
+	Variants      []storage.Variant           `json:"variants,omitempty"`
+	NotBefore     *time.Time                  `json:"not_before,omitempty"`
+	ExpiresAt     *time.Time                  `json:"expires_at,omitempty"`
+	FallbackURL   string                      `json:"fallback_url,omitempty"`
+	MaxClicks     int64                       `json:"max_clicks,omitempty"`
+	Password      string                      `json:"password,omitempty"`
+	Languages     []storage.LanguageVariant   `json:"languages,omitempty"`
+	Conversions   *storage.ConversionTracking `json:"conversions,omitempty"`
 }
 
 type ResponsePOST struct {
 	Result string `json:"result"`
 }
 
+type previewPage struct {
+	URL    string
+	Domain string
+}
+
 type ServerHandler struct {
-	cfg     *service.ConfigVars
-	storage Storage
+	cfg      *service.ConfigVars
+	storage  Storage
+	pages    *pages.Renderer
+	geo      GeoLocator
+	attempts *attemptLimiter
+	clicks   ClickRecorder
+	agents   *useragent.Classifier
+	live     *live.Hub
+	privacy  *privacy.Policy
+}
+
+type Option func(h *ServerHandler)
+
+func WithPages(renderer *pages.Renderer) Option {
+	return func(h *ServerHandler) {
+		h.pages = renderer
+	}
 }
 
-func NewServerHandler(cfg *service.ConfigVars, storage Storage) *ServerHandler {
-	return &ServerHandler{
-		cfg:     cfg,
-		storage: storage,
+func WithGeoLocator(geo GeoLocator) Option {
+	return func(h *ServerHandler) {
+		h.geo = geo
+	}
+}
+
+func NewServerHandler(cfg *service.ConfigVars, storage Storage, opts ...Option) *ServerHandler {
+	h := &ServerHandler{
+		cfg:      cfg,
+		storage:  storage,
+		pages:    pages.New(),
+		attempts: newAttemptLimiter(),
+		agents:   useragent.NewClassifier(useragent.DefaultRules()),
+		privacy: privacy.NewPolicy(privacy.Config{
+			TruncateIP:      cfg.TruncateIP,
+			SaltRotation:    cfg.SaltRotation,
+			DisableReferrer: cfg.DisableReferrer,
+		}),
+	}
+
+	for _, opt := range opts {
+		opt(h)
 	}
+
+	return h
 }
 
 type Storage interface {
 	Put(newLink storage.LinkEntity) error
 	Get(id string) (string, error)
+	GetLink(id string) (storage.LinkEntity, error)
+	ModifyLink(id string, change func(link *storage.LinkEntity) error) error
+	IncrementVariantClicks(id string, variant int) error
+	IncrementLanguageClicks(id string, tag string) error
+	ConsumeClick(id string) error
 	GetAll() ([]storage.LinkEntity, error)
-	RemoveURLs(context.Context, []string) error
+	RemoveURLs(context.Context, string, []string) error
+	RemoveExpired(context.Context, time.Time) (int64, error)
 	Close() error
 	Ping() error
 	Batch(context.Context, []storage.LinkBatch, string) ([]storage.LinkBatchResult, error)
+	PutBundle(bundle storage.Bundle) error
+	GetBundle(id string) (storage.Bundle, error)
+	GetBundles(userID string) ([]storage.Bundle, error)
+	ModifyBundle(id string, change func(bundle *storage.Bundle) error) error
+	DeleteBundle(id string) error
+	IncrementBundleItemClicks(id string, item int) error
+	PutCampaign(campaign storage.Campaign) error
+	GetCampaign(id string) (storage.Campaign, error)
+	GetCampaigns(userID string) ([]storage.Campaign, error)
+	UpdateCampaign(campaign storage.Campaign) error
+	DeleteCampaign(id string) error
+	SetCampaignLinks(id string, linkIDs []string) error
+	SaveClicks(ctx context.Context, clicks []storage.ClickEvent) error
+	GetClicks(ctx context.Context, linkID string, from, to time.Time) ([]storage.ClickEvent, error)
+	EachClick(ctx context.Context, linkIDs []string, from, to time.Time, fn func(storage.ClickEvent) error) error
+	GetSketches(ctx context.Context, linkID string, from, to time.Time) ([]storage.DailySketch, error)
+	GetClickCounts(ctx context.Context, linkID string, from, to time.Time, period string) ([]storage.ClickCount, error)
+	Rollup(ctx context.Context, until time.Time) (int64, error)
+	DeleteClicks(ctx context.Context, before time.Time) (int64, error)
+	PutAPIKey(key storage.APIKey) error
+	GetAPIKey(id string) (storage.APIKey, error)
+	GetAPIKeys(userID string) ([]storage.APIKey, error)
+	DeleteAPIKey(id string) error
+	SaveConversion(ctx context.Context, conversion storage.Conversion) (bool, error)
+	GetConversionCounts(ctx context.Context, linkID string, from, to time.Time) ([]storage.ConversionCount, error)
 }
 
 func (h *ServerHandler) GetURL(c echo.Context) error {
@@ -51,58 +143,167 @@ func (h *ServerHandler) GetURL(c echo.Context) error {
 		return c.String(http.StatusBadRequest, "id not found on postRequest")
 	}
 
-	shortURL, err := h.storage.Get(id)
+	preview, _ := strconv.ParseBool(c.QueryParam("preview"))
+
+	link, err := h.storage.GetLink(id)
+	if errors.Is(err, apiError.ErrLinkNotFound) && strings.HasSuffix(id, "+") {
+		// "/{hash}+" asks for the preview page; base64 hashes may end with "+"
+		// themselves, so the exact match above is tried first.
+		preview = true
+		link, err = h.storage.GetLink(strings.TrimSuffix(id, "+"))
+	}
+	if errors.Is(err, apiError.ErrLinkNotFound) {
+		// Bundles share the short code namespace with links.
+		if bundle, bundleErr := h.storage.GetBundle(id); bundleErr == nil {
+			return h.renderBundle(c, bundle)
+		}
+	}
 	if err != nil {
-		switch {
-		case errors.Is(err, apiError.ErrDeleteLink):
-			c.Response().WriteHeader(http.StatusGone)
-			return nil
-		case errors.Is(err, apiError.ErrLinkNotFound):
-			return c.String(http.StatusNotFound, "link not found")
+		return h.linkError(c, err)
+	}
+
+	if err := link.CheckActive(time.Now()); err != nil {
+		if link.FallbackURL != "" {
+			c.Response().Header().Set(echo.HeaderCacheControl, "no-cache")
+			c.Response().Header().Set("Location", link.FallbackURL)
+			return c.String(http.StatusTemporaryRedirect, "")
 		}
-		return c.String(http.StatusInternalServerError, "")
+		return h.linkError(c, err)
+	}
+
+	if remaining, ok := link.Remaining(); ok && remaining == 0 {
+		return h.linkError(c, apiError.ErrLinkExhausted)
+	}
+
+	if !hasAccess(c, link) {
+		return h.renderPasswordForm(c, http.StatusForbidden, "")
+	}
+
+	if preview || link.Interstitial || h.cfg.Interstitial {
+		// The preview shows the destination, that uses up a click too.
+		if err := h.useClick(c, link); err != nil {
+			return h.linkError(c, err)
+		}
+		return h.renderPreview(c, link.OriginalURL)
+	}
+
+	if link.HasOpenGraph() && usecases.IsPreviewBot(c.Request().UserAgent()) {
+		// Crawlers unfurling a click limited link neither use it up nor
+		// learn where it leads.
+		if link.MaxClicks > 0 {
+			link.OriginalURL = ""
+		}
+		return h.renderOpenGraph(c, link)
+	}
+
+	if link.MaxClicks > 0 && c.Request().Method == http.MethodHead {
+		// Link checkers learn that the link works, the destination is only
+		// handed out with a counted click.
+		c.Response().Header().Set(echo.HeaderCacheControl, "private, no-store")
+		return c.NoContent(http.StatusOK)
+	}
+
+	if err := h.useClick(c, link); err != nil {
+		return h.linkError(c, err)
 	}
 
-	c.Response().Header().Set("Location", shortURL)
+	now := time.Now()
+	h.setRedirectCache(c, link, now)
+	destination := h.withCampaignParams(link, h.resolveDestination(c, link))
+	c.Response().Header().Set("Location", h.withClickID(c, link, destination, now))
+	h.recordClick(c, link)
 	return c.String(http.StatusTemporaryRedirect, "")
 }
 
+// useClick counts a use of a click limited link. HEAD requests come from
+// link checkers and caches, they do not use up clicks.
+func (h *ServerHandler) useClick(c echo.Context, link storage.LinkEntity) error {
+	if link.MaxClicks == 0 || c.Request().Method == http.MethodHead {
+		return nil
+	}
+	return h.storage.ConsumeClick(link.ID)
+}
+
+func (h *ServerHandler) renderPreview(c echo.Context, originalURL string) error {
+	page := previewPage{
+		URL:    originalURL,
+		Domain: originalURL,
+	}
+	if parsed, err := url.Parse(originalURL); err == nil && parsed.Host != "" {
+		page.Domain = parsed.Hostname()
+	}
+
+	body, err := h.pages.Render("preview.html", page)
+	if err != nil {
+		fmt.Printf("render preview: %s", err.Error())
+		return c.String(http.StatusInternalServerError, "")
+	}
+
+	return c.HTMLBlob(http.StatusOK, body)
+}
+
+func (h *ServerHandler) renderOpenGraph(c echo.Context, link storage.LinkEntity) error {
+	body, err := h.pages.Render("opengraph.html", link)
+	if err != nil {
+		fmt.Printf("render open graph: %s", err.Error())
+		return c.String(http.StatusInternalServerError, "")
+	}
+
+	return c.HTMLBlob(http.StatusOK, body)
+}
+
 func (h *ServerHandler) GetURLs(c echo.Context) error {
-	cookie, err := c.Cookie("token")
-	if err != nil || !service.CheckCookie(cookie) {
+	userID, ok := h.currentUser(c)
+	if !ok {
 		c.Response().Header().Set("Content-Type", "application/json")
 		c.Response().WriteHeader(http.StatusNoContent)
 		return nil
 	}
 
-	c.SetCookie(cookie)
-	urls, err := h.storage.GetAll()
+	links, err := h.storage.GetAll()
 	if err != nil {
 		fmt.Printf("read urls from storage: %s", err.Error())
 		return c.String(http.StatusInternalServerError, "error read from storage")
 	}
 
+	urls := make([]storage.LinkEntity, 0, len(links))
+	for _, link := range links {
+		if link.UserID == userID {
+			urls = append(urls, link)
+		}
+	}
+
 	if len(urls) == 0 {
 		c.Response().Header().Set("Content-Type", "application/json")
 		c.Response().WriteHeader(http.StatusNoContent)
 		return nil
 	}
 
+	for i := range urls {
+		if remaining, ok := urls[i].Remaining(); ok {
+			urls[i].RemainingUses = &remaining
+		}
+		urls[i].PasswordHash = ""
+		urls[i].UserID = ""
+	}
+
 	bytes, err := json.Marshal(urls)
 	if err != nil {
 		return c.String(http.StatusInternalServerError, "error marhaling data")
 	}
 
+	tag := etag(bytes)
+	c.Response().Header().Set("ETag", tag)
+	c.Response().Header().Set(echo.HeaderCacheControl, "private, no-cache")
+	if etagMatches(c.Request().Header.Get("If-None-Match"), tag) {
+		return c.NoContent(http.StatusNotModified)
+	}
+
 	return c.JSONBlob(http.StatusOK, bytes)
 }
 
 func (h *ServerHandler) PostURL(c echo.Context) error {
-	cookie, err := c.Cookie("token")
-	if err != nil || service.CheckCookie(cookie) {
-		cookie = service.SetCookie()
-	}
-
-	c.SetCookie(cookie)
+	userID := h.sessionUser(c).ID
 
 	defer c.Request().Body.Close()
 	body, err := io.ReadAll(c.Request().Body)
@@ -115,6 +316,7 @@ func (h *ServerHandler) PostURL(c echo.Context) error {
 		ID:          id,
 		OriginalURL: string(body),
 		ShortURL:    fmt.Sprintf("%s/%s", h.cfg.BaseURL, id),
+		UserID:      userID,
 	}
 
 	if err := h.storage.Put(link); err != nil {
@@ -129,12 +331,7 @@ func (h *ServerHandler) PostURL(c echo.Context) error {
 }
 
 func (h *ServerHandler) PostURLJSON(c echo.Context) error {
-	cookie, err := c.Cookie("token")
-	if err != nil || service.CheckCookie(cookie) {
-		cookie = service.SetCookie()
-	}
-
-	c.SetCookie(cookie)
+	userID := h.sessionUser(c).ID
 
 	var request RequestPOST
 
@@ -142,11 +339,68 @@ func (h *ServerHandler) PostURLJSON(c echo.Context) error {
 		return c.String(http.StatusInternalServerError, "")
 	}
 
+	if err := validateRules(request.Rules); err != nil {
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+
+	if err := validateGeoRules(request.GeoRules); err != nil {
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+
+	if err := validateVariants(request.Variants); err != nil {
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+	for i := range request.Variants {
+		request.Variants[i].Clicks = 0
+	}
+
+	if request.NotBefore != nil && request.ExpiresAt != nil && !request.ExpiresAt.After(*request.NotBefore) {
+		return c.String(http.StatusBadRequest, "expires_at must be after not_before")
+	}
+
+	if err := validateLanguages(request.Languages); err != nil {
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+
+	if err := validateConversions(request.Conversions); err != nil {
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+	if request.Conversions != nil && request.Conversions.Param == "" {
+		request.Conversions.Param = clickIDParam
+	}
+
+	if request.MaxClicks < 0 {
+		return c.String(http.StatusBadRequest, "max_clicks must not be negative")
+	}
+
+	var passwordHash string
+	var err error
+	if request.Password != "" {
+		if passwordHash, err = hashPassword(request.Password); err != nil {
+			return c.String(http.StatusInternalServerError, "")
+		}
+	}
+
 	id := usecases.GenerateShortLink([]byte(request.URL))
 	link := storage.LinkEntity{
-		ID:          id,
-		OriginalURL: request.URL,
-		ShortURL:    fmt.Sprintf("%s/%s", h.cfg.BaseURL, id),
+		ID:            id,
+		OriginalURL:   request.URL,
+		ShortURL:      fmt.Sprintf("%s/%s", h.cfg.BaseURL, id),
+		Interstitial:  request.Interstitial,
+		OGTitle:       request.OGTitle,
+		OGDescription: request.OGDescription,
+		OGImage:       request.OGImage,
+		Rules:         request.Rules,
+		GeoRules:      request.GeoRules,
+		Variants:      request.Variants,
+		NotBefore:     request.NotBefore,
+		ExpiresAt:     request.ExpiresAt,
+		FallbackURL:   request.FallbackURL,
+		MaxClicks:     request.MaxClicks,
+		PasswordHash:  passwordHash,
+		Languages:     request.Languages,
+		Conversions:   request.Conversions,
+		UserID:        userID,
 	}
 
 	response := &ResponsePOST{
@@ -170,12 +424,7 @@ func (h *ServerHandler) PostURLJSON(c echo.Context) error {
 }
 
 func (h *ServerHandler) PostURLsBatchJSON(c echo.Context) error {
-	cookie, err := c.Cookie("token")
-	if err != nil || service.CheckCookie(cookie) {
-		cookie = service.SetCookie()
-	}
-
-	c.SetCookie(cookie)
+	userID := h.sessionUser(c).ID
 
 	defer c.Request().Body.Close()
 
@@ -184,6 +433,9 @@ func (h *ServerHandler) PostURLsBatchJSON(c echo.Context) error {
 	if err := c.Bind(&request); err != nil {
 		return c.String(http.StatusInternalServerError, "")
 	}
+	for i := range request {
+		request[i].UserID = userID
+	}
 	ctx := context.Background()
 	result, err := h.storage.Batch(ctx, request, h.cfg.BaseURL)
 	if err != nil {
@@ -212,7 +464,7 @@ func (h *ServerHandler) RemoveURLs(c echo.Context) error {
 		return c.String(http.StatusInternalServerError, "")
 	}
 
-	if err := h.storage.RemoveURLs(ctx, urls); err != nil {
+	if err := h.storage.RemoveURLs(ctx, h.sessionUser(c).ID, urls); err != nil {
 		return c.String(http.StatusInternalServerError, "")
 	}
 
@@ -1,19 +1,37 @@
 package handlers
 
 import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/labstack/echo/v4"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
+	apiError "github.com/irootpro/shorturl/internal/error"
+	"github.com/irootpro/shorturl/internal/url/geoip"
+	"github.com/irootpro/shorturl/internal/url/live"
+	"github.com/irootpro/shorturl/internal/url/pages"
 	"github.com/irootpro/shorturl/internal/url/service"
+	"github.com/irootpro/shorturl/internal/url/stats"
 	"github.com/irootpro/shorturl/internal/url/storage"
+	"github.com/irootpro/shorturl/internal/url/usecases"
 )
 
 func TestLink(t *testing.T) {
@@ -196,3 +214,1832 @@ func TestLink(t *testing.T) {
 		})
 	}
 }
+
+func TestPreview(t *testing.T) {
+	cfg := &service.ConfigVars{BaseURL: "http://localhost:8080"}
+	storageApp := storage.NewStorageMemory()
+	serverHandler := NewServerHandler(cfg, storageApp)
+
+	require.NoError(t, storageApp.Put(storage.LinkEntity{
+		ID:          "aHR0cHM6Ly9nb29nbGUuY29t",
+		OriginalURL: "https://google.com",
+	}))
+	require.NoError(t, storageApp.Put(storage.LinkEntity{
+		ID:           "aHR0cHM6Ly9hbWF6b24uY29t",
+		OriginalURL:  "https://amazon.com/books",
+		Interstitial: true,
+	}))
+
+	tests := []struct {
+		name       string
+		hash       string
+		query      string
+		statusCode int
+		domain     string
+	}{
+		{
+			name:       "Redirect without preview",
+			hash:       "aHR0cHM6Ly9nb29nbGUuY29t",
+			statusCode: http.StatusTemporaryRedirect,
+		},
+		{
+			name:       "Preview by query parameter",
+			hash:       "aHR0cHM6Ly9nb29nbGUuY29t",
+			query:      "?preview=1",
+			statusCode: http.StatusOK,
+			domain:     "google.com",
+		},
+		{
+			name:       "Preview by plus suffix",
+			hash:       "aHR0cHM6Ly9nb29nbGUuY29t+",
+			statusCode: http.StatusOK,
+			domain:     "google.com",
+		},
+		{
+			name:       "Per-link interstitial",
+			hash:       "aHR0cHM6Ly9hbWF6b24uY29t",
+			statusCode: http.StatusOK,
+			domain:     "amazon.com",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			e := echo.New()
+			requestGet := httptest.NewRequest(http.MethodGet, "/"+test.query, nil)
+			w := httptest.NewRecorder()
+			c := e.NewContext(requestGet, w)
+			c.SetPath(":hash")
+			c.SetParamNames("hash")
+			c.SetParamValues(test.hash)
+
+			assert.NoError(t, serverHandler.GetURL(c))
+
+			result := w.Result()
+			defer result.Body.Close()
+			assert.Equal(t, test.statusCode, result.StatusCode)
+			if test.domain != "" {
+				assert.Contains(t, w.Body.String(), "<strong>"+test.domain+"</strong>")
+				assert.Empty(t, result.Header.Get("Location"))
+			}
+		})
+	}
+}
+
+func TestOpenGraph(t *testing.T) {
+	cfg := &service.ConfigVars{BaseURL: "http://localhost:8080"}
+	storageApp := storage.NewStorageMemory()
+	serverHandler := NewServerHandler(cfg, storageApp)
+
+	require.NoError(t, storageApp.Put(storage.LinkEntity{
+		ID:          "aHR0cHM6Ly9nb29nbGUuY29t",
+		OriginalURL: "https://google.com",
+		ShortURL:    "http://localhost:8080/aHR0cHM6Ly9nb29nbGUuY29t",
+		OGTitle:     "Search",
+		OGImage:     "https://google.com/logo.png",
+	}))
+
+	tests := []struct {
+		name       string
+		userAgent  string
+		statusCode int
+	}{
+		{
+			name:       "Crawler gets open graph page",
+			userAgent:  "TelegramBot (like TwitterBot)",
+			statusCode: http.StatusOK,
+		},
+		{
+			name:       "Human gets redirect",
+			userAgent:  "Mozilla/5.0 (X11; Linux x86_64) Firefox/118.0",
+			statusCode: http.StatusTemporaryRedirect,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			e := echo.New()
+			requestGet := httptest.NewRequest(http.MethodGet, "/", nil)
+			requestGet.Header.Set("User-Agent", test.userAgent)
+			w := httptest.NewRecorder()
+			c := e.NewContext(requestGet, w)
+			c.SetPath(":hash")
+			c.SetParamNames("hash")
+			c.SetParamValues("aHR0cHM6Ly9nb29nbGUuY29t")
+
+			assert.NoError(t, serverHandler.GetURL(c))
+
+			result := w.Result()
+			defer result.Body.Close()
+			assert.Equal(t, test.statusCode, result.StatusCode)
+			if test.statusCode == http.StatusOK {
+				assert.Contains(t, w.Body.String(), `<meta property="og:title" content="Search">`)
+				assert.Contains(t, w.Body.String(), `<meta property="og:image" content="https://google.com/logo.png">`)
+			}
+		})
+	}
+}
+
+func TestRoutingRules(t *testing.T) {
+	cfg := &service.ConfigVars{BaseURL: "http://localhost:8080"}
+	storageApp := storage.NewStorageMemory()
+	serverHandler := NewServerHandler(cfg, storageApp)
+
+	owner := service.SetCookie()
+	ownerID, _ := service.UserID(owner)
+
+	const hash = "aHR0cHM6Ly9leGFtcGxlLmNvbQ=="
+	require.NoError(t, storageApp.Put(storage.LinkEntity{
+		ID:          hash,
+		OriginalURL: "https://example.com",
+		UserID:      ownerID,
+	}))
+
+	e := echo.New()
+	putRules := func(body string, cookie *http.Cookie) *httptest.ResponseRecorder {
+		requestPut := httptest.NewRequest(http.MethodPut, "/", strings.NewReader(body))
+		requestPut.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		if cookie != nil {
+			requestPut.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		c := e.NewContext(requestPut, w)
+		c.SetParamNames("hash")
+		c.SetParamValues(hash)
+		require.NoError(t, serverHandler.PutRules(c))
+		return w
+	}
+
+	w := putRules(`[{"os":"ios","url":"https://apps.apple.com/app"},{"os":"android","url":"https://play.google.com/app"}]`, owner)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	t.Run("Other users cannot change the rules", func(t *testing.T) {
+		assert.Equal(t, http.StatusNotFound, putRules(`[{"url":"https://evil.example"}]`, service.SetCookie()).Code)
+		assert.Equal(t, http.StatusNotFound, putRules(`[{"url":"https://evil.example"}]`, nil).Code)
+
+		link, err := storageApp.GetLink(hash)
+		require.NoError(t, err)
+		require.Len(t, link.Rules, 2)
+		assert.Equal(t, "https://apps.apple.com/app", link.Rules[0].URL)
+	})
+
+	tests := []struct {
+		name      string
+		userAgent string
+		location  string
+	}{
+		{
+			name:      "iOS goes to App Store",
+			userAgent: "Mozilla/5.0 (iPhone; CPU iPhone OS 17_0 like Mac OS X) AppleWebKit/605.1.15 Mobile/15E148 Safari/604.1",
+			location:  "https://apps.apple.com/app",
+		},
+		{
+			name:      "Android goes to Play",
+			userAgent: "Mozilla/5.0 (Linux; Android 14; Pixel 8) AppleWebKit/537.36 Chrome/118.0 Mobile Safari/537.36",
+			location:  "https://play.google.com/app",
+		},
+		{
+			name:      "Desktop goes to website",
+			userAgent: "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 Chrome/118.0 Safari/537.36",
+			location:  "https://example.com",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			requestGet := httptest.NewRequest(http.MethodGet, "/", nil)
+			requestGet.Header.Set("User-Agent", test.userAgent)
+			w := httptest.NewRecorder()
+			c := e.NewContext(requestGet, w)
+			c.SetPath(":hash")
+			c.SetParamNames("hash")
+			c.SetParamValues(hash)
+
+			assert.NoError(t, serverHandler.GetURL(c))
+
+			result := w.Result()
+			defer result.Body.Close()
+			assert.Equal(t, http.StatusTemporaryRedirect, result.StatusCode)
+			assert.Equal(t, test.location, result.Header.Get("Location"))
+		})
+	}
+}
+
+type geoLocatorMock map[string]geoip.Location
+
+func (m geoLocatorMock) Lookup(ip net.IP) (geoip.Location, error) {
+	return m[ip.String()], nil
+}
+
+func TestGeoRules(t *testing.T) {
+	cfg := &service.ConfigVars{BaseURL: "http://localhost:8080"}
+	storageApp := storage.NewStorageMemory()
+	serverHandler := NewServerHandler(cfg, storageApp, WithGeoLocator(geoLocatorMock{
+		"81.2.69.142": {Country: "GB", Continent: "EU"},
+		"89.160.20.1": {Country: "SE", Continent: "EU"},
+		"216.160.0.1": {Country: "US", Continent: "NA"},
+	}))
+
+	const hash = "aHR0cHM6Ly9leGFtcGxlLmNvbQ=="
+	require.NoError(t, storageApp.Put(storage.LinkEntity{
+		ID:          hash,
+		OriginalURL: "https://example.com",
+		GeoRules: []storage.GeoRule{
+			{Country: "GB", URL: "https://example.co.uk"},
+			{Continent: "EU", URL: "https://example.eu"},
+		},
+	}))
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		location   string
+	}{
+		{
+			name:       "Country rule",
+			remoteAddr: "81.2.69.142:1234",
+			location:   "https://example.co.uk",
+		},
+		{
+			name:       "Continent rule",
+			remoteAddr: "89.160.20.1:1234",
+			location:   "https://example.eu",
+		},
+		{
+			name:       "Default fallback",
+			remoteAddr: "216.160.0.1:1234",
+			location:   "https://example.com",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			e := echo.New()
+			requestGet := httptest.NewRequest(http.MethodGet, "/", nil)
+			requestGet.RemoteAddr = test.remoteAddr
+			w := httptest.NewRecorder()
+			c := e.NewContext(requestGet, w)
+			c.SetPath(":hash")
+			c.SetParamNames("hash")
+			c.SetParamValues(hash)
+
+			assert.NoError(t, serverHandler.GetURL(c))
+
+			result := w.Result()
+			defer result.Body.Close()
+			assert.Equal(t, test.location, result.Header.Get("Location"))
+		})
+	}
+}
+
+func TestVariants(t *testing.T) {
+	cfg := &service.ConfigVars{BaseURL: "http://localhost:8080"}
+	storageApp := storage.NewStorageMemory()
+	serverHandler := NewServerHandler(cfg, storageApp)
+
+	const hash = "aHR0cHM6Ly9leGFtcGxlLmNvbQ=="
+	require.NoError(t, storageApp.Put(storage.LinkEntity{
+		ID:          hash,
+		OriginalURL: "https://example.com",
+		Variants: []storage.Variant{
+			{URL: "https://example.com/a", Weight: 70},
+			{URL: "https://example.com/b", Weight: 30},
+		},
+	}))
+
+	e := echo.New()
+	get := func(remoteAddr string, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+		requestGet := httptest.NewRequest(http.MethodGet, "/", nil)
+		requestGet.RemoteAddr = remoteAddr
+		for _, cookie := range cookies {
+			requestGet.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		c := e.NewContext(requestGet, w)
+		c.SetPath(":hash")
+		c.SetParamNames("hash")
+		c.SetParamValues(hash)
+		require.NoError(t, serverHandler.GetURL(c))
+		return w
+	}
+
+	t.Run("Sticky assignment", func(t *testing.T) {
+		first := get("10.0.0.1:1000")
+		cookies := first.Result().Cookies()
+		require.Len(t, cookies, 1)
+
+		location := first.Header().Get("Location")
+		for i := 0; i < 5; i++ {
+			assert.Equal(t, location, get("10.0.0.1:1000").Header().Get("Location"))
+			assert.Equal(t, location, get("10.0.0.2:1000", cookies[0]).Header().Get("Location"))
+		}
+	})
+
+	t.Run("Weighted split and click counts", func(t *testing.T) {
+		link, err := storageApp.GetLink(hash)
+		require.NoError(t, err)
+		beforeA, beforeB := link.Variants[0].Clicks, link.Variants[1].Clicks
+
+		counts := map[string]int{}
+		for i := 0; i < 1000; i++ {
+			counts[get(fmt.Sprintf("10.1.%d.%d:1000", i/256, i%256)).Header().Get("Location")]++
+		}
+		assert.InDelta(t, 700, counts["https://example.com/a"], 80)
+		assert.InDelta(t, 300, counts["https://example.com/b"], 80)
+
+		link, err = storageApp.GetLink(hash)
+		require.NoError(t, err)
+		assert.Equal(t, beforeA+int64(counts["https://example.com/a"]), link.Variants[0].Clicks)
+		assert.Equal(t, beforeB+int64(counts["https://example.com/b"]), link.Variants[1].Clicks)
+	})
+
+	t.Run("Reordered variants keep their visitors", func(t *testing.T) {
+		first := get("10.0.0.3:1000")
+		cookies := first.Result().Cookies()
+		require.Len(t, cookies, 1)
+		location := first.Header().Get("Location")
+
+		require.NoError(t, storageApp.ModifyLink(hash, func(link *storage.LinkEntity) error {
+			link.Variants = []storage.Variant{
+				{URL: "https://example.com/c", Weight: 50},
+				link.Variants[1],
+				link.Variants[0],
+			}
+			return nil
+		}))
+		for i := 0; i < 5; i++ {
+			assert.Equal(t, location, get(fmt.Sprintf("10.2.0.%d:1000", i), cookies[0]).Header().Get("Location"))
+		}
+
+		require.NoError(t, storageApp.ModifyLink(hash, func(link *storage.LinkEntity) error {
+			link.Variants = []storage.Variant{{URL: "https://example.com/c", Weight: 1}}
+			return nil
+		}))
+		w := get("10.0.0.3:1000", cookies[0])
+		assert.Equal(t, "https://example.com/c", w.Header().Get("Location"), "removed variants are reassigned")
+		require.Len(t, w.Result().Cookies(), 1)
+		assert.NotEqual(t, cookies[0].Value, w.Result().Cookies()[0].Value)
+	})
+
+	t.Run("Variant urls are unique", func(t *testing.T) {
+		assert.Error(t, validateVariants([]storage.Variant{
+			{URL: "https://example.com/a", Weight: 1},
+			{URL: "https://example.com/a", Weight: 2},
+		}))
+	})
+}
+
+func TestActivationWindow(t *testing.T) {
+	cfg := &service.ConfigVars{BaseURL: "http://localhost:8080"}
+	storageApp := storage.NewStorageMemory()
+	serverHandler := NewServerHandler(cfg, storageApp)
+
+	past := time.Now().Add(-time.Hour)
+	future := time.Now().Add(time.Hour)
+
+	links := []storage.LinkEntity{
+		{ID: "active", OriginalURL: "https://example.com/active", NotBefore: &past, ExpiresAt: &future},
+		{ID: "scheduled", OriginalURL: "https://example.com/scheduled", NotBefore: &future},
+		{ID: "expired", OriginalURL: "https://example.com/expired", ExpiresAt: &past},
+		{ID: "fallback", OriginalURL: "https://example.com/promo", ExpiresAt: &past, FallbackURL: "https://example.com/"},
+	}
+	for _, link := range links {
+		require.NoError(t, storageApp.Put(link))
+	}
+
+	tests := []struct {
+		name       string
+		hash       string
+		statusCode int
+		location   string
+		body       string
+	}{
+		{
+			name:       "Active link redirects",
+			hash:       "active",
+			statusCode: http.StatusTemporaryRedirect,
+			location:   "https://example.com/active",
+		},
+		{
+			name:       "Scheduled link is not found",
+			hash:       "scheduled",
+			statusCode: http.StatusNotFound,
+			body:       "link not active yet",
+		},
+		{
+			name:       "Expired link is gone",
+			hash:       "expired",
+			statusCode: http.StatusGone,
+			body:       "link expired",
+		},
+		{
+			name:       "Expired link with fallback",
+			hash:       "fallback",
+			statusCode: http.StatusTemporaryRedirect,
+			location:   "https://example.com/",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			e := echo.New()
+			requestGet := httptest.NewRequest(http.MethodGet, "/", nil)
+			w := httptest.NewRecorder()
+			c := e.NewContext(requestGet, w)
+			c.SetPath(":hash")
+			c.SetParamNames("hash")
+			c.SetParamValues(test.hash)
+
+			assert.NoError(t, serverHandler.GetURL(c))
+
+			result := w.Result()
+			defer result.Body.Close()
+			assert.Equal(t, test.statusCode, result.StatusCode)
+			assert.Equal(t, test.location, result.Header.Get("Location"))
+			if test.body != "" {
+				assert.Equal(t, test.body, w.Body.String())
+			}
+		})
+	}
+
+	removed, err := storageApp.RemoveExpired(context.Background(), time.Now())
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), removed)
+
+	link, err := storageApp.GetLink("fallback")
+	require.NoError(t, err)
+	assert.Equal(t, "expired", link.IsDeleted)
+	assert.ErrorIs(t, link.CheckActive(time.Now()), apiError.ErrLinkExpired)
+}
+
+func TestClickLimit(t *testing.T) {
+	cfg := &service.ConfigVars{BaseURL: "http://localhost:8080"}
+	storageApp := storage.NewStorageMemory()
+	serverHandler := NewServerHandler(cfg, storageApp)
+
+	owner := service.SetCookie()
+	ownerID, _ := service.UserID(owner)
+	require.NoError(t, storageApp.Put(storage.LinkEntity{
+		ID:          "once",
+		OriginalURL: "https://example.com/reset",
+		MaxClicks:   1,
+		UserID:      ownerID,
+	}))
+	require.NoError(t, storageApp.Put(storage.LinkEntity{
+		ID:          "thrice",
+		OriginalURL: "https://example.com/download",
+		MaxClicks:   3,
+		UserID:      ownerID,
+	}))
+
+	get := func(hash string) int {
+		e := echo.New()
+		requestGet := httptest.NewRequest(http.MethodGet, "/", nil)
+		w := httptest.NewRecorder()
+		c := e.NewContext(requestGet, w)
+		c.SetPath(":hash")
+		c.SetParamNames("hash")
+		c.SetParamValues(hash)
+		require.NoError(t, serverHandler.GetURL(c))
+		return w.Code
+	}
+
+	t.Run("One-time link under concurrent clicks", func(t *testing.T) {
+		codes := make(chan int, 20)
+		var wg sync.WaitGroup
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				codes <- get("once")
+			}()
+		}
+		wg.Wait()
+		close(codes)
+
+		counts := map[int]int{}
+		for code := range codes {
+			counts[code]++
+		}
+		assert.Equal(t, 1, counts[http.StatusTemporaryRedirect])
+		assert.Equal(t, 19, counts[http.StatusGone])
+	})
+
+	t.Run("Remaining uses in user urls", func(t *testing.T) {
+		assert.Equal(t, http.StatusTemporaryRedirect, get("thrice"))
+
+		requestGet := httptest.NewRequest(http.MethodGet, "/api/user/urls", nil)
+		requestGet.AddCookie(owner)
+		w := httptest.NewRecorder()
+		require.NoError(t, serverHandler.GetURLs(echo.New().NewContext(requestGet, w)))
+		require.Equal(t, http.StatusOK, w.Code)
+
+		var urls []storage.LinkEntity
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &urls))
+		remaining := map[string]int64{}
+		for _, link := range urls {
+			require.NotNil(t, link.RemainingUses)
+			remaining[link.OriginalURL] = *link.RemainingUses
+		}
+		assert.Equal(t, map[string]int64{
+			"https://example.com/reset":    0,
+			"https://example.com/download": 2,
+		}, remaining)
+	})
+
+	t.Run("Previews use up clicks, crawlers do not see the destination", func(t *testing.T) {
+		require.NoError(t, storageApp.Put(storage.LinkEntity{
+			ID:          "secret",
+			OriginalURL: "https://example.com/secret",
+			MaxClicks:   1,
+			OGTitle:     "Secret",
+		}))
+
+		request := func(target, userAgent string) *httptest.ResponseRecorder {
+			r := httptest.NewRequest(http.MethodGet, target, nil)
+			r.Header.Set("User-Agent", userAgent)
+			w := httptest.NewRecorder()
+			c := echo.New().NewContext(r, w)
+			c.SetParamNames("hash")
+			c.SetParamValues("secret")
+			require.NoError(t, serverHandler.GetURL(c))
+			return w
+		}
+
+		for i := 0; i < 3; i++ {
+			w := request("/secret", "Slackbot-LinkExpanding 1.0")
+			assert.Equal(t, http.StatusOK, w.Code)
+			assert.Contains(t, w.Body.String(), `content="Secret"`)
+			assert.NotContains(t, w.Body.String(), "https://example.com/secret")
+		}
+
+		w := request("/secret?preview=1", "Mozilla/5.0")
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Body.String(), "https://example.com/secret")
+		assert.Equal(t, http.StatusGone, request("/secret?preview=1", "Mozilla/5.0").Code)
+		assert.Equal(t, http.StatusGone, get("secret"))
+	})
+}
+
+func TestPasswordProtection(t *testing.T) {
+	cfg := &service.ConfigVars{BaseURL: "http://localhost:8080"}
+	storageApp := storage.NewStorageMemory()
+	serverHandler := NewServerHandler(cfg, storageApp)
+
+	passwordHash, err := hashPassword("open sesame")
+	require.NoError(t, err)
+	require.NoError(t, storageApp.Put(storage.LinkEntity{
+		ID:           "secret",
+		OriginalURL:  "https://example.com/internal",
+		PasswordHash: passwordHash,
+	}))
+
+	get := func(cookies ...*http.Cookie) *httptest.ResponseRecorder {
+		requestGet := httptest.NewRequest(http.MethodGet, "/secret", nil)
+		for _, cookie := range cookies {
+			requestGet.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		c := echo.New().NewContext(requestGet, w)
+		c.SetParamNames("hash")
+		c.SetParamValues("secret")
+		require.NoError(t, serverHandler.GetURL(c))
+		return w
+	}
+
+	post := func(remoteAddr, password string) *httptest.ResponseRecorder {
+		requestPost := httptest.NewRequest(http.MethodPost, "/secret", strings.NewReader("password="+password))
+		requestPost.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+		requestPost.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		c := echo.New().NewContext(requestPost, w)
+		c.SetParamNames("hash")
+		c.SetParamValues("secret")
+		require.NoError(t, serverHandler.UnlockURL(c))
+		return w
+	}
+
+	t.Run("Form instead of redirect", func(t *testing.T) {
+		w := get()
+		assert.Equal(t, http.StatusForbidden, w.Code)
+		assert.Contains(t, w.Body.String(), `type="password"`)
+		assert.Empty(t, w.Header().Get("Location"))
+	})
+
+	t.Run("Wrong password", func(t *testing.T) {
+		w := post("10.0.0.1:1000", "guess")
+		assert.Equal(t, http.StatusForbidden, w.Code)
+		assert.Empty(t, w.Result().Cookies())
+	})
+
+	t.Run("Right password unlocks link", func(t *testing.T) {
+		w := post("10.0.0.2:1000", "open+sesame")
+		require.Equal(t, http.StatusSeeOther, w.Code)
+		assert.Equal(t, "/secret", w.Header().Get("Location"))
+
+		cookies := w.Result().Cookies()
+		require.Len(t, cookies, 1)
+
+		w = get(cookies[0])
+		assert.Equal(t, http.StatusTemporaryRedirect, w.Code)
+		assert.Equal(t, "https://example.com/internal", w.Header().Get("Location"))
+	})
+
+	t.Run("Attempts are rate limited per IP", func(t *testing.T) {
+		codes := map[int]int{}
+		for i := 0; i < passwordAttempts+2; i++ {
+			codes[post("10.0.0.3:1000", "guess").Code]++
+		}
+		assert.Equal(t, passwordAttempts, codes[http.StatusForbidden])
+		assert.Equal(t, 2, codes[http.StatusTooManyRequests])
+	})
+}
+
+func TestErrorPages(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "410.html"), []byte(`<p>custom {{.Code}}</p>`), 0644))
+	renderer, err := pages.Load(dir)
+	require.NoError(t, err)
+
+	storageApp := storage.NewStorageMemory()
+	require.NoError(t, storageApp.Put(storage.LinkEntity{ID: "deleted", OriginalURL: "https://example.com"}))
+	require.NoError(t, storageApp.RemoveURLs(context.Background(), "", []string{"deleted"}))
+
+	tests := []struct {
+		name       string
+		cfg        *service.ConfigVars
+		hash       string
+		accept     string
+		statusCode int
+		body       string
+		location   string
+	}{
+		{
+			name:       "Unknown link as JSON",
+			cfg:        &service.ConfigVars{},
+			hash:       "unknown",
+			accept:     "application/json",
+			statusCode: http.StatusNotFound,
+			body:       `{"status":404,"code":"link_not_found","message":"link not found"}`,
+		},
+		{
+			name:       "Unknown link as HTML",
+			cfg:        &service.ConfigVars{},
+			hash:       "unknown",
+			accept:     "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8",
+			statusCode: http.StatusNotFound,
+			body:       "We could not find a link",
+		},
+		{
+			name:       "Deleted link from overridden page",
+			cfg:        &service.ConfigVars{},
+			hash:       "deleted",
+			accept:     "text/html",
+			statusCode: http.StatusGone,
+			body:       "<p>custom link_deleted</p>",
+		},
+		{
+			name:       "Deleted link prefers JSON by quality",
+			cfg:        &service.ConfigVars{},
+			hash:       "deleted",
+			accept:     "text/html;q=0.5, application/json",
+			statusCode: http.StatusGone,
+			body:       `"code":"link_deleted"`,
+		},
+		{
+			name:       "Unknown link with global fallback",
+			cfg:        &service.ConfigVars{NotFoundRedirect: "https://example.com/"},
+			hash:       "unknown",
+			accept:     "text/html",
+			statusCode: http.StatusTemporaryRedirect,
+			location:   "https://example.com/",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			serverHandler := NewServerHandler(test.cfg, storageApp, WithPages(renderer))
+
+			requestGet := httptest.NewRequest(http.MethodGet, "/", nil)
+			requestGet.Header.Set(echo.HeaderAccept, test.accept)
+			w := httptest.NewRecorder()
+			c := echo.New().NewContext(requestGet, w)
+			c.SetParamNames("hash")
+			c.SetParamValues(test.hash)
+
+			assert.NoError(t, serverHandler.GetURL(c))
+			assert.Equal(t, test.statusCode, w.Code)
+			assert.Contains(t, w.Body.String(), test.body)
+			assert.Equal(t, test.location, w.Header().Get("Location"))
+		})
+	}
+}
+
+func TestRedirectCaching(t *testing.T) {
+	cfg := &service.ConfigVars{BaseURL: "http://localhost:8080"}
+	storageApp := storage.NewStorageMemory()
+	serverHandler := NewServerHandler(cfg, storageApp)
+
+	soon := time.Now().Add(time.Minute)
+	links := []storage.LinkEntity{
+		{ID: "plain", OriginalURL: "https://example.com/plain"},
+		{ID: "expiring", OriginalURL: "https://example.com/expiring", ExpiresAt: &soon},
+		{ID: "limited", OriginalURL: "https://example.com/limited", MaxClicks: 1},
+	}
+	for _, link := range links {
+		require.NoError(t, storageApp.Put(link))
+	}
+
+	request := func(method, hash string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, "/", nil)
+		w := httptest.NewRecorder()
+		c := echo.New().NewContext(r, w)
+		c.SetParamNames("hash")
+		c.SetParamValues(hash)
+		require.NoError(t, serverHandler.GetURL(c))
+		return w
+	}
+
+	t.Run("Plain redirect is public without click recording", func(t *testing.T) {
+		w := request(http.MethodHead, "plain")
+		assert.Equal(t, http.StatusTemporaryRedirect, w.Code)
+		assert.Equal(t, "https://example.com/plain", w.Header().Get("Location"))
+		assert.Equal(t, "public, max-age=300", w.Header().Get("Cache-Control"))
+		assert.NotEmpty(t, w.Header().Get("Expires"))
+	})
+
+	t.Run("Max age is capped by expiry", func(t *testing.T) {
+		w := request(http.MethodGet, "expiring")
+		assert.Regexp(t, `^public, max-age=(59|60)$`, w.Header().Get("Cache-Control"))
+	})
+
+	t.Run("HEAD neither uses up clicks nor reveals the destination", func(t *testing.T) {
+		for i := 0; i < 3; i++ {
+			w := request(http.MethodHead, "limited")
+			assert.Equal(t, http.StatusOK, w.Code)
+			assert.Empty(t, w.Header().Get("Location"))
+			assert.Equal(t, "private, no-store", w.Header().Get("Cache-Control"))
+		}
+		assert.Equal(t, http.StatusTemporaryRedirect, request(http.MethodGet, "limited").Code)
+		assert.Equal(t, http.StatusGone, request(http.MethodGet, "limited").Code)
+	})
+
+	t.Run("Campaign links are not shared", func(t *testing.T) {
+		require.NoError(t, storageApp.Put(storage.LinkEntity{ID: "campaign", OriginalURL: "https://example.com/sale", CampaignID: "spring"}))
+		w := request(http.MethodGet, "campaign")
+		assert.Equal(t, "private, no-store", w.Header().Get("Cache-Control"))
+	})
+
+	t.Run("Recorded clicks reach the server", func(t *testing.T) {
+		// Wired like cmd/shortener: clicks go to the recorder and the hub.
+		recorder := &clickRecorderMock{}
+		hub := live.NewHub(live.DefaultHistory, live.DefaultBuffer)
+		defer hub.Close()
+		serverHandler = NewServerHandler(cfg, storageApp, WithClickRecorder(recorder), WithLiveHub(hub))
+
+		for _, hash := range []string{"plain", "expiring"} {
+			w := request(http.MethodGet, hash)
+			assert.Equal(t, http.StatusTemporaryRedirect, w.Code)
+			assert.Equal(t, "private, no-cache", w.Header().Get("Cache-Control"), hash)
+			assert.Empty(t, w.Header().Get("Expires"), hash)
+		}
+
+		w := request(http.MethodHead, "plain")
+		assert.Equal(t, "https://example.com/plain", w.Header().Get("Location"))
+		assert.Equal(t, "private, no-cache", w.Header().Get("Cache-Control"))
+		assert.Equal(t, "private, no-store", request(http.MethodGet, "campaign").Header().Get("Cache-Control"))
+		assert.Len(t, recorder.events, 3, "HEAD is not a click")
+	})
+}
+
+func TestRemoveURLs(t *testing.T) {
+	cfg := &service.ConfigVars{BaseURL: "http://localhost:8080"}
+	storageApp := storage.NewStorageMemory()
+	serverHandler := NewServerHandler(cfg, storageApp)
+
+	owner := service.SetCookie()
+	ownerID, _ := service.UserID(owner)
+	require.NoError(t, storageApp.Put(storage.LinkEntity{ID: "mine", OriginalURL: "https://example.com", UserID: ownerID}))
+
+	remove := func(cookie *http.Cookie) int {
+		r := httptest.NewRequest(http.MethodDelete, "/api/user/urls", strings.NewReader(`["mine"]`))
+		r.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		if cookie != nil {
+			r.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		require.NoError(t, serverHandler.RemoveURLs(echo.New().NewContext(r, w)))
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusAccepted, remove(service.SetCookie()))
+	assert.Equal(t, http.StatusAccepted, remove(nil))
+	_, err := storageApp.GetLink("mine")
+	assert.NoError(t, err, "other users cannot delete the link")
+
+	assert.Equal(t, http.StatusAccepted, remove(owner))
+	_, err = storageApp.GetLink("mine")
+	assert.ErrorIs(t, err, apiError.ErrDeleteLink)
+}
+
+func TestUserURLsETag(t *testing.T) {
+	cfg := &service.ConfigVars{BaseURL: "http://localhost:8080"}
+	storageApp := storage.NewStorageMemory()
+	serverHandler := NewServerHandler(cfg, storageApp)
+
+	cookie := service.SetCookie()
+	userID, _ := service.UserID(cookie)
+	require.NoError(t, storageApp.Put(storage.LinkEntity{ID: "plain", OriginalURL: "https://example.com", UserID: userID}))
+
+	list := func(ifNoneMatch string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/api/user/urls", nil)
+		r.AddCookie(cookie)
+		if ifNoneMatch != "" {
+			r.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		w := httptest.NewRecorder()
+		require.NoError(t, serverHandler.GetURLs(echo.New().NewContext(r, w)))
+		return w
+	}
+
+	first := list("")
+	require.Equal(t, http.StatusOK, first.Code)
+	tag := first.Header().Get("ETag")
+	require.NotEmpty(t, tag)
+
+	notModified := list(tag)
+	assert.Equal(t, http.StatusNotModified, notModified.Code)
+	assert.Empty(t, notModified.Body.String())
+
+	require.NoError(t, storageApp.Put(storage.LinkEntity{ID: "stranger", OriginalURL: "https://example.net", UserID: "stranger"}))
+	assert.Equal(t, http.StatusNotModified, list(tag).Code, "other users' links are not listed")
+
+	require.NoError(t, storageApp.Put(storage.LinkEntity{ID: "other", OriginalURL: "https://example.org", UserID: userID}))
+	changed := list(tag)
+	assert.Equal(t, http.StatusOK, changed.Code)
+	assert.NotEqual(t, tag, changed.Header().Get("ETag"))
+}
+
+func TestLanguages(t *testing.T) {
+	cfg := &service.ConfigVars{BaseURL: "http://localhost:8080"}
+	storageApp := storage.NewStorageMemory()
+	recorder := &clickRecorderMock{}
+	serverHandler := NewServerHandler(cfg, storageApp, WithClickRecorder(recorder))
+
+	languages := []storage.LanguageVariant{
+		{Tag: "de", URL: "https://docs.example.com/de/"},
+		{Tag: "pt-BR", URL: "https://docs.example.com/pt-br/"},
+		{Tag: "fr", URL: "https://docs.example.com/fr/"},
+	}
+	require.NoError(t, validateLanguages(languages))
+	require.NoError(t, storageApp.Put(storage.LinkEntity{
+		ID:          "docs",
+		OriginalURL: "https://docs.example.com/en/",
+		Languages:   languages,
+	}))
+
+	tests := []struct {
+		name           string
+		acceptLanguage string
+		location       string
+	}{
+		{
+			name:           "Exact match",
+			acceptLanguage: "de-DE,de;q=0.9,en;q=0.8",
+			location:       "https://docs.example.com/de/",
+		},
+		{
+			name:           "Quality values are honoured",
+			acceptLanguage: "fr;q=0.3, de;q=0.7",
+			location:       "https://docs.example.com/de/",
+		},
+		{
+			name:           "Regional variant",
+			acceptLanguage: "pt-BR",
+			location:       "https://docs.example.com/pt-br/",
+		},
+		{
+			name:           "Unsupported language falls back to default",
+			acceptLanguage: "ja-JP,ja;q=0.9",
+			location:       "https://docs.example.com/en/",
+		},
+		{
+			name:           "Missing header falls back to default",
+			acceptLanguage: "",
+			location:       "https://docs.example.com/en/",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.Header.Set("Accept-Language", test.acceptLanguage)
+			w := httptest.NewRecorder()
+			c := echo.New().NewContext(r, w)
+			c.SetParamNames("hash")
+			c.SetParamValues("docs")
+
+			require.NoError(t, serverHandler.GetURL(c))
+			assert.Equal(t, test.location, w.Header().Get("Location"))
+		})
+	}
+
+	link, err := storageApp.GetLink("docs")
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), link.Languages[0].Clicks)
+	assert.Equal(t, int64(1), link.Languages[1].Clicks)
+	assert.Equal(t, int64(0), link.Languages[2].Clicks)
+
+	var recorded []string
+	for _, event := range recorder.events {
+		recorded = append(recorded, event.Language)
+	}
+	assert.Equal(t, []string{"de", "de", "pt-BR", "", ""}, recorded, "the chosen language is part of the click")
+}
+
+func TestBundles(t *testing.T) {
+	cfg := &service.ConfigVars{BaseURL: "http://localhost:8080"}
+	storageApp := storage.NewStorageMemory()
+	serverHandler := NewServerHandler(cfg, storageApp)
+
+	owner := service.SetCookie()
+	stranger := service.SetCookie()
+
+	call := func(handler echo.HandlerFunc, method, body string, cookie *http.Cookie, names []string, values ...string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, "/", strings.NewReader(body))
+		r.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		if cookie != nil {
+			r.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		c := echo.New().NewContext(r, w)
+		c.SetParamNames(names...)
+		c.SetParamValues(values...)
+		require.NoError(t, handler(c))
+		return w
+	}
+
+	w := call(serverHandler.PostBundle, http.MethodPost,
+		`{"title":"My links","theme":"dark","items":[{"title":"Blog","url":"https://blog.example.com"},{"title":"Shop","url":"https://shop.example.com"}]}`,
+		owner, nil)
+	require.Equal(t, http.StatusCreated, w.Code)
+
+	var bundle storage.Bundle
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &bundle))
+	require.NotEmpty(t, bundle.ID)
+	assert.Equal(t, "http://localhost:8080/"+bundle.ID, bundle.ShortURL)
+
+	t.Run("Invalid bundle", func(t *testing.T) {
+		w := call(serverHandler.PostBundle, http.MethodPost, `{"title":"Empty","items":[]}`, owner, nil)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("Only the owner sees the bundle", func(t *testing.T) {
+		assert.Equal(t, http.StatusOK, call(serverHandler.GetBundles, http.MethodGet, "", owner, nil).Code)
+		assert.Equal(t, http.StatusNoContent, call(serverHandler.GetBundles, http.MethodGet, "", stranger, nil).Code)
+		assert.Equal(t, http.StatusNotFound, call(serverHandler.GetBundle, http.MethodGet, "", stranger, []string{"code"}, bundle.ID).Code)
+	})
+
+	t.Run("Landing page and item clicks", func(t *testing.T) {
+		w := call(serverHandler.GetURL, http.MethodGet, "", nil, []string{"hash"}, bundle.ID)
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Body.String(), `<body class="dark">`)
+		assert.Contains(t, w.Body.String(), `href="/`+bundle.ID+`/1"`)
+
+		w = call(serverHandler.GetBundleItem, http.MethodGet, "", nil, []string{"hash", "item"}, bundle.ID, "1")
+		assert.Equal(t, http.StatusTemporaryRedirect, w.Code)
+		assert.Equal(t, "https://shop.example.com", w.Header().Get("Location"))
+
+		w = call(serverHandler.GetBundleItem, http.MethodGet, "", nil, []string{"hash", "item"}, bundle.ID, "5")
+		assert.Equal(t, http.StatusNotFound, w.Code)
+
+		stored, err := storageApp.GetBundle(bundle.ID)
+		require.NoError(t, err)
+		assert.Equal(t, int64(0), stored.Items[0].Clicks)
+		assert.Equal(t, int64(1), stored.Items[1].Clicks)
+	})
+
+	t.Run("Update keeps clicks of unchanged items", func(t *testing.T) {
+		w := call(serverHandler.PutBundle, http.MethodPut,
+			`{"title":"Links","items":[{"title":"Shop","url":"https://shop.example.com"},{"title":"Docs","url":"https://docs.example.com"}]}`,
+			owner, []string{"code"}, bundle.ID)
+		require.Equal(t, http.StatusOK, w.Code)
+
+		var updated storage.Bundle
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &updated))
+		assert.Equal(t, "Links", updated.Title)
+		assert.Equal(t, int64(1), updated.Items[0].Clicks)
+		assert.Equal(t, int64(0), updated.Items[1].Clicks)
+
+		w = call(serverHandler.PutBundle, http.MethodPut,
+			`{"title":"Hijack","items":[{"title":"Evil","url":"https://evil.example.com"}]}`,
+			stranger, []string{"code"}, bundle.ID)
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		assert.Equal(t, http.StatusNotFound, call(serverHandler.DeleteBundle, http.MethodDelete, "", stranger, []string{"code"}, bundle.ID).Code)
+		assert.Equal(t, http.StatusNoContent, call(serverHandler.DeleteBundle, http.MethodDelete, "", owner, []string{"code"}, bundle.ID).Code)
+		assert.Equal(t, http.StatusNotFound, call(serverHandler.GetURL, http.MethodGet, "", nil, []string{"hash"}, bundle.ID).Code)
+	})
+}
+
+type clickRecorderMock struct {
+	mu     sync.Mutex
+	events []storage.ClickEvent
+}
+
+func (m *clickRecorderMock) Record(event storage.ClickEvent) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.events = append(m.events, event)
+	return true
+}
+
+func TestClickEvents(t *testing.T) {
+	cfg := &service.ConfigVars{BaseURL: "http://localhost:8080"}
+	storageApp := storage.NewStorageMemory()
+	recorder := &clickRecorderMock{}
+	serverHandler := NewServerHandler(cfg, storageApp, WithClickRecorder(recorder))
+
+	require.NoError(t, storageApp.Put(storage.LinkEntity{ID: "link", OriginalURL: "https://example.com"}))
+
+	request := func(method, query string) {
+		r := httptest.NewRequest(method, "/link"+query, nil)
+		r.RemoteAddr = "192.0.2.10:1234"
+		r.Header.Set("Referer", "https://news.example.org/")
+		r.Header.Set("User-Agent", "Mozilla/5.0 (X11; Linux x86_64) Firefox/118.0")
+		w := httptest.NewRecorder()
+		c := echo.New().NewContext(r, w)
+		c.SetParamNames("hash")
+		c.SetParamValues("link")
+		require.NoError(t, serverHandler.GetURL(c))
+	}
+
+	request(http.MethodGet, "")
+	request(http.MethodHead, "")
+	request(http.MethodGet, "?preview=1")
+
+	require.Len(t, recorder.events, 1)
+	event := recorder.events[0]
+	assert.Equal(t, "link", event.LinkID)
+	assert.Equal(t, "https://news.example.org/", event.Referrer)
+	assert.Equal(t, "Mozilla/5.0 (X11; Linux x86_64) Firefox/118.0", event.UserAgent)
+	assert.Len(t, event.IPHash, 64)
+	assert.NotContains(t, event.IPHash, "192.0.2.10")
+	assert.Equal(t, "desktop", event.Device)
+	assert.Equal(t, "firefox", event.Browser)
+	assert.Equal(t, "linux", event.OS)
+	assert.False(t, event.Bot)
+	assert.WithinDuration(t, time.Now(), event.Time, time.Minute)
+}
+
+func TestClickPrivacy(t *testing.T) {
+	tests := []struct {
+		name     string
+		cfg      service.ConfigVars
+		headers  map[string]string
+		referrer string
+		tracked  bool
+	}{
+		{name: "default", referrer: "https://news.example.org/", tracked: true},
+		{name: "referrer disabled", cfg: service.ConfigVars{DisableReferrer: true}, tracked: true},
+		{name: "do not track", headers: map[string]string{"DNT": "1"}},
+		{name: "global privacy control", headers: map[string]string{"Sec-GPC": "1"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "storage.json")
+			storageApp, err := storage.NewStorageFile(path)
+			require.NoError(t, err)
+			require.NoError(t, storageApp.Put(storage.LinkEntity{ID: "link", OriginalURL: "https://example.com"}))
+
+			cfg := tt.cfg
+			cfg.BaseURL = "http://localhost:8080"
+			cfg.TruncateIP = true
+			recorder := &clickRecorderMock{}
+			serverHandler := NewServerHandler(&cfg, storageApp, WithClickRecorder(recorder))
+
+			r := httptest.NewRequest(http.MethodGet, "/link", nil)
+			r.RemoteAddr = "192.0.2.10:1234"
+			r.Header.Set("Referer", "https://news.example.org/")
+			r.Header.Set("User-Agent", "Mozilla/5.0 (X11; Linux x86_64) Firefox/118.0")
+			for k, v := range tt.headers {
+				r.Header.Set(k, v)
+			}
+			c := echo.New().NewContext(r, httptest.NewRecorder())
+			c.SetParamNames("hash")
+			c.SetParamValues("link")
+			require.NoError(t, serverHandler.GetURL(c))
+
+			require.Len(t, recorder.events, 1)
+			event := recorder.events[0]
+			assert.Equal(t, tt.referrer, event.Referrer)
+			assert.Equal(t, tt.tracked, event.IPHash != "")
+			assert.Equal(t, tt.tracked, event.UserAgent != "")
+			assert.Equal(t, "desktop", event.Device)
+
+			require.NoError(t, storageApp.SaveClicks(context.Background(), recorder.events))
+			require.NoError(t, storageApp.Close())
+			data, err := os.ReadFile(path)
+			require.NoError(t, err)
+			assert.Contains(t, string(data), `"link_id":"link"`)
+			assert.NotContains(t, string(data), "192.0.2")
+		})
+	}
+}
+
+func TestStats(t *testing.T) {
+	cfg := &service.ConfigVars{BaseURL: "http://localhost:8080"}
+	storageApp := storage.NewStorageMemory()
+	serverHandler := NewServerHandler(cfg, storageApp)
+
+	owner := service.SetCookie()
+	ownerID, _ := service.UserID(owner)
+	stranger := service.SetCookie()
+
+	require.NoError(t, storageApp.Put(storage.LinkEntity{ID: "link", OriginalURL: "https://example.com", UserID: ownerID}))
+	day := time.Date(2026, 3, 2, 0, 0, 0, 0, time.UTC)
+	require.NoError(t, storageApp.SaveClicks(context.Background(), []storage.ClickEvent{
+		{Time: day.Add(1 * time.Hour), LinkID: "link", IPHash: testIPHash("a"), Referrer: "https://news.example.org/x", Country: "DE", Device: "mobile"},
+		{Time: day.Add(2 * time.Hour), LinkID: "link", IPHash: testIPHash("a"), Country: "DE", Device: "mobile"},
+		{Time: day.Add(26 * time.Hour), LinkID: "link", IPHash: testIPHash("b"), Referrer: "https://news.example.org/y", Country: "FR", Device: "desktop"},
+		{Time: day.Add(30 * time.Hour), LinkID: "other", IPHash: testIPHash("c")},
+		{Time: day.Add(-time.Hour), LinkID: "link", IPHash: testIPHash("d")},
+		{Time: day.Add(3 * time.Hour), LinkID: "link", IPHash: testIPHash("e"), Device: "desktop", Bot: true},
+	}))
+
+	request := func(cookie *http.Cookie, query string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/api/user/urls/link/stats?"+query, nil)
+		if cookie != nil {
+			r.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		c := echo.New().NewContext(r, w)
+		c.SetParamNames("hash")
+		c.SetParamValues("link")
+		require.NoError(t, serverHandler.GetStats(c))
+		return w
+	}
+
+	assert.Equal(t, http.StatusNotFound, request(nil, "").Code)
+	assert.Equal(t, http.StatusNotFound, request(stranger, "").Code)
+	assert.Equal(t, http.StatusBadRequest, request(owner, "bucket=month").Code)
+	assert.Equal(t, http.StatusBadRequest, request(owner, "tz=Nowhere/City").Code)
+	assert.Equal(t, http.StatusBadRequest, request(owner, "from=2026-03-04&to=2026-03-02").Code)
+
+	w := request(owner, "from=2026-03-02&to=2026-03-04&bucket=day")
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var report stats.Report
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &report))
+	assert.Equal(t, int64(3), report.TotalClicks)
+	assert.Equal(t, int64(2), report.UniqueVisitors)
+	assert.Equal(t, "24h0m0s", report.UniqueVisitorsPeriod)
+	require.Len(t, report.Series, 2)
+	assert.Equal(t, int64(2), report.Series[0].Clicks)
+	assert.Equal(t, int64(1), report.Series[1].Clicks)
+	assert.Equal(t, []stats.Count{{Value: "news.example.org", Clicks: 2}, {Value: stats.DirectReferrer, Clicks: 1}}, report.TopReferrers)
+	assert.Equal(t, []stats.Count{{Value: "DE", Clicks: 2}, {Value: "FR", Clicks: 1}}, report.TopCountries)
+	assert.Equal(t, []stats.Count{{Value: "mobile", Clicks: 2}, {Value: "desktop", Clicks: 1}}, report.TopDevices)
+	assert.Equal(t, int64(1), report.BotClicks)
+	assert.False(t, report.IncludeBots)
+
+	w = request(owner, "from=2026-03-02&to=2026-03-04&include_bots=true")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &report))
+	assert.True(t, report.IncludeBots)
+	assert.Equal(t, int64(4), report.TotalClicks)
+	assert.Equal(t, int64(0), report.BotClicks)
+	assert.Equal(t, int64(3), report.UniqueVisitors)
+	assert.Equal(t, []stats.Count{{Value: "desktop", Clicks: 2}, {Value: "mobile", Clicks: 2}}, report.TopDevices)
+
+	// Rollups and retention must not change what owners see.
+	for i, query := range []string{"from=2026-03-01&to=2026-03-04", "from=2026-03-02&to=2026-03-03&bucket=hour&tz=Asia/Kolkata"} {
+		before := request(owner, query).Body.String()
+		_, err := storageApp.Rollup(context.Background(), day.Add(time.Duration(2+24*i)*time.Hour))
+		require.NoError(t, err)
+		_, err = storageApp.DeleteClicks(context.Background(), day.Add(48*time.Hour))
+		require.NoError(t, err)
+		assert.JSONEq(t, before, request(owner, query).Body.String())
+	}
+}
+
+func TestExport(t *testing.T) {
+	cfg := &service.ConfigVars{BaseURL: "http://localhost:8080"}
+	storageApp := storage.NewStorageMemory()
+	serverHandler := NewServerHandler(cfg, storageApp)
+
+	owner := service.SetCookie()
+	ownerID, _ := service.UserID(owner)
+	stranger := service.SetCookie()
+
+	require.NoError(t, storageApp.Put(storage.LinkEntity{ID: "link", OriginalURL: "https://example.com", UserID: ownerID}))
+	require.NoError(t, storageApp.Put(storage.LinkEntity{ID: "second", OriginalURL: "https://example.org", UserID: ownerID}))
+	require.NoError(t, storageApp.Put(storage.LinkEntity{ID: "foreign", OriginalURL: "https://example.net", UserID: "someone"}))
+	day := time.Date(2026, 3, 2, 0, 0, 0, 0, time.UTC)
+	require.NoError(t, storageApp.SaveClicks(context.Background(), []storage.ClickEvent{
+		{Time: day.Add(1 * time.Hour), LinkID: "link", IPHash: testIPHash("a"), Country: "DE"},
+		{Time: day.Add(2 * time.Hour), LinkID: "second", IPHash: testIPHash("b")},
+		{Time: day.Add(3 * time.Hour), LinkID: "foreign", IPHash: testIPHash("c")},
+		{Time: day.Add(26 * time.Hour), LinkID: "link", IPHash: testIPHash("a")},
+	}))
+
+	request := func(handler echo.HandlerFunc, cookie *http.Cookie, hash, query string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/api/user/urls/export?"+query, nil)
+		if cookie != nil {
+			r.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		c := echo.New().NewContext(r, w)
+		c.SetParamNames("hash")
+		c.SetParamValues(hash)
+		require.NoError(t, handler(c))
+		return w
+	}
+
+	assert.Equal(t, http.StatusNotFound, request(serverHandler.ExportLink, stranger, "link", "").Code)
+	assert.Equal(t, http.StatusNotFound, request(serverHandler.ExportLink, nil, "link", "").Code)
+	assert.Equal(t, http.StatusUnauthorized, request(serverHandler.ExportAll, nil, "", "").Code)
+	assert.Equal(t, http.StatusBadRequest, request(serverHandler.ExportLink, owner, "link", "format=xml").Code)
+	assert.Equal(t, http.StatusBadRequest, request(serverHandler.ExportLink, owner, "link", "from=yesterday").Code)
+
+	w := request(serverHandler.ExportLink, owner, "link", "from=2026-03-01&to=2026-03-05")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "text/csv; charset=utf-8", w.Header().Get(echo.HeaderContentType))
+	assert.Equal(t, `attachment; filename="link-clicks.csv"`, w.Header().Get(echo.HeaderContentDisposition))
+	assert.Equal(t, "time,link_id,referrer,user_agent,country,device,browser,os,bot,language\n"+
+		"2026-03-02T01:00:00Z,link,,,DE,,,,false,\n"+
+		"2026-03-03T02:00:00Z,link,,,,,,,false,\n", w.Body.String())
+
+	w = request(serverHandler.ExportLink, owner, "link", "from=2026-03-03T00:00:00Z&to=2026-03-05&format=ndjson")
+	assert.Equal(t, "application/x-ndjson", w.Header().Get(echo.HeaderContentType))
+	assert.Equal(t, 1, strings.Count(w.Body.String(), "\n"))
+
+	w = request(serverHandler.ExportAll, owner, "", "from=2026-03-01&to=2026-03-05&kind=daily")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, `attachment; filename="links-daily.csv"`, w.Header().Get(echo.HeaderContentDisposition))
+	assert.Equal(t, "day,link_id,clicks,bot_clicks,unique_visitors\n"+
+		"2026-03-02,link,1,0,1\n2026-03-02,second,1,0,1\n2026-03-03,link,1,0,1\n", w.Body.String())
+
+	w = request(serverHandler.ExportAll, stranger, "", "from=2026-03-01&to=2026-03-05")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "time,link_id,referrer,user_agent,country,device,browser,os,bot,language\n", w.Body.String())
+}
+
+func TestCampaigns(t *testing.T) {
+	cfg := &service.ConfigVars{BaseURL: "http://localhost:8080"}
+	storageApp := storage.NewStorageMemory()
+	serverHandler := NewServerHandler(cfg, storageApp)
+
+	owner := service.SetCookie()
+	ownerID, _ := service.UserID(owner)
+	stranger := service.SetCookie()
+
+	require.NoError(t, storageApp.Put(storage.LinkEntity{ID: "spring", OriginalURL: "https://shop.example.com/spring?utm_source=mail", UserID: ownerID}))
+	require.NoError(t, storageApp.Put(storage.LinkEntity{ID: "summer", OriginalURL: "https://shop.example.com/summer#top", UserID: ownerID}))
+	require.NoError(t, storageApp.Put(storage.LinkEntity{ID: "other", OriginalURL: "https://example.org", UserID: ownerID}))
+	require.NoError(t, storageApp.Put(storage.LinkEntity{ID: "foreign", OriginalURL: "https://example.net", UserID: "someone"}))
+
+	call := func(handler echo.HandlerFunc, method, body string, cookie *http.Cookie, names []string, values ...string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, "/", strings.NewReader(body))
+		r.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		if cookie != nil {
+			r.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		c := echo.New().NewContext(r, w)
+		c.SetParamNames(names...)
+		c.SetParamValues(values...)
+		require.NoError(t, handler(c))
+		return w
+	}
+
+	w := call(serverHandler.PostCampaign, http.MethodPost,
+		`{"name":"Sale","params":{"utm_source":"campaign","utm_campaign":"sale"},"links":["spring","summer"]}`,
+		owner, nil)
+	require.Equal(t, http.StatusCreated, w.Code)
+
+	var campaign storage.Campaign
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &campaign))
+	require.NotEmpty(t, campaign.ID)
+	assert.Empty(t, campaign.UserID)
+	assert.Equal(t, []string{"spring", "summer"}, campaign.Links)
+
+	t.Run("Invalid campaign", func(t *testing.T) {
+		assert.Equal(t, http.StatusBadRequest, call(serverHandler.PostCampaign, http.MethodPost, `{"links":[]}`, owner, nil).Code)
+		w := call(serverHandler.PostCampaign, http.MethodPost, `{"name":"Theft","links":["foreign"]}`, owner, nil)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.Equal(t, "link foreign not found", w.Body.String())
+	})
+
+	t.Run("Only the owner sees the campaign", func(t *testing.T) {
+		assert.Equal(t, http.StatusOK, call(serverHandler.GetCampaigns, http.MethodGet, "", owner, nil).Code)
+		assert.Equal(t, http.StatusNoContent, call(serverHandler.GetCampaigns, http.MethodGet, "", stranger, nil).Code)
+		assert.Equal(t, http.StatusNotFound, call(serverHandler.GetCampaign, http.MethodGet, "", stranger, []string{"code"}, campaign.ID).Code)
+		assert.Equal(t, http.StatusNotFound, call(serverHandler.GetCampaignStats, http.MethodGet, "", stranger, []string{"code"}, campaign.ID).Code)
+		assert.Equal(t, http.StatusNotFound, call(serverHandler.DeleteCampaign, http.MethodDelete, "", stranger, []string{"code"}, campaign.ID).Code)
+	})
+
+	t.Run("Params are added to member destinations", func(t *testing.T) {
+		w := call(serverHandler.GetURL, http.MethodGet, "", nil, []string{"hash"}, "spring")
+		assert.Equal(t, "https://shop.example.com/spring?utm_source=mail&utm_campaign=sale", w.Header().Get("Location"))
+
+		w = call(serverHandler.GetURL, http.MethodGet, "", nil, []string{"hash"}, "summer")
+		assert.Equal(t, "https://shop.example.com/summer?utm_campaign=sale&utm_source=campaign#top", w.Header().Get("Location"))
+
+		w = call(serverHandler.GetURL, http.MethodGet, "", nil, []string{"hash"}, "other")
+		assert.Equal(t, "https://example.org", w.Header().Get("Location"))
+	})
+
+	t.Run("Aggregated stats", func(t *testing.T) {
+		day := time.Date(2026, 3, 2, 0, 0, 0, 0, time.UTC)
+		require.NoError(t, storageApp.SaveClicks(context.Background(), []storage.ClickEvent{
+			{Time: day.Add(1 * time.Hour), LinkID: "spring", IPHash: testIPHash("a")},
+			{Time: day.Add(2 * time.Hour), LinkID: "summer", IPHash: testIPHash("a")},
+			{Time: day.Add(3 * time.Hour), LinkID: "summer", IPHash: testIPHash("b")},
+			{Time: day.Add(4 * time.Hour), LinkID: "summer", IPHash: testIPHash("c"), Bot: true},
+			{Time: day.Add(26 * time.Hour), LinkID: "summer", IPHash: testIPHash("b")},
+			{Time: day.Add(27 * time.Hour), LinkID: "other", IPHash: testIPHash("d")},
+		}))
+
+		r := httptest.NewRequest(http.MethodGet, "/?from=2026-03-01&to=2026-03-04", nil)
+		r.AddCookie(owner)
+		w := httptest.NewRecorder()
+		c := echo.New().NewContext(r, w)
+		c.SetParamNames("code")
+		c.SetParamValues(campaign.ID)
+		require.NoError(t, serverHandler.GetCampaignStats(c))
+		require.Equal(t, http.StatusOK, w.Code)
+
+		var report CampaignReport
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &report))
+		assert.Equal(t, campaign.ID, report.CampaignID)
+		assert.Equal(t, int64(4), report.TotalClicks)
+		assert.Equal(t, int64(1), report.BotClicks)
+		assert.Equal(t, int64(2), report.UniqueVisitors, "visitors of several links are counted once")
+		require.Len(t, report.Series, 3)
+		assert.Equal(t, []int64{0, 3, 1}, []int64{report.Series[0].Clicks, report.Series[1].Clicks, report.Series[2].Clicks})
+		assert.Equal(t, []CampaignClick{
+			{LinkID: "summer", ShortURL: "http://localhost:8080/summer", Clicks: 3},
+			{LinkID: "spring", ShortURL: "http://localhost:8080/spring", Clicks: 1},
+		}, report.Links)
+	})
+
+	t.Run("Update and delete", func(t *testing.T) {
+		w := call(serverHandler.PutCampaign, http.MethodPut, `{"name":"Sale 2"}`, owner, []string{"code"}, campaign.ID)
+		require.Equal(t, http.StatusOK, w.Code)
+		campaign = storage.Campaign{}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &campaign))
+		assert.Equal(t, "Sale 2", campaign.Name)
+		assert.Equal(t, []string{"spring", "summer"}, campaign.Links, "links are kept without a links field")
+		assert.Empty(t, campaign.Params)
+
+		w = call(serverHandler.PutCampaign, http.MethodPut, `{"name":"Sale 2","params":{"ref":"x"},"links":["other","summer"]}`, owner, []string{"code"}, campaign.ID)
+		require.Equal(t, http.StatusOK, w.Code)
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &campaign))
+		assert.Equal(t, []string{"other", "summer"}, campaign.Links)
+
+		w = call(serverHandler.GetURL, http.MethodGet, "", nil, []string{"hash"}, "spring")
+		assert.Equal(t, "https://shop.example.com/spring?utm_source=mail", w.Header().Get("Location"))
+		w = call(serverHandler.GetURL, http.MethodGet, "", nil, []string{"hash"}, "other")
+		assert.Equal(t, "https://example.org?ref=x", w.Header().Get("Location"))
+
+		assert.Equal(t, http.StatusNoContent, call(serverHandler.DeleteCampaign, http.MethodDelete, "", owner, []string{"code"}, campaign.ID).Code)
+		assert.Equal(t, http.StatusNotFound, call(serverHandler.GetCampaign, http.MethodGet, "", owner, []string{"code"}, campaign.ID).Code)
+
+		link, err := storageApp.GetLink("other")
+		require.NoError(t, err)
+		assert.Empty(t, link.CampaignID)
+		w = call(serverHandler.GetURL, http.MethodGet, "", nil, []string{"hash"}, "other")
+		assert.Equal(t, "https://example.org", w.Header().Get("Location"))
+	})
+}
+
+func TestConversions(t *testing.T) {
+	cfg := &service.ConfigVars{BaseURL: "http://localhost:8080"}
+	storageApp := storage.NewStorageMemory()
+	serverHandler := NewServerHandler(cfg, storageApp)
+
+	owner := service.SetCookie()
+	ownerID, _ := service.UserID(owner)
+	stranger := service.SetCookie()
+
+	require.NoError(t, storageApp.Put(storage.LinkEntity{ID: "signup", OriginalURL: "https://app.example.com/join?plan=pro", UserID: ownerID}))
+
+	call := func(handler echo.HandlerFunc, method, target, body string, cookie *http.Cookie, names []string, values ...string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, strings.NewReader(body))
+		r.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		if cookie != nil {
+			r.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		c := echo.New().NewContext(r, w)
+		c.SetParamNames(names...)
+		c.SetParamValues(values...)
+		require.NoError(t, handler(c))
+		return w
+	}
+
+	assert.Equal(t, http.StatusBadRequest, call(serverHandler.PutConversions, http.MethodPut, "/", `{"mode":"header"}`, owner, []string{"hash"}, "signup").Code)
+
+	w := call(serverHandler.PutConversions, http.MethodPut, "/", `{"mode":"query"}`, owner, []string{"hash"}, "signup")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"mode":"query","param":"click_id"}`, w.Body.String())
+
+	var clickIDs []string
+	t.Run("Click ID in the query", func(t *testing.T) {
+		w := call(serverHandler.GetURL, http.MethodGet, "/", "", nil, []string{"hash"}, "signup")
+		require.Equal(t, http.StatusTemporaryRedirect, w.Code)
+		assert.Equal(t, "private, no-store", w.Header().Get(echo.HeaderCacheControl))
+
+		location, err := url.Parse(w.Header().Get("Location"))
+		require.NoError(t, err)
+		assert.Equal(t, "pro", location.Query().Get("plan"))
+		clickID := location.Query().Get("click_id")
+		linkID, _, ok := service.ParseClickID(clickID)
+		require.True(t, ok)
+		assert.Equal(t, "signup", linkID)
+		clickIDs = append(clickIDs, clickID)
+
+		w = call(serverHandler.GetURL, http.MethodHead, "/", "", nil, []string{"hash"}, "signup")
+		assert.NotContains(t, w.Header().Get("Location"), "click_id")
+	})
+
+	t.Run("Postback", func(t *testing.T) {
+		w := call(serverHandler.PostConversion, http.MethodPost, "/?click_id="+url.QueryEscape(clickIDs[0]), "", nil, nil)
+		assert.Equal(t, http.StatusCreated, w.Code)
+		assert.JSONEq(t, fmt.Sprintf(`{"click_id":%q,"link_id":"signup","status":"recorded"}`, clickIDs[0]), w.Body.String())
+
+		w = call(serverHandler.PostConversion, http.MethodGet, "/?click_id="+url.QueryEscape(clickIDs[0]), "", nil, nil)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Body.String(), `"duplicate"`)
+
+		tampered := strings.Replace(clickIDs[0], ".", "x.", 1)
+		assert.Equal(t, http.StatusBadRequest, call(serverHandler.PostConversion, http.MethodPost, "/?click_id="+url.QueryEscape(tampered), "", nil, nil).Code)
+		assert.Equal(t, http.StatusBadRequest, call(serverHandler.PostConversion, http.MethodPost, "/", "", nil, nil).Code)
+
+		expired := service.NewClickID("signup", time.Now().Add(-31*24*time.Hour))
+		w = call(serverHandler.PostConversion, http.MethodPost, "/?click_id="+url.QueryEscape(expired), "", nil, nil)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.Equal(t, "click id expired", w.Body.String())
+	})
+
+	t.Run("Click ID cookie and pixel", func(t *testing.T) {
+		require.Equal(t, http.StatusOK, call(serverHandler.PutConversions, http.MethodPut, "/", `{"mode":"cookie"}`, owner, []string{"hash"}, "signup").Code)
+
+		w := call(serverHandler.GetURL, http.MethodGet, "/", "", nil, []string{"hash"}, "signup")
+		assert.Equal(t, "https://app.example.com/join?plan=pro", w.Header().Get("Location"))
+		cookies := w.Result().Cookies()
+		require.Len(t, cookies, 1)
+		assert.Equal(t, "click_id", cookies[0].Name)
+		assert.True(t, cookies[0].HttpOnly)
+
+		w = call(serverHandler.GetConversionPixel, http.MethodGet, "/", "", cookies[0], nil)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "image/gif", w.Header().Get(echo.HeaderContentType))
+		assert.Equal(t, transparentGIF, w.Body.Bytes())
+
+		w = call(serverHandler.GetConversionPixel, http.MethodGet, "/?click_id=broken", "", nil, nil)
+		assert.Equal(t, http.StatusOK, w.Code, "the pixel never breaks the page")
+
+		w = call(serverHandler.PostConversion, http.MethodPost, "/?click_id="+url.QueryEscape(cookies[0].Value), "", nil, nil)
+		assert.Equal(t, http.StatusOK, w.Code, "the pixel recorded the conversion")
+	})
+
+	t.Run("Report", func(t *testing.T) {
+		now := time.Now().UTC()
+		require.NoError(t, storageApp.SaveClicks(context.Background(), []storage.ClickEvent{
+			{Time: now, LinkID: "signup", IPHash: testIPHash("a")},
+			{Time: now, LinkID: "signup", IPHash: testIPHash("b")},
+			{Time: now, LinkID: "signup", IPHash: testIPHash("c")},
+			{Time: now, LinkID: "signup", IPHash: testIPHash("d")},
+			{Time: now, LinkID: "signup", IPHash: testIPHash("e"), Bot: true},
+		}))
+
+		target := fmt.Sprintf("/?from=%s&to=%s", now.Add(-24*time.Hour).Format("2006-01-02"), now.Add(24*time.Hour).Format("2006-01-02"))
+		assert.Equal(t, http.StatusNotFound, call(serverHandler.GetConversions, http.MethodGet, target, "", stranger, []string{"hash"}, "signup").Code)
+		assert.Equal(t, http.StatusBadRequest, call(serverHandler.GetConversions, http.MethodGet, "/?from=soon", "", owner, []string{"hash"}, "signup").Code)
+
+		w := call(serverHandler.GetConversions, http.MethodGet, target, "", owner, []string{"hash"}, "signup")
+		require.Equal(t, http.StatusOK, w.Code)
+
+		var report ConversionReport
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &report))
+		assert.Equal(t, int64(4), report.Clicks, "bot clicks are not counted")
+		assert.Equal(t, int64(2), report.Conversions)
+		assert.Equal(t, 0.5, report.Rate)
+		require.Len(t, report.Days, 1)
+		assert.Equal(t, storage.SketchDay(now), report.Days[0].Day)
+		assert.Equal(t, 0.5, report.Days[0].Rate)
+	})
+}
+
+func TestSession(t *testing.T) {
+	cfg := &service.ConfigVars{BaseURL: "http://localhost:8080"}
+	storageApp := storage.NewStorageMemory()
+	serverHandler := NewServerHandler(cfg, storageApp)
+
+	cookie := service.SetCookie()
+	userID, _ := service.UserID(cookie)
+
+	post := func(body string, cookie *http.Cookie) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/api/shorten", strings.NewReader(body))
+		r.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		if cookie != nil {
+			r.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		c := echo.New().NewContext(r, w)
+		require.NoError(t, serverHandler.Session()(serverHandler.PostURLJSON)(c))
+		return w
+	}
+
+	t.Run("Valid token keeps the identity", func(t *testing.T) {
+		w := post(`{"url":"https://example.com/kept"}`, cookie)
+		require.Equal(t, http.StatusCreated, w.Code)
+		assert.Empty(t, w.Result().Cookies(), "no new token for a valid one")
+
+		link, err := storageApp.GetLink(usecases.GenerateShortLink([]byte("https://example.com/kept")))
+		require.NoError(t, err)
+		assert.Equal(t, userID, link.UserID)
+	})
+
+	t.Run("Malformed token is replaced", func(t *testing.T) {
+		for _, value := range []string{"garbage", "id:zz", "id:key.zz", ":"} {
+			w := post(fmt.Sprintf(`{"url":"https://example.com/%s"}`, url.PathEscape(value)), &http.Cookie{Name: "token", Value: value})
+			require.Equal(t, http.StatusCreated, w.Code)
+			cookies := w.Result().Cookies()
+			require.Len(t, cookies, 1)
+			issued, ok := service.UserID(cookies[0])
+			require.True(t, ok)
+			assert.NotEqual(t, userID, issued)
+		}
+	})
+
+	t.Run("Identity is stored in the context", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "/api/user/urls", nil)
+		r.AddCookie(cookie)
+		c := echo.New().NewContext(r, httptest.NewRecorder())
+
+		var user User
+		require.NoError(t, serverHandler.Session()(func(c echo.Context) error {
+			var ok bool
+			user, ok = UserFromContext(c)
+			require.True(t, ok)
+			return nil
+		})(c))
+		assert.Equal(t, User{ID: userID}, user)
+
+		c = echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/api/user/urls", nil), httptest.NewRecorder())
+		require.NoError(t, serverHandler.Session()(func(c echo.Context) error {
+			user, _ = UserFromContext(c)
+			return nil
+		})(c))
+		assert.True(t, user.Issued)
+		assert.NotEmpty(t, user.ID)
+	})
+
+	t.Run("New callers own nothing", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "/api/user/urls", nil)
+		w := httptest.NewRecorder()
+		require.NoError(t, serverHandler.Session()(serverHandler.GetURLs)(echo.New().NewContext(r, w)))
+		assert.Equal(t, http.StatusNoContent, w.Code)
+		assert.Len(t, w.Result().Cookies(), 1)
+	})
+}
+
+func TestAPIKeys(t *testing.T) {
+	cfg := &service.ConfigVars{BaseURL: "http://localhost:8080"}
+	storageApp := storage.NewStorageMemory()
+	serverHandler := NewServerHandler(cfg, storageApp)
+
+	e := echo.New()
+	session := serverHandler.Session()
+	e.POST("/api/shorten", serverHandler.PostURLJSON, session, RequireScope(ScopeCreate))
+	user := e.Group("/api/user", session)
+	user.GET("/urls", serverHandler.GetURLs, RequireScope(ScopeRead))
+	user.GET("/urls/:hash/stats", serverHandler.GetStats, RequireScope(ScopeStats))
+	user.POST("/keys", serverHandler.PostAPIKey)
+	user.GET("/keys", serverHandler.GetAPIKeys)
+	user.DELETE("/keys/:id", serverHandler.DeleteAPIKey)
+
+	owner := service.SetCookie()
+	ownerID, _ := service.UserID(owner)
+	stranger := service.SetCookie()
+
+	do := func(method, target, body string, cookie *http.Cookie, key string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, strings.NewReader(body))
+		r.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		if cookie != nil {
+			r.AddCookie(cookie)
+		}
+		if key != "" {
+			r.Header.Set(echo.HeaderAuthorization, "Bearer "+key)
+		}
+		w := httptest.NewRecorder()
+		e.ServeHTTP(w, r)
+		return w
+	}
+
+	assert.Equal(t, http.StatusBadRequest, do(http.MethodPost, "/api/user/keys", `{"scopes":["admin"]}`, owner, "").Code)
+	assert.Equal(t, http.StatusBadRequest, do(http.MethodPost, "/api/user/keys", `{"expires_at":"2020-01-01T00:00:00Z"}`, owner, "").Code)
+
+	w := do(http.MethodPost, "/api/user/keys", `{"name":"ci","scopes":["create","stats"]}`, owner, "")
+	require.Equal(t, http.StatusCreated, w.Code)
+	assert.NotContains(t, w.Body.String(), "hash")
+
+	var created APIKeyResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &created))
+	require.NotEmpty(t, created.Key)
+	assert.Equal(t, []string{ScopeCreate, ScopeStats}, created.Scopes)
+
+	t.Run("Only a hash is stored", func(t *testing.T) {
+		key, err := storageApp.GetAPIKey(created.ID)
+		require.NoError(t, err)
+		assert.Equal(t, ownerID, key.UserID)
+		assert.NotContains(t, key.Hash, strings.TrimPrefix(created.Key, created.ID+"."))
+
+		w := do(http.MethodGet, "/api/user/keys", "", owner, "")
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.NotContains(t, w.Body.String(), created.Key)
+		assert.Contains(t, w.Body.String(), created.ID)
+	})
+
+	t.Run("Key acts as its owner", func(t *testing.T) {
+		w := do(http.MethodPost, "/api/shorten", `{"url":"https://example.com/from-ci"}`, nil, created.Key)
+		require.Equal(t, http.StatusCreated, w.Code)
+		assert.Empty(t, w.Result().Cookies(), "key callers get no token cookie")
+
+		id := usecases.GenerateShortLink([]byte("https://example.com/from-ci"))
+		link, err := storageApp.GetLink(id)
+		require.NoError(t, err)
+		assert.Equal(t, ownerID, link.UserID)
+
+		assert.Equal(t, http.StatusOK, do(http.MethodGet, "/api/user/urls/"+id+"/stats", "", nil, created.Key).Code)
+	})
+
+	t.Run("Scopes and key management", func(t *testing.T) {
+		w := do(http.MethodGet, "/api/user/urls", "", nil, created.Key)
+		assert.Equal(t, http.StatusForbidden, w.Code)
+		assert.Equal(t, "api key lacks the read scope", w.Body.String())
+
+		assert.Equal(t, http.StatusForbidden, do(http.MethodPost, "/api/user/keys", `{}`, nil, created.Key).Code)
+		assert.Equal(t, http.StatusForbidden, do(http.MethodDelete, "/api/user/keys/"+created.ID, "", nil, created.Key).Code)
+	})
+
+	t.Run("Bad keys are refused", func(t *testing.T) {
+		for _, key := range []string{"garbage", created.ID + ".wrong", "missing." + strings.TrimPrefix(created.Key, created.ID+".")} {
+			w := do(http.MethodGet, "/api/user/urls", "", owner, key)
+			assert.Equal(t, http.StatusUnauthorized, w.Code, key)
+			assert.Equal(t, "Bearer", w.Header().Get(echo.HeaderWWWAuthenticate))
+		}
+
+		expiresAt := time.Now().Add(-time.Minute)
+		require.NoError(t, storageApp.PutAPIKey(storage.APIKey{ID: "old", UserID: ownerID, Hash: hashKeySecret("secret"), ExpiresAt: &expiresAt}))
+		w := do(http.MethodGet, "/api/user/urls", "", nil, "old.secret")
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+		assert.Equal(t, "api key expired", w.Body.String())
+	})
+
+	t.Run("Revoke", func(t *testing.T) {
+		assert.Equal(t, http.StatusNotFound, do(http.MethodDelete, "/api/user/keys/"+created.ID, "", stranger, "").Code)
+		assert.Equal(t, http.StatusNoContent, do(http.MethodDelete, "/api/user/keys/"+created.ID, "", owner, "").Code)
+		assert.Equal(t, http.StatusUnauthorized, do(http.MethodGet, "/api/user/urls/x/stats", "", nil, created.Key).Code)
+	})
+}
+
+func TestLiveEvents(t *testing.T) {
+	heartbeat := sseHeartbeat
+	sseHeartbeat = 50 * time.Millisecond
+	defer func() { sseHeartbeat = heartbeat }()
+
+	cfg := &service.ConfigVars{BaseURL: "http://localhost:8080"}
+	storageApp := storage.NewStorageMemory()
+	hub := live.NewHub(live.DefaultHistory, live.DefaultBuffer)
+	defer hub.Close()
+	serverHandler := NewServerHandler(cfg, storageApp, WithLiveHub(hub))
+
+	owner := service.SetCookie()
+	ownerID, _ := service.UserID(owner)
+	stranger := service.SetCookie()
+	strangerID, _ := service.UserID(stranger)
+	require.NoError(t, storageApp.Put(storage.LinkEntity{ID: "link", OriginalURL: "https://example.com", UserID: ownerID}))
+	require.NoError(t, storageApp.Put(storage.LinkEntity{ID: "other", OriginalURL: "https://example.org", UserID: strangerID}))
+
+	e := echo.New()
+	e.GET("/:hash", serverHandler.GetURL)
+	e.GET("/api/user/urls/events", serverHandler.GetAllEvents)
+	e.GET("/api/user/urls/:hash/events", serverHandler.GetEvents)
+	server := httptest.NewServer(e)
+	defer server.Close()
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	click := func(hash string) {
+		resp, err := client.Get(server.URL + "/" + hash)
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode)
+	}
+	stream := func(path string, cookie *http.Cookie, lastID string) *http.Response {
+		r, err := http.NewRequest(http.MethodGet, server.URL+path, nil)
+		require.NoError(t, err)
+		if cookie != nil {
+			r.AddCookie(cookie)
+		}
+		if lastID != "" {
+			r.Header.Set("Last-Event-ID", lastID)
+		}
+		resp, err := client.Do(r)
+		require.NoError(t, err)
+		return resp
+	}
+
+	resp := stream("/api/user/urls/link/events", stranger, "")
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	resp = stream("/api/user/urls/events", nil, "")
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	click("link")
+
+	resp = stream("/api/user/urls/link/events", owner, "0")
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	lines := make(chan string)
+	go func() {
+		reader := bufio.NewReader(resp.Body)
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				close(lines)
+				return
+			}
+			lines <- strings.TrimSuffix(line, "\n")
+		}
+	}()
+	next := func(prefix string) string {
+		for {
+			select {
+			case line, ok := <-lines:
+				require.True(t, ok, "stream closed")
+				if strings.HasPrefix(line, prefix) {
+					return line
+				}
+			case <-time.After(5 * time.Second):
+				require.FailNow(t, "no line starting with "+prefix)
+			}
+		}
+	}
+
+	assert.Equal(t, "id: 1", next("id: "), "missed events are replayed")
+
+	click("other")
+	click("link")
+	assert.Equal(t, "id: 3", next("id: "), "other users' clicks are not streamed")
+	assert.Equal(t, "event: click", next("event: "))
+	var event live.Event
+	require.NoError(t, json.Unmarshal([]byte(strings.TrimPrefix(next("data: "), "data: ")), &event))
+	assert.Equal(t, "link", event.LinkID)
+	assert.Equal(t, uint64(3), event.ID)
+
+	assert.Equal(t, ": heartbeat", next(": heartbeat"))
+
+	all := stream("/api/user/urls/events", owner, "1")
+	defer all.Body.Close()
+	require.Equal(t, http.StatusOK, all.StatusCode)
+	reader := bufio.NewReader(all.Body)
+	line, err := reader.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "id: 3\n", line, "resuming skips events up to Last-Event-ID")
+
+	fresh := stream("/api/user/urls/events", owner, "")
+	defer fresh.Body.Close()
+	require.Equal(t, http.StatusOK, fresh.StatusCode)
+	click("link")
+	reader = bufio.NewReader(fresh.Body)
+	for {
+		line, err = reader.ReadString('\n')
+		require.NoError(t, err)
+		if strings.HasPrefix(line, "id: ") {
+			break
+		}
+	}
+	assert.Equal(t, "id: 4\n", line, "new streams do not replay the history")
+
+	hub.Close()
+	for range lines {
+	}
+}
+
+func testIPHash(visitor string) string {
+	sum := sha256.Sum256([]byte(visitor))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,193 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+
+	apiError "github.com/irootpro/shorturl/internal/error"
+	"github.com/irootpro/shorturl/internal/url/storage"
+	"github.com/irootpro/shorturl/internal/url/usecases"
+)
+
+var scopes = map[string]bool{
+	ScopeCreate: true,
+	ScopeRead:   true,
+	ScopeDelete: true,
+	ScopeStats:  true,
+}
+
+// APIKeyRequest creates an API key, without scopes the key may do anything
+// the owner can and without expires_at it never expires.
+type APIKeyRequest struct {
+	Name      string     `json:"name,omitempty"`
+	Scopes    []string   `json:"scopes,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// APIKeyResponse describes a key, Key is the bearer token and only set in
+// the response that created it.
+type APIKeyResponse struct {
+	ID        string     `json:"id"`
+	Name      string     `json:"name,omitempty"`
+	Scopes    []string   `json:"scopes,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	Key       string     `json:"key,omitempty"`
+}
+
+func (r APIKeyRequest) validate(now time.Time) error {
+	seen := make(map[string]bool, len(r.Scopes))
+	for _, scope := range r.Scopes {
+		if !scopes[scope] {
+			return fmt.Errorf("unknown scope %q", scope)
+		}
+		if seen[scope] {
+			return fmt.Errorf("duplicate scope %q", scope)
+		}
+		seen[scope] = true
+	}
+	if r.ExpiresAt != nil && !r.ExpiresAt.After(now) {
+		return errors.New("expires_at must be in the future")
+	}
+	return nil
+}
+
+func apiKeyResponse(key storage.APIKey) APIKeyResponse {
+	return APIKeyResponse{
+		ID:        key.ID,
+		Name:      key.Name,
+		Scopes:    key.Scopes,
+		CreatedAt: key.CreatedAt,
+		ExpiresAt: key.ExpiresAt,
+	}
+}
+
+func hashKeySecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func checkKeySecret(secret, hash string) bool {
+	return subtle.ConstantTimeCompare([]byte(hashKeySecret(secret)), []byte(hash)) == 1
+}
+
+// keyOwner returns the caller managing API keys. Keys are managed with the
+// token cookie only, a leaked key cannot create or revoke others.
+func (h *ServerHandler) keyOwner(c echo.Context) (User, bool) {
+	user := h.sessionUser(c)
+	return user, user.KeyID == ""
+}
+
+func apiKeyError(c echo.Context, err error) error {
+	if errors.Is(err, apiError.ErrAPIKeyNotFound) {
+		return c.String(http.StatusNotFound, "api key not found")
+	}
+	fmt.Printf("api key: %s", err.Error())
+	return c.String(http.StatusInternalServerError, "")
+}
+
+// PostAPIKey creates a key for the caller and responds with the bearer
+// token, it cannot be read again later.
+func (h *ServerHandler) PostAPIKey(c echo.Context) error {
+	user, ok := h.keyOwner(c)
+	if !ok {
+		return c.String(http.StatusForbidden, "api keys are managed with the token cookie")
+	}
+
+	var request APIKeyRequest
+	if err := c.Bind(&request); err != nil {
+		return c.String(http.StatusBadRequest, "error read api key from request")
+	}
+
+	now := time.Now().UTC()
+	if err := request.validate(now); err != nil {
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+
+	id, err := usecases.GenerateCode()
+	if err != nil {
+		return c.String(http.StatusInternalServerError, "")
+	}
+
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return c.String(http.StatusInternalServerError, "")
+	}
+	secret := base64.RawURLEncoding.EncodeToString(buf)
+
+	key := storage.APIKey{
+		ID:        id,
+		UserID:    user.ID,
+		Name:      request.Name,
+		Hash:      hashKeySecret(secret),
+		Scopes:    request.Scopes,
+		CreatedAt: now,
+		ExpiresAt: request.ExpiresAt,
+	}
+
+	if err := h.storage.PutAPIKey(key); err != nil {
+		return apiKeyError(c, err)
+	}
+
+	response := apiKeyResponse(key)
+	response.Key = id + "." + secret
+	return c.JSON(http.StatusCreated, response)
+}
+
+func (h *ServerHandler) GetAPIKeys(c echo.Context) error {
+	user, ok := h.keyOwner(c)
+	if !ok {
+		return c.String(http.StatusForbidden, "api keys are managed with the token cookie")
+	}
+	if user.Issued {
+		return c.NoContent(http.StatusNoContent)
+	}
+
+	keys, err := h.storage.GetAPIKeys(user.ID)
+	if err != nil {
+		return apiKeyError(c, err)
+	}
+
+	if len(keys) == 0 {
+		return c.NoContent(http.StatusNoContent)
+	}
+
+	response := make([]APIKeyResponse, 0, len(keys))
+	for _, key := range keys {
+		response = append(response, apiKeyResponse(key))
+	}
+
+	return c.JSON(http.StatusOK, response)
+}
+
+// DeleteAPIKey revokes a key of the caller, other users' keys are reported
+// as missing.
+func (h *ServerHandler) DeleteAPIKey(c echo.Context) error {
+	user, ok := h.keyOwner(c)
+	if !ok {
+		return c.String(http.StatusForbidden, "api keys are managed with the token cookie")
+	}
+
+	key, err := h.storage.GetAPIKey(c.Param("id"))
+	if err != nil {
+		return apiKeyError(c, err)
+	}
+	if user.Issued || key.UserID != user.ID {
+		return apiKeyError(c, apiError.ErrAPIKeyNotFound)
+	}
+
+	if err := h.storage.DeleteAPIKey(key.ID); err != nil {
+		return apiKeyError(c, err)
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
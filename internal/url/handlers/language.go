@@ -0,0 +1,76 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"golang.org/x/text/language"
+
+	"github.com/irootpro/shorturl/internal/url/storage"
+)
+
+// pickLanguage negotiates Accept-Language against the link's language
+// variants and returns the index of the best one, or -1 when the default
+// destination should be used.
+func pickLanguage(c echo.Context, variants []storage.LanguageVariant) int {
+	preferred, _, err := language.ParseAcceptLanguage(c.Request().Header.Get("Accept-Language"))
+	if err != nil || len(preferred) == 0 {
+		return -1
+	}
+
+	// The first supported tag is what the matcher falls back to, und keeps
+	// the default destination in that role.
+	supported := []language.Tag{language.Und}
+	for _, v := range variants {
+		supported = append(supported, language.Make(v.Tag))
+	}
+
+	_, index, confidence := language.NewMatcher(supported).Match(preferred...)
+	if confidence == language.No || index == 0 {
+		return -1
+	}
+
+	return index - 1
+}
+
+// validateLanguages checks the tags and stores them in canonical form, so
+// the chosen tag can be matched against stored variants later.
+func validateLanguages(variants []storage.LanguageVariant) error {
+	seen := make(map[string]bool)
+	for i, v := range variants {
+		if v.URL == "" {
+			return errors.New("language url is required")
+		}
+
+		tag, err := language.Parse(v.Tag)
+		if err != nil {
+			return fmt.Errorf("invalid language tag %q", v.Tag)
+		}
+
+		variants[i].Tag = tag.String()
+		if seen[variants[i].Tag] {
+			return fmt.Errorf("duplicate language tag %q", variants[i].Tag)
+		}
+		seen[variants[i].Tag] = true
+		variants[i].Clicks = 0
+	}
+	return nil
+}
+
+func (h *ServerHandler) PutLanguages(c echo.Context) error {
+	var variants []storage.LanguageVariant
+	if err := c.Bind(&variants); err != nil {
+		return c.String(http.StatusBadRequest, "error read languages from request")
+	}
+
+	if err := validateLanguages(variants); err != nil {
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+
+	return h.updateLink(c, func(link *storage.LinkEntity) interface{} {
+		link.Languages = variants
+		return link.Languages
+	})
+}
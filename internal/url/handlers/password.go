@@ -0,0 +1,120 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/time/rate"
+
+	"github.com/irootpro/shorturl/internal/url/service"
+	"github.com/irootpro/shorturl/internal/url/storage"
+)
+
+const (
+	accessCookieTTL = 30 * time.Minute
+
+	// Every client IP may try passwordAttempts passwords at once and then
+	// one more per passwordAttemptInterval.
+	passwordAttempts        = 5
+	passwordAttemptInterval = 12 * time.Second
+	attemptLimiterTTL       = 10 * time.Minute
+)
+
+type passwordPage struct {
+	Error string
+}
+
+type attemptLimiter struct {
+	mu       sync.Mutex
+	limiters map[string]*attemptEntry
+}
+
+type attemptEntry struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+func newAttemptLimiter() *attemptLimiter {
+	return &attemptLimiter{
+		limiters: make(map[string]*attemptEntry),
+	}
+}
+
+func (l *attemptLimiter) Allow(ip string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	for key, entry := range l.limiters {
+		if now.Sub(entry.lastSeen) > attemptLimiterTTL {
+			delete(l.limiters, key)
+		}
+	}
+
+	entry, ok := l.limiters[ip]
+	if !ok {
+		entry = &attemptEntry{
+			limiter: rate.NewLimiter(rate.Every(passwordAttemptInterval), passwordAttempts),
+		}
+		l.limiters[ip] = entry
+	}
+	entry.lastSeen = now
+
+	return entry.limiter.AllowN(now, 1)
+}
+
+func hashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", fmt.Errorf("hash password: %s", err.Error())
+	}
+	return string(hash), nil
+}
+
+func hasAccess(c echo.Context, link storage.LinkEntity) bool {
+	if link.PasswordHash == "" {
+		return true
+	}
+
+	cookie, err := c.Cookie(service.AccessCookieName(link.ID))
+	return err == nil && service.CheckAccessCookie(cookie, link.ID)
+}
+
+func (h *ServerHandler) renderPasswordForm(c echo.Context, status int, message string) error {
+	body, err := h.pages.Render("password.html", passwordPage{Error: message})
+	if err != nil {
+		fmt.Printf("render password form: %s", err.Error())
+		return c.String(http.StatusInternalServerError, "")
+	}
+
+	return c.HTMLBlob(status, body)
+}
+
+// UnlockURL checks the password posted from the form served by GetURL and
+// sends the client back to the short link with an access cookie.
+func (h *ServerHandler) UnlockURL(c echo.Context) error {
+	link, err := h.storage.GetLink(c.Param("hash"))
+	if err != nil {
+		return h.linkError(c, err)
+	}
+
+	if link.PasswordHash == "" {
+		return c.Redirect(http.StatusSeeOther, c.Request().URL.Path)
+	}
+
+	if !h.attempts.Allow(c.RealIP()) {
+		return h.renderPasswordForm(c, http.StatusTooManyRequests, "Too many attempts, try again later.")
+	}
+
+	password := c.FormValue("password")
+	if bcrypt.CompareHashAndPassword([]byte(link.PasswordHash), []byte(password)) != nil {
+		return h.renderPasswordForm(c, http.StatusForbidden, "Wrong password.")
+	}
+
+	c.SetCookie(service.SetAccessCookie(link.ID, accessCookieTTL))
+	return c.Redirect(http.StatusSeeOther, c.Request().URL.Path)
+}
@@ -0,0 +1,178 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/irootpro/shorturl/internal/url/geoip"
+	"github.com/irootpro/shorturl/internal/url/storage"
+	"github.com/irootpro/shorturl/internal/url/useragent"
+)
+
+const (
+	userAgentKey = "useragent"
+	// languageKey holds the tag of the language variant chosen for the
+	// redirect, the click event records it.
+	languageKey = "language"
+)
+
+type GeoLocator interface {
+	Lookup(ip net.IP) (geoip.Location, error)
+}
+
+// resolveDestination picks the URL a client is redirected to. User agent
+// rules are checked first, then geo rules, language variants and weighted
+// variants, and the original URL is the fallback when nothing matches.
+func (h *ServerHandler) resolveDestination(c echo.Context, link storage.LinkEntity) string {
+	if len(link.Rules) != 0 {
+		agent := h.userAgent(c)
+		for _, rule := range link.Rules {
+			if ruleMatches(rule, agent) {
+				return rule.URL
+			}
+		}
+	}
+
+	if len(link.GeoRules) != 0 && h.geo != nil {
+		location, err := h.geo.Lookup(net.ParseIP(c.RealIP()))
+		if err == nil {
+			for _, rule := range link.GeoRules {
+				if geoRuleMatches(rule, location) {
+					return rule.URL
+				}
+			}
+		}
+	}
+
+	if len(link.Languages) != 0 {
+		if index := pickLanguage(c, link.Languages); index >= 0 {
+			c.Set(languageKey, link.Languages[index].Tag)
+			if c.Request().Method != http.MethodHead {
+				if err := h.storage.IncrementLanguageClicks(link.ID, link.Languages[index].Tag); err != nil {
+					fmt.Printf("count language click: %s", err.Error())
+				}
+			}
+			return link.Languages[index].URL
+		}
+	}
+
+	if len(link.Variants) != 0 {
+		index := h.pickVariant(c, link)
+		if c.Request().Method != http.MethodHead {
+			if err := h.storage.IncrementVariantClicks(link.ID, index); err != nil {
+				fmt.Printf("count variant click: %s", err.Error())
+			}
+		}
+		return link.Variants[index].URL
+	}
+
+	return link.OriginalURL
+}
+
+// userAgent classifies the client once per request, routing rules and the
+// click event share the result.
+func (h *ServerHandler) userAgent(c echo.Context) useragent.Agent {
+	if agent, ok := c.Get(userAgentKey).(useragent.Agent); ok {
+		return agent
+	}
+	agent := h.agents.Classify(c.Request().UserAgent())
+	c.Set(userAgentKey, agent)
+	return agent
+}
+
+func ruleMatches(rule storage.RoutingRule, agent useragent.Agent) bool {
+	return fieldMatches(rule.OS, agent.OS) &&
+		fieldMatches(rule.Device, agent.Device) &&
+		fieldMatches(rule.Browser, agent.Browser)
+}
+
+func geoRuleMatches(rule storage.GeoRule, location geoip.Location) bool {
+	if location.Country == "" && location.Continent == "" {
+		return false
+	}
+	return fieldMatches(rule.Country, location.Country) &&
+		fieldMatches(rule.Continent, location.Continent)
+}
+
+func fieldMatches(want, got string) bool {
+	return want == "" || strings.EqualFold(want, got)
+}
+
+func validateRules(rules []storage.RoutingRule) error {
+	for _, rule := range rules {
+		if rule.URL == "" {
+			return errors.New("rule url is required")
+		}
+	}
+	return nil
+}
+
+func validateGeoRules(rules []storage.GeoRule) error {
+	for _, rule := range rules {
+		if rule.URL == "" {
+			return errors.New("rule url is required")
+		}
+		if rule.Country == "" && rule.Continent == "" {
+			return errors.New("rule country or continent is required")
+		}
+	}
+	return nil
+}
+
+func (h *ServerHandler) PutRules(c echo.Context) error {
+	var rules []storage.RoutingRule
+	if err := c.Bind(&rules); err != nil {
+		return c.String(http.StatusBadRequest, "error read rules from request")
+	}
+
+	if err := validateRules(rules); err != nil {
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+
+	return h.updateLink(c, func(link *storage.LinkEntity) interface{} {
+		link.Rules = rules
+		return link.Rules
+	})
+}
+
+func (h *ServerHandler) PutGeoRules(c echo.Context) error {
+	var rules []storage.GeoRule
+	if err := c.Bind(&rules); err != nil {
+		return c.String(http.StatusBadRequest, "error read rules from request")
+	}
+
+	if err := validateGeoRules(rules); err != nil {
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+
+	return h.updateLink(c, func(link *storage.LinkEntity) interface{} {
+		link.GeoRules = rules
+		return link.GeoRules
+	})
+}
+
+// updateLink applies change to the caller's link from the hash parameter,
+// stores it and responds with the value returned by change. Links of other
+// users are reported as missing.
+func (h *ServerHandler) updateLink(c echo.Context, change func(link *storage.LinkEntity) interface{}) error {
+	link, err := h.ownLink(c)
+	if err != nil {
+		return ownLinkError(c, err)
+	}
+
+	var response interface{}
+	err = h.storage.ModifyLink(link.ID, func(link *storage.LinkEntity) error {
+		response = change(link)
+		return nil
+	})
+	if err != nil {
+		return ownLinkError(c, err)
+	}
+
+	return c.JSON(http.StatusOK, response)
+}
@@ -0,0 +1,169 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+
+	apiError "github.com/irootpro/shorturl/internal/error"
+	"github.com/irootpro/shorturl/internal/url/service"
+)
+
+const userKey = "user"
+
+// Scopes of API keys, keys without scopes are allowed everything.
+const (
+	ScopeCreate = "create"
+	ScopeRead   = "read"
+	ScopeDelete = "delete"
+	ScopeStats  = "stats"
+)
+
+var (
+	errAPIKey        = errors.New("invalid api key")
+	errAPIKeyExpired = errors.New("api key expired")
+)
+
+// User is the caller identity resolved from the token cookie or an API key.
+type User struct {
+	ID string
+	// Issued is set when the caller had no valid token and got a new one
+	// with this response, such a user owns nothing yet.
+	Issued bool
+	// KeyID is the API key the caller authenticated with, Scopes are the
+	// scopes of that key.
+	KeyID  string
+	Scopes []string
+}
+
+// Allows reports whether the caller may act within scope. The token cookie
+// and keys without scopes allow everything.
+func (u User) Allows(scope string) bool {
+	if u.KeyID == "" || len(u.Scopes) == 0 {
+		return true
+	}
+	for _, v := range u.Scopes {
+		if v == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// Session resolves the caller identity once per request and stores it in
+// the context. An Authorization: Bearer API key takes precedence over the
+// token cookie, a bad key is refused. Callers with neither get a new token.
+func (h *ServerHandler) Session() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			user, err := h.resolveUser(c)
+			if err != nil {
+				if errors.Is(err, errAPIKey) || errors.Is(err, errAPIKeyExpired) {
+					c.Response().Header().Set(echo.HeaderWWWAuthenticate, "Bearer")
+					return c.String(http.StatusUnauthorized, err.Error())
+				}
+				fmt.Printf("session: %s", err.Error())
+				return c.String(http.StatusInternalServerError, "")
+			}
+
+			c.Set(userKey, user)
+			return next(c)
+		}
+	}
+}
+
+// RequireScope refuses API keys without scope. It runs after Session.
+func RequireScope(scope string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if user, ok := UserFromContext(c); ok && !user.Allows(scope) {
+				return c.String(http.StatusForbidden, fmt.Sprintf("api key lacks the %s scope", scope))
+			}
+			return next(c)
+		}
+	}
+}
+
+// UserFromContext returns the identity stored by Session.
+func UserFromContext(c echo.Context) (User, bool) {
+	user, ok := c.Get(userKey).(User)
+	return user, ok
+}
+
+// sessionUser returns the caller identity, resolving it when the Session
+// middleware did not run for the route. Such routes see a bad API key as
+// a caller who owns nothing.
+func (h *ServerHandler) sessionUser(c echo.Context) User {
+	if user, ok := UserFromContext(c); ok {
+		return user
+	}
+
+	user, err := h.resolveUser(c)
+	if err != nil {
+		user = User{Issued: true}
+	}
+	c.Set(userKey, user)
+	return user
+}
+
+// currentUser returns the identity of a caller who already had a token or
+// an API key.
+func (h *ServerHandler) currentUser(c echo.Context) (string, bool) {
+	user := h.sessionUser(c)
+	return user.ID, !user.Issued
+}
+
+func (h *ServerHandler) resolveUser(c echo.Context) (User, error) {
+	if token, ok := bearerToken(c.Request()); ok {
+		return h.userFromKey(token)
+	}
+
+	if cookie, err := c.Cookie("token"); err == nil {
+		if id, ok := service.UserID(cookie); ok {
+			return User{ID: id}, nil
+		}
+	}
+
+	cookie := service.SetCookie()
+	c.SetCookie(cookie)
+	id, _ := service.UserID(cookie)
+	return User{ID: id, Issued: true}, nil
+}
+
+func bearerToken(r *http.Request) (string, bool) {
+	scheme, token, ok := strings.Cut(r.Header.Get(echo.HeaderAuthorization), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	return strings.TrimSpace(token), true
+}
+
+// userFromKey looks the key up by the ID before the dot and checks the
+// secret after it against the stored hash.
+func (h *ServerHandler) userFromKey(token string) (User, error) {
+	id, secret, ok := strings.Cut(token, ".")
+	if !ok {
+		return User{}, errAPIKey
+	}
+
+	key, err := h.storage.GetAPIKey(id)
+	if err != nil {
+		if errors.Is(err, apiError.ErrAPIKeyNotFound) {
+			return User{}, errAPIKey
+		}
+		return User{}, err
+	}
+
+	if !checkKeySecret(secret, key.Hash) {
+		return User{}, errAPIKey
+	}
+	if key.ExpiresAt != nil && !time.Now().Before(*key.ExpiresAt) {
+		return User{}, errAPIKeyExpired
+	}
+
+	return User{ID: key.UserID, KeyID: key.ID, Scopes: key.Scopes}, nil
+}
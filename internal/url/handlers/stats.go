@@ -0,0 +1,133 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+
+	apiError "github.com/irootpro/shorturl/internal/error"
+	"github.com/irootpro/shorturl/internal/url/stats"
+	"github.com/irootpro/shorturl/internal/url/storage"
+)
+
+// defaultStatsRange is used when the request has no from parameter.
+const defaultStatsRange = 30 * 24 * time.Hour
+
+// GetStats reports clicks of one link to its owner, links of other users
+// are reported as missing.
+func (h *ServerHandler) GetStats(c echo.Context) error {
+	link, err := h.ownLink(c)
+	if err != nil {
+		return ownLinkError(c, err)
+	}
+
+	query, err := statsQuery(c)
+	if err != nil {
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+
+	counts, err := h.storage.GetClickCounts(c.Request().Context(), link.ID, query.From, query.To, query.Period())
+	if err != nil {
+		fmt.Printf("stats: %s", err.Error())
+		return c.String(http.StatusInternalServerError, "")
+	}
+
+	sketches, err := h.storage.GetSketches(c.Request().Context(), link.ID, query.From, query.To)
+	if err != nil {
+		fmt.Printf("stats: %s", err.Error())
+		return c.String(http.StatusInternalServerError, "")
+	}
+
+	return c.JSON(http.StatusOK, h.statsReport(counts, sketches, query))
+}
+
+// statsReport computes the report and states the period unique visitors
+// can be told apart in.
+func (h *ServerHandler) statsReport(counts []storage.ClickCount, sketches []storage.DailySketch, query stats.Query) stats.Report {
+	report := stats.Compute(counts, sketches, query)
+	report.UniqueVisitorsPeriod = h.privacy.SaltRotation().String()
+	return report
+}
+
+// ownLink loads the link from the hash parameter if it belongs to the
+// caller, other users' links are reported as missing.
+func (h *ServerHandler) ownLink(c echo.Context) (storage.LinkEntity, error) {
+	userID, ok := h.currentUser(c)
+	if !ok {
+		return storage.LinkEntity{}, apiError.ErrLinkNotFound
+	}
+
+	link, err := h.storage.GetLink(c.Param("hash"))
+	if err != nil {
+		return storage.LinkEntity{}, err
+	}
+	if link.UserID == "" || link.UserID != userID {
+		return storage.LinkEntity{}, apiError.ErrLinkNotFound
+	}
+
+	return link, nil
+}
+
+func ownLinkError(c echo.Context, err error) error {
+	if errors.Is(err, apiError.ErrLinkNotFound) || errors.Is(err, apiError.ErrDeleteLink) {
+		return c.String(http.StatusNotFound, "link not found")
+	}
+	fmt.Printf("own link: %s", err.Error())
+	return c.String(http.StatusInternalServerError, "")
+}
+
+// statsQuery reads bucket, tz, include_bots, from and to. Times are RFC 3339 or plain
+// dates, dates are midnight in the requested time zone.
+func statsQuery(c echo.Context) (stats.Query, error) {
+	query := stats.Query{
+		Bucket:   c.QueryParam("bucket"),
+		Location: time.UTC,
+	}
+	if query.Bucket == "" {
+		query.Bucket = stats.BucketDay
+	}
+
+	if includeBots := c.QueryParam("include_bots"); includeBots != "" {
+		value, err := strconv.ParseBool(includeBots)
+		if err != nil {
+			return query, fmt.Errorf("invalid include_bots %q", includeBots)
+		}
+		query.IncludeBots = value
+	}
+
+	if tz := c.QueryParam("tz"); tz != "" {
+		location, err := time.LoadLocation(tz)
+		if err != nil {
+			return query, fmt.Errorf("unknown time zone %q", tz)
+		}
+		query.Location = location
+	}
+
+	var err error
+	query.To = time.Now()
+	if to := c.QueryParam("to"); to != "" {
+		if query.To, err = parseStatsTime(to, query.Location); err != nil {
+			return query, fmt.Errorf("invalid to: %s", err.Error())
+		}
+	}
+
+	query.From = query.To.Add(-defaultStatsRange)
+	if from := c.QueryParam("from"); from != "" {
+		if query.From, err = parseStatsTime(from, query.Location); err != nil {
+			return query, fmt.Errorf("invalid from: %s", err.Error())
+		}
+	}
+
+	return query, query.Validate()
+}
+
+func parseStatsTime(value string, location *time.Location) (time.Time, error) {
+	if t, err := time.ParseInLocation("2006-01-02", value, location); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
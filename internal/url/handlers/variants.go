@@ -0,0 +1,113 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/irootpro/shorturl/internal/url/storage"
+)
+
+const variantCookieMaxAge = 30 * 24 * 60 * 60
+
+// pickVariant returns the index of the variant shown to the client. A visitor
+// keeps the variant from their cookie while it is still in the list; new
+// visitors are bucketed by a hash of their address, user agent and the link
+// so the choice is stable even when cookies are disabled.
+func (h *ServerHandler) pickVariant(c echo.Context, link storage.LinkEntity) int {
+	name := variantCookieName(link.ID)
+	if cookie, err := c.Cookie(name); err == nil {
+		for i, v := range link.Variants {
+			if variantKey(v) == cookie.Value {
+				return i
+			}
+		}
+	}
+
+	hash := fnv.New64a()
+	fmt.Fprintf(hash, "%s|%s|%s", c.RealIP(), c.Request().UserAgent(), link.ID)
+	index := weightedIndex(link.Variants, hash.Sum64())
+
+	c.SetCookie(&http.Cookie{
+		Name:   name,
+		Value:  variantKey(link.Variants[index]),
+		Path:   "/",
+		MaxAge: variantCookieMaxAge,
+	})
+
+	return index
+}
+
+func weightedIndex(variants []storage.Variant, hash uint64) int {
+	var total uint64
+	for _, v := range variants {
+		total += uint64(v.Weight)
+	}
+
+	point := hash % total
+	for i, v := range variants {
+		if point < uint64(v.Weight) {
+			return i
+		}
+		point -= uint64(v.Weight)
+	}
+
+	return len(variants) - 1
+}
+
+// variantKey identifies a variant in the sticky cookie. It is derived from
+// the URL rather than the position, so reordering the variants does not move
+// visitors to another destination.
+func variantKey(v storage.Variant) string {
+	sum := sha256.Sum256([]byte(v.URL))
+	return hex.EncodeToString(sum[:8])
+}
+
+// variantCookieName derives a cookie name from the link hash, which may
+// contain characters not allowed in cookie names.
+func variantCookieName(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return "variant_" + hex.EncodeToString(sum[:6])
+}
+
+func validateVariants(variants []storage.Variant) error {
+	seen := make(map[string]bool, len(variants))
+	for _, v := range variants {
+		if v.URL == "" {
+			return errors.New("variant url is required")
+		}
+		if v.Weight <= 0 {
+			return errors.New("variant weight must be positive")
+		}
+		if seen[v.URL] {
+			return fmt.Errorf("duplicate variant url %q", v.URL)
+		}
+		seen[v.URL] = true
+	}
+	return nil
+}
+
+func (h *ServerHandler) PutVariants(c echo.Context) error {
+	var variants []storage.Variant
+	if err := c.Bind(&variants); err != nil {
+		return c.String(http.StatusBadRequest, "error read variants from request")
+	}
+
+	if err := validateVariants(variants); err != nil {
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+
+	for i := range variants {
+		variants[i].Clicks = 0
+	}
+
+	return h.updateLink(c, func(link *storage.LinkEntity) interface{} {
+		link.Variants = variants
+		return link.Variants
+	})
+}
@@ -0,0 +1,195 @@
+// Package hll implements HyperLogLog sketches for counting unique visitors
+// without keeping their identifiers.
+package hll
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"hash/fnv"
+	"math"
+	"math/bits"
+)
+
+// Precision is the number of hash bits used to pick a register. With 2^12
+// registers the relative standard error of an estimate is 1.04/sqrt(4096),
+// about 1.6%.
+const Precision = 12
+
+const (
+	registers = 1 << Precision
+
+	version     = 1
+	encodeDense = 0
+	// Sketches of rarely clicked links are mostly zero registers, they are
+	// encoded as a list of the non-zero ones.
+	encodeSparse = 1
+)
+
+// StandardError is the relative standard error of Estimate. Roughly 68% of
+// estimates are within one, and 95% within two standard errors of the true
+// count.
+var StandardError = 1.04 / math.Sqrt(registers)
+
+var ErrInvalidSketch = errors.New("invalid sketch encoding")
+
+// Sketch is a dense HyperLogLog sketch. The zero value is not usable, use New.
+type Sketch struct {
+	registers []uint8
+}
+
+func New() *Sketch {
+	return &Sketch{registers: make([]uint8, registers)}
+}
+
+// Add counts value as seen.
+func (s *Sketch) Add(value string) {
+	h := fnv.New64a()
+	h.Write([]byte(value))
+	s.AddHash(mix(h.Sum64()))
+}
+
+// AddHash counts a well mixed 64 bit hash.
+func (s *Sketch) AddHash(hash uint64) {
+	index := hash >> (64 - Precision)
+	rank := uint8(bits.LeadingZeros64(hash<<Precision|1<<(Precision-1)) + 1)
+	if rank > s.registers[index] {
+		s.registers[index] = rank
+	}
+}
+
+// Merge adds everything counted by other to s, the estimate of the result is
+// the estimate of the union of both sets.
+func (s *Sketch) Merge(other *Sketch) {
+	for i, v := range other.registers {
+		if v > s.registers[i] {
+			s.registers[i] = v
+		}
+	}
+}
+
+// Estimate returns the approximate number of distinct values added.
+func (s *Sketch) Estimate() int64 {
+	var sum float64
+	zeros := 0
+	for _, v := range s.registers {
+		sum += 1 / float64(uint64(1)<<v)
+		if v == 0 {
+			zeros++
+		}
+	}
+
+	m := float64(registers)
+	alpha := 0.7213 / (1 + 1.079/m)
+	estimate := alpha * m * m / sum
+
+	// Linear counting is far more accurate for small cardinalities.
+	if estimate <= 2.5*m && zeros != 0 {
+		estimate = m * math.Log(m/float64(zeros))
+	}
+
+	return int64(estimate + 0.5)
+}
+
+func (s *Sketch) MarshalBinary() ([]byte, error) {
+	nonZero := 0
+	for _, v := range s.registers {
+		if v != 0 {
+			nonZero++
+		}
+	}
+
+	if nonZero*3 >= registers {
+		data := make([]byte, 0, 3+registers)
+		data = append(data, version, Precision, encodeDense)
+		return append(data, s.registers...), nil
+	}
+
+	data := make([]byte, 0, 3+binary.MaxVarintLen64+nonZero*3)
+	data = append(data, version, Precision, encodeSparse)
+	buf := make([]byte, binary.MaxVarintLen64)
+	data = append(data, buf[:binary.PutUvarint(buf, uint64(nonZero))]...)
+	last := 0
+	for i, v := range s.registers {
+		if v == 0 {
+			continue
+		}
+		data = append(data, buf[:binary.PutUvarint(buf, uint64(i-last))]...)
+		data = append(data, v)
+		last = i
+	}
+
+	return data, nil
+}
+
+func (s *Sketch) UnmarshalBinary(data []byte) error {
+	if len(data) < 3 || data[0] != version || data[1] != Precision {
+		return ErrInvalidSketch
+	}
+
+	s.registers = make([]uint8, registers)
+	switch data[2] {
+	case encodeDense:
+		if len(data) != 3+registers {
+			return ErrInvalidSketch
+		}
+		copy(s.registers, data[3:])
+	case encodeSparse:
+		data = data[3:]
+		count, n := binary.Uvarint(data)
+		if n <= 0 {
+			return ErrInvalidSketch
+		}
+		data = data[n:]
+		index := uint64(0)
+		for ; count > 0; count-- {
+			delta, n := binary.Uvarint(data)
+			if n <= 0 || len(data) < n+1 {
+				return ErrInvalidSketch
+			}
+			if index += delta; index >= registers {
+				return ErrInvalidSketch
+			}
+			s.registers[index] = data[n]
+			data = data[n+1:]
+		}
+		if len(data) != 0 {
+			return ErrInvalidSketch
+		}
+	default:
+		return ErrInvalidSketch
+	}
+
+	return nil
+}
+
+// MarshalText lets sketches be stored in JSON files.
+func (s *Sketch) MarshalText() ([]byte, error) {
+	data, err := s.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	text := make([]byte, base64.StdEncoding.EncodedLen(len(data)))
+	base64.StdEncoding.Encode(text, data)
+	return text, nil
+}
+
+func (s *Sketch) UnmarshalText(text []byte) error {
+	data := make([]byte, base64.StdEncoding.DecodedLen(len(text)))
+	n, err := base64.StdEncoding.Decode(data, text)
+	if err != nil {
+		return ErrInvalidSketch
+	}
+	return s.UnmarshalBinary(data[:n])
+}
+
+// mix is the murmur3 finalizer, FNV alone does not spread short similar
+// strings well enough over the high bits.
+func mix(h uint64) uint64 {
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
+}
@@ -0,0 +1,71 @@
+package hll
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEstimate(t *testing.T) {
+	for _, n := range []int{0, 1, 10, 1000, 20000, 200000} {
+		t.Run(fmt.Sprint(n), func(t *testing.T) {
+			s := New()
+			for i := 0; i < n; i++ {
+				s.Add(fmt.Sprintf("visitor-%d", i))
+				// Repeated visits must not change the count.
+				s.Add(fmt.Sprintf("visitor-%d", i))
+			}
+
+			tolerance := 3 * StandardError * float64(n)
+			assert.InDelta(t, n, s.Estimate(), math.Max(tolerance, 1))
+		})
+	}
+}
+
+func TestMerge(t *testing.T) {
+	a, b, union := New(), New(), New()
+	for i := 0; i < 6000; i++ {
+		a.Add(fmt.Sprint(i))
+		union.Add(fmt.Sprint(i))
+	}
+	for i := 3000; i < 9000; i++ {
+		b.Add(fmt.Sprint(i))
+		union.Add(fmt.Sprint(i))
+	}
+
+	a.Merge(b)
+	assert.Equal(t, union.Estimate(), a.Estimate())
+	assert.InDelta(t, 9000, a.Estimate(), 3*StandardError*9000)
+}
+
+func TestEncoding(t *testing.T) {
+	for _, n := range []int{0, 5, 50000} {
+		s := New()
+		for i := 0; i < n; i++ {
+			s.Add(fmt.Sprint(i))
+		}
+
+		data, err := s.MarshalBinary()
+		require.NoError(t, err)
+		if n < 100 {
+			assert.Less(t, len(data), 32, "small sketches use the sparse encoding")
+		}
+
+		decoded := &Sketch{}
+		require.NoError(t, decoded.UnmarshalBinary(data))
+		assert.Equal(t, s.registers, decoded.registers)
+
+		text, err := json.Marshal(s)
+		require.NoError(t, err)
+		fromJSON := &Sketch{}
+		require.NoError(t, json.Unmarshal(text, fromJSON))
+		assert.Equal(t, s.registers, fromJSON.registers)
+	}
+
+	assert.ErrorIs(t, (&Sketch{}).UnmarshalBinary([]byte{version, Precision, encodeSparse, 1, 0xff}), ErrInvalidSketch)
+	assert.ErrorIs(t, (&Sketch{}).UnmarshalBinary([]byte{version, Precision + 1, encodeDense}), ErrInvalidSketch)
+}
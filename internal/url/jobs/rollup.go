@@ -0,0 +1,64 @@
+package jobs
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// rollupDelay keeps the current hour and clicks still queued in the
+// recorder out of the rollup. Clicks saved later are counted anyway, the
+// delay only saves that extra work.
+const rollupDelay = 5 * time.Minute
+
+type ClickRoller interface {
+	Rollup(ctx context.Context, until time.Time) (int64, error)
+	DeleteClicks(ctx context.Context, before time.Time) (int64, error)
+}
+
+// RunRollup rolls raw clicks up into hourly and daily counts every interval
+// and deletes raw clicks older than retention, zero retention keeps them. A
+// zero or negative interval disables the job, raw clicks are then kept.
+func RunRollup(ctx context.Context, storage ClickRoller, interval, retention time.Duration) {
+	if interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			RollupOnce(ctx, storage, now, retention)
+		}
+	}
+}
+
+// RollupOnce runs one rollup and retention pass. Both steps are safe to
+// repeat, an interrupted pass is finished by the next one.
+func RollupOnce(ctx context.Context, storage ClickRoller, now time.Time, retention time.Duration) {
+	rolled, err := storage.Rollup(ctx, now.Add(-rollupDelay))
+	if err != nil {
+		fmt.Printf("roll up clicks: %s\n", err.Error())
+		return
+	}
+	if rolled > 0 {
+		fmt.Printf("Rolled up %d clicks\n", rolled)
+	}
+
+	if retention <= 0 {
+		return
+	}
+
+	deleted, err := storage.DeleteClicks(ctx, now.Add(-retention))
+	if err != nil {
+		fmt.Printf("delete old clicks: %s\n", err.Error())
+		return
+	}
+	if deleted > 0 {
+		fmt.Printf("Deleted %d clicks past retention\n", deleted)
+	}
+}
@@ -0,0 +1,38 @@
+package jobs
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+type ExpiredRemover interface {
+	RemoveExpired(ctx context.Context, now time.Time) (int64, error)
+}
+
+// RunSweeper tombstones expired links every interval until ctx is done. A
+// zero or negative interval disables the sweeper.
+func RunSweeper(ctx context.Context, storage ExpiredRemover, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			removed, err := storage.RemoveExpired(ctx, now)
+			if err != nil {
+				fmt.Printf("sweep expired links: %s\n", err.Error())
+				continue
+			}
+			if removed > 0 {
+				fmt.Printf("Sweeper removed %d expired links\n", removed)
+			}
+		}
+	}
+}
@@ -0,0 +1,152 @@
+// Package live fans click events out to Server-Sent Events subscribers.
+package live
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultHistory is how many recent events are kept for clients
+	// resuming with Last-Event-ID.
+	DefaultHistory = 1024
+	// DefaultBuffer is how many events a subscriber may fall behind before
+	// it is dropped.
+	DefaultBuffer = 256
+	// Latest subscribes to new events only, without replaying the history.
+	Latest = ^uint64(0)
+)
+
+// Event is one redirect as shown to the link owner.
+type Event struct {
+	ID       uint64    `json:"id"`
+	UserID   string    `json:"-"`
+	LinkID   string    `json:"link_id"`
+	Time     time.Time `json:"time"`
+	Referrer string    `json:"referrer,omitempty"`
+	Country  string    `json:"country,omitempty"`
+	Device   string    `json:"device,omitempty"`
+	Browser  string    `json:"browser,omitempty"`
+	OS       string    `json:"os,omitempty"`
+	Language string    `json:"language,omitempty"`
+	Bot      bool      `json:"bot,omitempty"`
+}
+
+// Subscription receives the events of one user, or of one of the user's
+// links when LinkID is set. C is closed when the subscriber was too slow or
+// the hub was closed.
+type Subscription struct {
+	C <-chan Event
+
+	userID string
+	linkID string
+	events chan Event
+}
+
+func (s *Subscription) matches(event Event) bool {
+	return event.UserID == s.userID && (s.linkID == "" || event.LinkID == s.linkID)
+}
+
+// Hub keeps a ring buffer of recent events and the current subscriptions.
+// Publish never blocks: a subscriber whose buffer is full is dropped and has
+// to reconnect, resuming from the ring buffer.
+type Hub struct {
+	mu          sync.Mutex
+	lastID      uint64
+	history     []Event
+	next        int
+	buffer      int
+	subscribers map[*Subscription]struct{}
+	closed      bool
+}
+
+func NewHub(history, buffer int) *Hub {
+	return &Hub{
+		history:     make([]Event, 0, history),
+		buffer:      buffer,
+		subscribers: make(map[*Subscription]struct{}),
+	}
+}
+
+// Publish assigns the event its ID and hands it to matching subscribers.
+func (h *Hub) Publish(event Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.closed {
+		return
+	}
+
+	h.lastID++
+	event.ID = h.lastID
+
+	if len(h.history) < cap(h.history) {
+		h.history = append(h.history, event)
+	} else if len(h.history) > 0 {
+		h.history[h.next] = event
+		h.next = (h.next + 1) % len(h.history)
+	}
+
+	for sub := range h.subscribers {
+		if !sub.matches(event) {
+			continue
+		}
+		select {
+		case sub.events <- event:
+		default:
+			h.drop(sub)
+		}
+	}
+}
+
+// Subscribe registers a subscriber and returns the buffered events after
+// lastID it has missed, oldest first. New subscribers pass Latest.
+func (h *Hub) Subscribe(userID, linkID string, lastID uint64) (*Subscription, []Event) {
+	events := make(chan Event, h.buffer)
+	sub := &Subscription{C: events, userID: userID, linkID: linkID, events: events}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.closed {
+		close(events)
+		return sub, nil
+	}
+
+	var missed []Event
+	for i := range h.history {
+		event := h.history[(h.next+i)%len(h.history)]
+		if event.ID > lastID && sub.matches(event) {
+			missed = append(missed, event)
+		}
+	}
+
+	h.subscribers[sub] = struct{}{}
+
+	return sub, missed
+}
+
+func (h *Hub) Unsubscribe(sub *Subscription) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if _, ok := h.subscribers[sub]; ok {
+		h.drop(sub)
+	}
+}
+
+// Close ends all subscriptions so streaming handlers return on shutdown.
+func (h *Hub) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.closed = true
+	for sub := range h.subscribers {
+		h.drop(sub)
+	}
+}
+
+func (h *Hub) drop(sub *Subscription) {
+	delete(h.subscribers, sub)
+	close(sub.events)
+}
@@ -0,0 +1,58 @@
+package live
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHub(t *testing.T) {
+	hub := NewHub(3, 2)
+
+	all, missed := hub.Subscribe("user", "", 0)
+	assert.Empty(t, missed)
+	link, _ := hub.Subscribe("user", "a", 0)
+
+	hub.Publish(Event{UserID: "user", LinkID: "a"})
+	hub.Publish(Event{UserID: "user", LinkID: "b"})
+	hub.Publish(Event{UserID: "other", LinkID: "c"})
+
+	assert.Equal(t, uint64(1), (<-all.C).ID)
+	assert.Equal(t, uint64(2), (<-all.C).ID)
+	assert.Equal(t, uint64(1), (<-link.C).ID)
+
+	// Both subscribers have room for two more events.
+	hub.Publish(Event{UserID: "user", LinkID: "a"})
+	hub.Publish(Event{UserID: "user", LinkID: "a"})
+	hub.Publish(Event{UserID: "user", LinkID: "a"})
+
+	var received []uint64
+	for event := range link.C {
+		received = append(received, event.ID)
+	}
+	assert.Equal(t, []uint64{4, 5}, received, "a slow subscriber is dropped")
+
+	// Resuming replays the ring buffer, which only holds the last 3 events.
+	resumed, missed := hub.Subscribe("user", "", 1)
+	require.Len(t, missed, 3)
+	assert.Equal(t, uint64(4), missed[0].ID)
+	assert.Equal(t, uint64(6), missed[2].ID)
+
+	fresh, missed := hub.Subscribe("user", "", Latest)
+	assert.Empty(t, missed, "new subscribers do not get the history")
+	hub.Unsubscribe(fresh)
+
+	hub.Unsubscribe(resumed)
+	_, ok := <-resumed.C
+	assert.False(t, ok)
+
+	event, ok := <-all.C
+	assert.True(t, ok, "events buffered before the drop are still delivered")
+	assert.Equal(t, uint64(4), event.ID)
+
+	hub.Close()
+	sub, _ := hub.Subscribe("user", "", 0)
+	_, ok = <-sub.C
+	assert.False(t, ok)
+}
@@ -0,0 +1,54 @@
+package pages
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	"html/template"
+	"path/filepath"
+)
+
+//go:embed templates/*.html
+var templatesFS embed.FS
+
+type Renderer struct {
+	templates *template.Template
+}
+
+func New() *Renderer {
+	return &Renderer{
+		templates: template.Must(template.ParseFS(templatesFS, "templates/*.html")),
+	}
+}
+
+// Load returns the built-in pages with templates from dir overriding the
+// ones with the same file name, e.g. 404.html.
+func Load(dir string) (*Renderer, error) {
+	r := New()
+	if dir == "" {
+		return r, nil
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.html"))
+	if err != nil {
+		return nil, fmt.Errorf("list pages in %s: %s", dir, err.Error())
+	}
+	if len(files) == 0 {
+		return r, nil
+	}
+
+	if _, err = r.templates.ParseFiles(files...); err != nil {
+		return nil, fmt.Errorf("parse pages from %s: %s", dir, err.Error())
+	}
+
+	return r, nil
+}
+
+func (r *Renderer) Render(name string, data interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := r.templates.ExecuteTemplate(&buf, name, data); err != nil {
+		return nil, fmt.Errorf("render page %s: %s", name, err.Error())
+	}
+
+	return buf.Bytes(), nil
+}
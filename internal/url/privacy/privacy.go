@@ -0,0 +1,124 @@
+// Package privacy removes personal data from click events before they are
+// recorded.
+package privacy
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/irootpro/shorturl/internal/url/storage"
+)
+
+const DefaultSaltRotation = 24 * time.Hour
+
+// Truncated addresses keep the network and drop the host part.
+var (
+	ipv4Mask = net.CIDRMask(24, 32)
+	ipv6Mask = net.CIDRMask(48, 128)
+)
+
+type Config struct {
+	// TruncateIP drops the last octet of IPv4 and all but the first 48 bits
+	// of IPv6 addresses before they are hashed.
+	TruncateIP bool
+	// SaltRotation is how long a salt is used. Salts only live in memory, so
+	// hashes of different periods cannot be linked, not even by us.
+	SaltRotation time.Duration
+	// DisableReferrer stops recording the Referer header.
+	DisableReferrer bool
+}
+
+// Policy applies the configured privacy rules to click events. The client
+// address only ever leaves it as a salted hash.
+type Policy struct {
+	cfg Config
+	now func() time.Time
+
+	mu     sync.Mutex
+	period int64
+	salt   []byte
+}
+
+func NewPolicy(cfg Config) *Policy {
+	if cfg.SaltRotation <= 0 {
+		cfg.SaltRotation = DefaultSaltRotation
+	}
+	return &Policy{cfg: cfg, now: time.Now, period: -1}
+}
+
+// OptedOut reports whether the client asked not to be tracked with DNT or
+// Global Privacy Control.
+func OptedOut(r *http.Request) bool {
+	return r.Header.Get("DNT") == "1" || r.Header.Get("Sec-GPC") == "1"
+}
+
+// SaltRotation is how long address hashes stay comparable.
+func (p *Policy) SaltRotation() time.Duration {
+	return p.cfg.SaltRotation
+}
+
+// Apply fills in the visitor hash of ip and removes what the policy or the
+// client does not allow to keep. Clicks of opted out clients are still
+// counted, but without anything that identifies or locates the visitor.
+func (p *Policy) Apply(r *http.Request, ip string, event *storage.ClickEvent) {
+	if p.cfg.DisableReferrer {
+		event.Referrer = ""
+	}
+
+	if OptedOut(r) {
+		event.IPHash = ""
+		event.UserAgent = ""
+		event.Referrer = ""
+		event.Country = ""
+		return
+	}
+
+	event.IPHash = p.HashIP(ip)
+}
+
+// HashIP returns the salted hash of the optionally truncated address, or an
+// empty string when ip is not an address.
+func (p *Policy) HashIP(ip string) string {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return ""
+	}
+
+	if p.cfg.TruncateIP {
+		if v4 := parsed.To4(); v4 != nil {
+			parsed = v4.Mask(ipv4Mask)
+		} else {
+			parsed = parsed.Mask(ipv6Mask)
+		}
+	}
+
+	mac := hmac.New(sha256.New, p.currentSalt())
+	mac.Write([]byte(parsed.String()))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// currentSalt rotates the salt at fixed multiples of the rotation period, so
+// with daily rotation one salt covers one UTC day of unique visitors.
+func (p *Policy) currentSalt() []byte {
+	period := p.now().UnixNano() / int64(p.cfg.SaltRotation)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if period != p.period {
+		salt := make([]byte, 32)
+		if _, err := rand.Read(salt); err != nil {
+			panic("read random salt: " + err.Error())
+		}
+		p.salt = salt
+		p.period = period
+	}
+
+	return p.salt
+}
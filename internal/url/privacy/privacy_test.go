@@ -0,0 +1,69 @@
+package privacy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/irootpro/shorturl/internal/url/storage"
+)
+
+func TestHashIP(t *testing.T) {
+	now := time.Date(2026, 3, 2, 10, 0, 0, 0, time.UTC)
+	policy := NewPolicy(Config{})
+	policy.now = func() time.Time { return now }
+
+	hash := policy.HashIP("192.0.2.10")
+	assert.Len(t, hash, 64)
+	assert.NotContains(t, hash, "192.0.2.10")
+	assert.Equal(t, hash, policy.HashIP("192.0.2.10"))
+	assert.NotEqual(t, hash, policy.HashIP("192.0.2.11"))
+	assert.Empty(t, policy.HashIP("not an address"))
+
+	assert.NotEqual(t, hash, NewPolicy(Config{}).HashIP("192.0.2.10"), "salts are random per process")
+
+	now = now.Add(DefaultSaltRotation)
+	assert.NotEqual(t, hash, policy.HashIP("192.0.2.10"), "salts rotate")
+
+	truncating := NewPolicy(Config{TruncateIP: true})
+	assert.Equal(t, truncating.HashIP("192.0.2.10"), truncating.HashIP("192.0.2.200"))
+	assert.NotEqual(t, truncating.HashIP("192.0.2.10"), truncating.HashIP("192.0.3.10"))
+	assert.Equal(t, truncating.HashIP("2001:db8:1:2::1"), truncating.HashIP("2001:db8:1:3::1"))
+}
+
+func TestApply(t *testing.T) {
+	tests := []struct {
+		name     string
+		cfg      Config
+		headers  map[string]string
+		referrer bool
+		tracked  bool
+	}{
+		{name: "default", referrer: true, tracked: true},
+		{name: "referrer disabled", cfg: Config{DisableReferrer: true}, tracked: true},
+		{name: "do not track", headers: map[string]string{"DNT": "1"}},
+		{name: "global privacy control", headers: map[string]string{"Sec-GPC": "1"}},
+		{name: "DNT unset", headers: map[string]string{"DNT": "0"}, referrer: true, tracked: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/link", nil)
+			for k, v := range tt.headers {
+				r.Header.Set(k, v)
+			}
+
+			event := storage.ClickEvent{Referrer: "https://news.example.org/", UserAgent: "Firefox", Country: "DE", Device: "desktop"}
+			NewPolicy(tt.cfg).Apply(r, "192.0.2.10", &event)
+
+			assert.Equal(t, tt.referrer, event.Referrer != "")
+			assert.Equal(t, tt.tracked, event.IPHash != "")
+			assert.Equal(t, tt.tracked, event.UserAgent != "")
+			assert.Equal(t, tt.tracked, event.Country != "")
+			assert.Equal(t, "desktop", event.Device, "coarse classification is kept")
+		})
+	}
+}
@@ -1,52 +1,95 @@
 package service
 
 import (
-	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
-	"log"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/google/uuid"
 )
 
-var key = []byte("secret key cookie")
+// TokenTTL is how long the identity cookie is kept by browsers.
+const TokenTTL = 365 * 24 * time.Hour
 
-func SetCookie() *http.Cookie {
-	id := uuid.NewString()
+// secureCookies marks cookies Secure, SetSecureCookies turns it off for
+// plain HTTP deployments.
+var secureCookies = true
 
-	h := hmac.New(sha256.New, key)
-	h.Write([]byte(id))
-	dst := h.Sum(nil)
+// SetSecureCookies sets whether cookies are only sent over HTTPS. It is
+// called once at startup.
+func SetSecureCookies(secure bool) {
+	secureCookies = secure
+}
 
+func SetCookie() *http.Cookie {
+	id := uuid.NewString()
 	cookie := &http.Cookie{
-		Name:  "token",
-		Value: fmt.Sprintf("%s:%x", id, dst),
-		Path:  "/",
+		Name:     "token",
+		Value:    fmt.Sprintf("%s:%s", id, signature(purposeCookie, id, sha256.Size)),
+		Path:     "/",
+		Expires:  time.Now().Add(TokenTTL),
+		MaxAge:   int(TokenTTL / time.Second),
+		Secure:   secureCookies,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
 	}
 	return cookie
 }
 
+// CheckCookie reports whether a token cookie carries a valid signature, a
+// malformed cookie is simply invalid.
 func CheckCookie(cookie *http.Cookie) bool {
-	values := strings.Split(cookie.Value, ":")
+	_, ok := UserID(cookie)
+	return ok
+}
 
-	data, err := hex.DecodeString(values[1])
-	if err != nil {
-		log.Fatal(err)
-		return false
+// UserID returns the identity from a token cookie issued by SetCookie.
+func UserID(cookie *http.Cookie) (string, bool) {
+	id, signed, ok := strings.Cut(cookie.Value, ":")
+	if !ok || !verifySignature(purposeCookie, id, signed, sha256.Size) {
+		return "", false
 	}
 
-	id := values[0]
+	return id, true
+}
+
+// AccessCookieName derives the name of the cookie that unlocks a password
+// protected link, link hashes may contain characters not allowed in names.
+func AccessCookieName(linkID string) string {
+	sum := sha256.Sum256([]byte(linkID))
+	return "access_" + hex.EncodeToString(sum[:6])
+}
 
-	h := hmac.New(sha256.New, key)
-	h.Write([]byte(id))
-	sign := h.Sum(nil)
+// SetAccessCookie remembers that the password of linkID was entered, the
+// cookie is signed together with its expiry time.
+func SetAccessCookie(linkID string, ttl time.Duration) *http.Cookie {
+	expires := time.Now().Add(ttl)
+	expiresUnix := strconv.FormatInt(expires.Unix(), 10)
+	return &http.Cookie{
+		Name:     AccessCookieName(linkID),
+		Value:    fmt.Sprintf("%s:%s", expiresUnix, signature(purposeAccess, linkID+"|"+expiresUnix, sha256.Size)),
+		Path:     "/",
+		Expires:  expires,
+		Secure:   secureCookies,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+}
 
-	if hmac.Equal(sign, data) {
-		return true
-	} else {
+func CheckAccessCookie(cookie *http.Cookie, linkID string) bool {
+	values := strings.Split(cookie.Value, ":")
+	if len(values) != 2 {
 		return false
 	}
+
+	expiresUnix, err := strconv.ParseInt(values[0], 10, 64)
+	if err != nil || time.Now().Unix() >= expiresUnix {
+		return false
+	}
+
+	return verifySignature(purposeAccess, linkID+"|"+values[0], values[1], sha256.Size)
 }
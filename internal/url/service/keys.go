@@ -0,0 +1,168 @@
+package service
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+// minSecretSize is the shortest secret accepted for a signing key.
+const minSecretSize = 16
+
+// Purposes of signatures. The purpose is part of the MAC input, so a value
+// signed as one kind of token is never accepted as another.
+const (
+	purposeCookie = "cookie"
+	purposeAccess = "access"
+	purposeClick  = "click"
+)
+
+// SigningKey is an HMAC key of the cookies and click IDs. The ID is part of
+// every signature, so keys can be rotated without invalidating identities
+// signed with an older key that is still active.
+type SigningKey struct {
+	ID     string
+	Secret []byte
+}
+
+// keys holds the active []SigningKey, the last one signs. Until SetKeys is
+// called a random key is used, signatures do not survive a restart then.
+var keys atomic.Value
+
+func init() {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		panic("read random signing key: " + err.Error())
+	}
+	keys.Store([]SigningKey{{ID: "random", Secret: secret}})
+}
+
+// SetKeys replaces the active keys, the last key signs from now on.
+func SetKeys(active []SigningKey) error {
+	if len(active) == 0 {
+		return errors.New("no signing keys")
+	}
+
+	seen := make(map[string]bool, len(active))
+	for _, key := range active {
+		if !validKeyID(key.ID) {
+			return fmt.Errorf("invalid signing key id %q", key.ID)
+		}
+		if seen[key.ID] {
+			return fmt.Errorf("duplicate signing key id %q", key.ID)
+		}
+		if len(key.Secret) < minSecretSize {
+			return fmt.Errorf("signing key %s is shorter than %d bytes", key.ID, minSecretSize)
+		}
+		seen[key.ID] = true
+	}
+
+	keys.Store(append([]SigningKey(nil), active...))
+	return nil
+}
+
+// ParseKeys reads comma separated id:secret pairs, oldest first.
+func ParseKeys(spec string) ([]SigningKey, error) {
+	var parsed []SigningKey
+	for _, field := range strings.Split(spec, ",") {
+		if field = strings.TrimSpace(field); field == "" {
+			continue
+		}
+		key, err := parseKey(field)
+		if err != nil {
+			return nil, err
+		}
+		parsed = append(parsed, key)
+	}
+	return parsed, nil
+}
+
+// LoadKeys reads a keys file with one id:secret pair per line, oldest
+// first. Empty lines and lines starting with # are skipped.
+func LoadKeys(path string) ([]SigningKey, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var loaded []SigningKey
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		key, err := parseKey(text)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", line, err.Error())
+		}
+		loaded = append(loaded, key)
+	}
+
+	return loaded, scanner.Err()
+}
+
+func parseKey(text string) (SigningKey, error) {
+	id, secret, ok := strings.Cut(text, ":")
+	if !ok || secret == "" {
+		return SigningKey{}, errors.New("signing keys are id:secret pairs")
+	}
+	return SigningKey{ID: id, Secret: []byte(secret)}, nil
+}
+
+// validKeyID allows letters, digits, "-" and "_", the ID must not contain
+// the separators of the signed values.
+func validKeyID(id string) bool {
+	if id == "" {
+		return false
+	}
+	for _, r := range id {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+func mac(key SigningKey, purpose, data string) []byte {
+	h := hmac.New(sha256.New, key.Secret)
+	h.Write([]byte(purpose + "|" + data))
+	return h.Sum(nil)
+}
+
+// signature signs data for purpose with the newest key. It is the key ID
+// and the hex encoded MAC cut to size bytes, separated by a dot.
+func signature(purpose, data string, size int) string {
+	active := keys.Load().([]SigningKey)
+	key := active[len(active)-1]
+	return key.ID + "." + hex.EncodeToString(mac(key, purpose, data)[:size])
+}
+
+// verifySignature checks a signature of data for purpose made by any
+// active key.
+func verifySignature(purpose, data, signed string, size int) bool {
+	id, encoded, ok := strings.Cut(signed, ".")
+	if !ok {
+		return false
+	}
+
+	decoded, err := hex.DecodeString(encoded)
+	if err != nil || len(decoded) != size {
+		return false
+	}
+
+	for _, key := range keys.Load().([]SigningKey) {
+		if key.ID == id {
+			return hmac.Equal(mac(key, purpose, data)[:size], decoded)
+		}
+	}
+	return false
+}
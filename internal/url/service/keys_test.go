@@ -0,0 +1,108 @@
+package service
+
+import (
+	"crypto/sha256"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeyRotation(t *testing.T) {
+	previous := keys.Load()
+	t.Cleanup(func() { keys.Store(previous) })
+
+	old := SigningKey{ID: "2025", Secret: []byte("old secret of the cookies")}
+	current := SigningKey{ID: "2026", Secret: []byte("new secret of the cookies")}
+
+	require.NoError(t, SetKeys([]SigningKey{old}))
+	oldCookie := SetCookie()
+	oldClick := NewClickID("link", time.Now())
+	_, signed, _ := strings.Cut(oldCookie.Value, ":")
+	assert.True(t, strings.HasPrefix(signed, "2025."))
+
+	require.NoError(t, SetKeys([]SigningKey{old, current}))
+	newCookie := SetCookie()
+	_, signed, _ = strings.Cut(newCookie.Value, ":")
+	assert.True(t, strings.HasPrefix(signed, "2026."), "the newest key signs")
+
+	_, ok := UserID(oldCookie)
+	assert.True(t, ok, "older active keys verify")
+	_, ok = UserID(newCookie)
+	assert.True(t, ok)
+	_, _, ok = ParseClickID(oldClick)
+	assert.True(t, ok)
+
+	require.NoError(t, SetKeys([]SigningKey{current}))
+	_, ok = UserID(oldCookie)
+	assert.False(t, ok, "retired keys do not verify")
+	_, _, ok = ParseClickID(oldClick)
+	assert.False(t, ok)
+	_, ok = UserID(newCookie)
+	assert.True(t, ok)
+
+	forged := *newCookie
+	forged.Value = strings.Replace(forged.Value, "2026.", "2025.", 1)
+	_, ok = UserID(&forged)
+	assert.False(t, ok)
+}
+
+func TestSignaturePurposes(t *testing.T) {
+	signed := signature(purposeCookie, "link|1900000000", sha256.Size)
+	assert.True(t, verifySignature(purposeCookie, "link|1900000000", signed, sha256.Size))
+	assert.False(t, verifySignature(purposeAccess, "link|1900000000", signed, sha256.Size), "a token signature does not unlock links")
+
+	signed = signature(purposeClick, "user", sha256.Size)
+	_, ok := UserID(&http.Cookie{Value: "user:" + signed})
+	assert.False(t, ok, "a click ID signature is not an identity")
+}
+
+func TestSetKeys(t *testing.T) {
+	previous := keys.Load()
+	t.Cleanup(func() { keys.Store(previous) })
+
+	assert.Error(t, SetKeys(nil))
+	assert.Error(t, SetKeys([]SigningKey{{ID: "a.b", Secret: []byte("long enough secret")}}))
+	assert.Error(t, SetKeys([]SigningKey{{ID: "short", Secret: []byte("secret")}}))
+	assert.Error(t, SetKeys([]SigningKey{
+		{ID: "same", Secret: []byte("long enough secret")},
+		{ID: "same", Secret: []byte("another long secret")},
+	}))
+}
+
+func TestLoadKeys(t *testing.T) {
+	parsed, err := ParseKeys("k1:first secret value, k2:second:secret:value")
+	require.NoError(t, err)
+	assert.Equal(t, []SigningKey{
+		{ID: "k1", Secret: []byte("first secret value")},
+		{ID: "k2", Secret: []byte("second:secret:value")},
+	}, parsed)
+
+	_, err = ParseKeys("missing-secret")
+	assert.Error(t, err)
+
+	path := filepath.Join(t.TempDir(), "keys")
+	require.NoError(t, os.WriteFile(path, []byte("# rotated yearly\nk1:first secret value\n\nk2:second secret value\n"), 0o600))
+	loaded, err := LoadKeys(path)
+	require.NoError(t, err)
+	require.Len(t, loaded, 2)
+	assert.Equal(t, "k2", loaded[1].ID)
+
+	require.NoError(t, os.WriteFile(path, []byte("k1:first secret value\nbroken\n"), 0o600))
+	_, err = LoadKeys(path)
+	assert.EqualError(t, err, "line 2: signing keys are id:secret pairs")
+}
+
+func TestSetCookieAttributes(t *testing.T) {
+	cookie := SetCookie()
+	assert.True(t, cookie.Secure)
+	assert.True(t, cookie.HttpOnly)
+	assert.Equal(t, http.SameSiteLaxMode, cookie.SameSite)
+	assert.WithinDuration(t, time.Now().Add(TokenTTL), cookie.Expires, time.Minute)
+	assert.Equal(t, int(TokenTTL/time.Second), cookie.MaxAge)
+}
@@ -3,6 +3,9 @@ package service
 import (
 	"flag"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type ConfigVars struct {
@@ -10,14 +13,67 @@ type ConfigVars struct {
 	BaseURL     string
 	StoragePath string
 	DSN         string
+	// Interstitial shows the preview page for every link instead of redirecting.
+	Interstitial bool
+	// GeoIPPath points to a MaxMind-format .mmdb file, geo rules are ignored without it.
+	GeoIPPath string
+	// TrustedProxies lists IPs and CIDRs allowed to set X-Forwarded-For.
+	TrustedProxies []string
+	// SweepInterval is how often expired links are tombstoned, zero or less
+	// disables the sweeper.
+	SweepInterval time.Duration
+	// PagesDir holds HTML templates overriding the built-in pages.
+	PagesDir string
+	// NotFoundRedirect is where unknown short links are redirected instead of a 404.
+	NotFoundRedirect string
+	// UserAgentRules is a rules file replacing the built-in user agent
+	// classification, it is read again on SIGHUP.
+	UserAgentRules string
+	// RollupInterval is how often raw clicks are rolled up into hourly and
+	// daily counts, zero or less disables the rollups.
+	RollupInterval time.Duration
+	// ClickRetention is how long raw clicks are kept after their rollup,
+	// zero keeps them forever.
+	ClickRetention time.Duration
+	// TruncateIP drops the host part of client addresses before they are
+	// hashed for unique visitor counts.
+	TruncateIP bool
+	// SaltRotation is how often the in-memory salt of address hashes changes.
+	SaltRotation time.Duration
+	// DisableReferrer stops recording the Referer header of clicks.
+	DisableReferrer bool
+	// SigningKeys are comma separated id:secret pairs signing cookies and
+	// click IDs, the last one signs and all of them verify.
+	SigningKeys string
+	// SigningKeysFile holds one id:secret pair per line and replaces
+	// SigningKeys, it is read again on SIGHUP.
+	SigningKeysFile string
 }
 
 func SetVars() *ConfigVars {
 	var serverAddress, baseURL, fileStoragePath, databaseDSNString string
+	var geoIPPath, trustedProxies, pagesDir, notFoundRedirect, userAgentRules string
+	var signingKeys, signingKeysFile string
+	var interstitial, truncateIP, disableReferrer bool
+	var sweepInterval, rollupInterval, clickRetention, saltRotation time.Duration
 	flag.StringVar(&serverAddress, "a", "", "Input server address")
 	flag.StringVar(&baseURL, "b", "", "Input base url")
 	flag.StringVar(&fileStoragePath, "f", "", "Input file storage path")
 	flag.StringVar(&databaseDSNString, "d", "", "Input DSN for connetd to datbase")
+	flag.BoolVar(&interstitial, "i", false, "Always show interstitial preview page")
+	flag.StringVar(&geoIPPath, "g", "", "Input path to GeoIP database")
+	flag.StringVar(&trustedProxies, "t", "", "Input comma separated trusted proxies")
+	flag.DurationVar(&sweepInterval, "s", time.Minute, "Input interval of expired links sweeper")
+	flag.StringVar(&pagesDir, "p", "", "Input directory with custom HTML pages")
+	flag.StringVar(&notFoundRedirect, "r", "", "Input redirect URL for unknown links")
+	flag.StringVar(&userAgentRules, "u", "", "Input path to user agent rules file")
+	flag.DurationVar(&rollupInterval, "o", 5*time.Minute, "Input interval of click rollups")
+	flag.DurationVar(&clickRetention, "k", 90*24*time.Hour, "Input retention of raw clicks, 0 keeps them")
+	flag.BoolVar(&truncateIP, "n", false, "Truncate client addresses before hashing")
+	flag.DurationVar(&saltRotation, "z", 24*time.Hour, "Input rotation interval of the address hash salt")
+	flag.BoolVar(&disableReferrer, "e", false, "Do not record referrers of clicks")
+	flag.StringVar(&signingKeys, "c", "", "Input comma separated signing keys id:secret, newest last")
+	flag.StringVar(&signingKeysFile, "y", "", "Input path to signing keys file")
 	flag.Parse()
 
 	if serverAddress == "" {
@@ -52,10 +108,118 @@ func SetVars() *ConfigVars {
 		databaseDSNString = envDatabaseDSN
 	}
 
+	envInterstitial := os.Getenv("ALWAYS_INTERSTITIAL")
+	if envInterstitial != "" {
+		if value, err := strconv.ParseBool(envInterstitial); err == nil {
+			interstitial = value
+		}
+	}
+
+	envGeoIPPath := os.Getenv("GEOIP_DB")
+	if envGeoIPPath != "" {
+		geoIPPath = envGeoIPPath
+	}
+
+	envTrustedProxies := os.Getenv("TRUSTED_PROXIES")
+	if envTrustedProxies != "" {
+		trustedProxies = envTrustedProxies
+	}
+
+	envSweepInterval := os.Getenv("SWEEP_INTERVAL")
+	if envSweepInterval != "" {
+		if value, err := time.ParseDuration(envSweepInterval); err == nil {
+			sweepInterval = value
+		}
+	}
+
+	envPagesDir := os.Getenv("PAGES_DIR")
+	if envPagesDir != "" {
+		pagesDir = envPagesDir
+	}
+
+	envNotFoundRedirect := os.Getenv("NOT_FOUND_REDIRECT")
+	if envNotFoundRedirect != "" {
+		notFoundRedirect = envNotFoundRedirect
+	}
+
+	envUserAgentRules := os.Getenv("UA_RULES")
+	if envUserAgentRules != "" {
+		userAgentRules = envUserAgentRules
+	}
+
+	envRollupInterval := os.Getenv("ROLLUP_INTERVAL")
+	if envRollupInterval != "" {
+		if value, err := time.ParseDuration(envRollupInterval); err == nil {
+			rollupInterval = value
+		}
+	}
+
+	envClickRetention := os.Getenv("CLICK_RETENTION")
+	if envClickRetention != "" {
+		if value, err := time.ParseDuration(envClickRetention); err == nil {
+			clickRetention = value
+		}
+	}
+
+	envTruncateIP := os.Getenv("TRUNCATE_IP")
+	if envTruncateIP != "" {
+		if value, err := strconv.ParseBool(envTruncateIP); err == nil {
+			truncateIP = value
+		}
+	}
+
+	envSaltRotation := os.Getenv("SALT_ROTATION")
+	if envSaltRotation != "" {
+		if value, err := time.ParseDuration(envSaltRotation); err == nil {
+			saltRotation = value
+		}
+	}
+
+	envDisableReferrer := os.Getenv("DISABLE_REFERRER")
+	if envDisableReferrer != "" {
+		if value, err := strconv.ParseBool(envDisableReferrer); err == nil {
+			disableReferrer = value
+		}
+	}
+
+	envSigningKeys := os.Getenv("SIGNING_KEYS")
+	if envSigningKeys != "" {
+		signingKeys = envSigningKeys
+	}
+
+	envSigningKeysFile := os.Getenv("SIGNING_KEYS_FILE")
+	if envSigningKeysFile != "" {
+		signingKeysFile = envSigningKeysFile
+	}
+
 	return &ConfigVars{
-		SrvAddr:     serverAddress,
-		BaseURL:     baseURL,
-		StoragePath: fileStoragePath,
-		DSN:         databaseDSNString,
+		SrvAddr:          serverAddress,
+		BaseURL:          baseURL,
+		StoragePath:      fileStoragePath,
+		DSN:              databaseDSNString,
+		Interstitial:     interstitial,
+		GeoIPPath:        geoIPPath,
+		TrustedProxies:   splitList(trustedProxies),
+		SweepInterval:    sweepInterval,
+		PagesDir:         pagesDir,
+		NotFoundRedirect: notFoundRedirect,
+		UserAgentRules:   userAgentRules,
+		RollupInterval:   rollupInterval,
+		ClickRetention:   clickRetention,
+		TruncateIP:       truncateIP,
+		SaltRotation:     saltRotation,
+		DisableReferrer:  disableReferrer,
+		SigningKeys:      signingKeys,
+		SigningKeysFile:  signingKeysFile,
+	}
+}
+
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
 	}
+	return items
 }
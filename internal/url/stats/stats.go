@@ -0,0 +1,252 @@
+// Package stats aggregates the click events of a link for the stats API.
+package stats
+
+import (
+	"errors"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/irootpro/shorturl/internal/url/hll"
+	"github.com/irootpro/shorturl/internal/url/storage"
+)
+
+const (
+	BucketHour = "hour"
+	BucketDay  = "day"
+	BucketWeek = "week"
+)
+
+// MaxBuckets bounds the time series so a wide range with hourly buckets
+// cannot blow up the response.
+const MaxBuckets = 5000
+
+// TopLimit is how many entries the top lists hold.
+const TopLimit = 10
+
+// DirectReferrer names clicks that came without a Referer header.
+const DirectReferrer = storage.DirectReferrer
+
+var (
+	ErrBucket      = errors.New("bucket must be hour, day or week")
+	ErrRange       = errors.New("from must be before to")
+	ErrTooManyBins = errors.New("time range has too many buckets")
+)
+
+// Query selects the clicks in [From, To) and how they are bucketed. Bucket
+// boundaries follow the calendar of Location.
+type Query struct {
+	From     time.Time
+	To       time.Time
+	Bucket   string
+	Location *time.Location
+	// IncludeBots counts clicks classified as bots like any other click.
+	IncludeBots bool
+}
+
+type Point struct {
+	Start  time.Time `json:"start"`
+	Clicks int64     `json:"clicks"`
+}
+
+type Count struct {
+	Value  string `json:"value"`
+	Clicks int64  `json:"clicks"`
+}
+
+type Report struct {
+	From        time.Time `json:"from"`
+	To          time.Time `json:"to"`
+	Bucket      string    `json:"bucket"`
+	TimeZone    string    `json:"tz"`
+	IncludeBots bool      `json:"include_bots"`
+	TotalClicks int64     `json:"total_clicks"`
+	// BotClicks are the bot clicks left out of the report, zero when bots
+	// are included.
+	BotClicks int64 `json:"bot_clicks"`
+	// UniqueVisitors is a HyperLogLog estimate. UniqueVisitorsError is its
+	// relative standard error, the true count lies between UniqueVisitorsLow
+	// and UniqueVisitorsHigh with about 95% confidence.
+	UniqueVisitors      int64   `json:"unique_visitors"`
+	UniqueVisitorsError float64 `json:"unique_visitors_error"`
+	UniqueVisitorsLow   int64   `json:"unique_visitors_low"`
+	UniqueVisitorsHigh  int64   `json:"unique_visitors_high"`
+	// UniqueVisitorsPeriod is how long a visitor keeps the same address
+	// hash. The salt of the hash rotates every period, so a visitor coming
+	// back in a later period is counted again: unique visitors are exact
+	// only within one period and overcounted across several.
+	UniqueVisitorsPeriod string  `json:"unique_visitors_period,omitempty"`
+	Series               []Point `json:"series"`
+	TopReferrers         []Count `json:"top_referrers"`
+	TopCountries         []Count `json:"top_countries"`
+	TopDevices           []Count `json:"top_devices"`
+	TopBrowsers          []Count `json:"top_browsers"`
+	TopOS                []Count `json:"top_os"`
+}
+
+// Validate checks the query, fills in the UTC default location and aligns
+// the range to whole hours.
+func (q *Query) Validate() error {
+	if q.Location == nil {
+		q.Location = time.UTC
+	}
+
+	switch q.Bucket {
+	case BucketHour, BucketDay, BucketWeek:
+	default:
+		return ErrBucket
+	}
+
+	if !q.From.Before(q.To) {
+		return ErrRange
+	}
+
+	// Clicks are stored in hourly counts once rolled up, the range is widened
+	// to whole hours so totals do not change with the rollup.
+	q.From = q.From.Truncate(time.Hour)
+	if to := q.To.Truncate(time.Hour); !to.Equal(q.To) {
+		q.To = to.Add(time.Hour)
+	}
+
+	bins := 0
+	for start := q.bucketStart(q.From); start.Before(q.To); start = q.next(start) {
+		if bins++; bins > MaxBuckets {
+			return ErrTooManyBins
+		}
+	}
+
+	return nil
+}
+
+// Period is the coarsest resolution of stored counts that still puts every
+// click in the right bucket. Daily counts are kept for UTC days.
+func (q Query) Period() string {
+	if q.Bucket != BucketHour && q.Location.String() == "UTC" {
+		return storage.PeriodDay
+	}
+	return storage.PeriodHour
+}
+
+// Compute builds the report from click counts, which must already be limited
+// to the query range. Empty buckets are part of the series. Counts are put in
+// the bucket their hour or day starts in.
+//
+// Unique visitors come from merging the daily sketches of every day that
+// overlaps the range, so visitors of the partial days at its edges are
+// counted for the whole day. Visitors of days hashed with different salts
+// never merge, see Report.UniqueVisitorsPeriod.
+func Compute(counts []storage.ClickCount, sketches []storage.DailySketch, q Query) Report {
+	report := Report{
+		From:        q.From,
+		To:          q.To,
+		Bucket:      q.Bucket,
+		TimeZone:    q.Location.String(),
+		IncludeBots: q.IncludeBots,
+		Series:      []Point{},
+	}
+
+	index := make(map[int64]int)
+	for start := q.bucketStart(q.From); start.Before(q.To); start = q.next(start) {
+		index[start.Unix()] = len(report.Series)
+		report.Series = append(report.Series, Point{Start: start})
+	}
+
+	visitors := hll.New()
+	for _, v := range sketches {
+		if !v.Bots || q.IncludeBots {
+			visitors.Merge(v.Sketch)
+		}
+	}
+
+	referrers := make(map[string]int64)
+	countries := make(map[string]int64)
+	devices := make(map[string]int64)
+	browsers := make(map[string]int64)
+	systems := make(map[string]int64)
+
+	for _, count := range counts {
+		if count.Bot && !q.IncludeBots {
+			report.BotClicks += count.Clicks
+			continue
+		}
+
+		report.TotalClicks += count.Clicks
+
+		if i, ok := index[q.bucketStart(count.Start).Unix()]; ok {
+			report.Series[i].Clicks += count.Clicks
+		}
+
+		referrers[count.Referrer] += count.Clicks
+		if count.Country != "" {
+			countries[count.Country] += count.Clicks
+		}
+		if count.Device != "" {
+			devices[count.Device] += count.Clicks
+		}
+		if count.Browser != "" {
+			browsers[count.Browser] += count.Clicks
+		}
+		if count.OS != "" {
+			systems[count.OS] += count.Clicks
+		}
+	}
+
+	report.UniqueVisitors = visitors.Estimate()
+	report.UniqueVisitorsError = hll.StandardError
+	margin := 2 * hll.StandardError * float64(report.UniqueVisitors)
+	report.UniqueVisitorsLow = int64(math.Floor(float64(report.UniqueVisitors) - margin))
+	report.UniqueVisitorsHigh = int64(math.Ceil(float64(report.UniqueVisitors) + margin))
+	report.TopReferrers = top(referrers)
+	report.TopCountries = top(countries)
+	report.TopDevices = top(devices)
+	report.TopBrowsers = top(browsers)
+	report.TopOS = top(systems)
+
+	return report
+}
+
+func (q Query) bucketStart(t time.Time) time.Time {
+	t = t.In(q.Location)
+	switch q.Bucket {
+	case BucketHour:
+		return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, q.Location)
+	case BucketWeek:
+		// Weeks start on Monday.
+		offset := (int(t.Weekday()) + 6) % 7
+		return time.Date(t.Year(), t.Month(), t.Day()-offset, 0, 0, 0, 0, q.Location)
+	default:
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, q.Location)
+	}
+}
+
+// next steps by calendar units so buckets stay aligned across DST changes.
+func (q Query) next(start time.Time) time.Time {
+	switch q.Bucket {
+	case BucketHour:
+		return start.Add(time.Hour)
+	case BucketWeek:
+		return time.Date(start.Year(), start.Month(), start.Day()+7, 0, 0, 0, 0, q.Location)
+	default:
+		return time.Date(start.Year(), start.Month(), start.Day()+1, 0, 0, 0, 0, q.Location)
+	}
+}
+
+func top(counts map[string]int64) []Count {
+	result := make([]Count, 0, len(counts))
+	for value, clicks := range counts {
+		result = append(result, Count{Value: value, Clicks: clicks})
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Clicks != result[j].Clicks {
+			return result[i].Clicks > result[j].Clicks
+		}
+		return result[i].Value < result[j].Value
+	})
+
+	if len(result) > TopLimit {
+		result = result[:TopLimit]
+	}
+
+	return result
+}
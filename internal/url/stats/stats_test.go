@@ -0,0 +1,125 @@
+package stats
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/irootpro/shorturl/internal/url/hll"
+	"github.com/irootpro/shorturl/internal/url/storage"
+)
+
+func TestCompute(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	require.NoError(t, err)
+
+	// 2026-03-01 is a Sunday.
+	start := time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)
+	events := []storage.ClickEvent{
+		{Time: start.Add(30 * time.Minute), IPHash: "a", UserAgent: "x"},
+		{Time: start.Add(23*time.Hour + 30*time.Minute), IPHash: "a", UserAgent: "y"},
+		{Time: start.Add(24*time.Hour + 10*time.Minute), IPHash: "b"},
+		{Time: start.Add(9 * 24 * time.Hour), IPHash: "b"},
+	}
+
+	tests := []struct {
+		name   string
+		query  Query
+		starts []time.Time
+		clicks []int64
+		total  int64
+	}{
+		{
+			name:   "days in UTC",
+			query:  Query{From: start, To: start.Add(48 * time.Hour), Bucket: BucketDay},
+			starts: []time.Time{start, start.Add(24 * time.Hour)},
+			clicks: []int64{2, 1},
+			total:  3,
+		},
+		{
+			name:   "days in Berlin",
+			query:  Query{From: start, To: start.Add(48 * time.Hour), Bucket: BucketDay, Location: berlin},
+			starts: []time.Time{time.Date(2026, 3, 1, 0, 0, 0, 0, berlin), time.Date(2026, 3, 2, 0, 0, 0, 0, berlin), time.Date(2026, 3, 3, 0, 0, 0, 0, berlin)},
+			clicks: []int64{1, 2, 0},
+			total:  3,
+		},
+		{
+			name:   "weeks start on monday",
+			query:  Query{From: start, To: start.Add(14 * 24 * time.Hour), Bucket: BucketWeek},
+			starts: []time.Time{start.Add(-6 * 24 * time.Hour), start.Add(24 * time.Hour), start.Add(8 * 24 * time.Hour)},
+			clicks: []int64{2, 1, 1},
+			total:  4,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.NoError(t, tt.query.Validate())
+
+			var in []storage.ClickEvent
+			for _, event := range events {
+				if !event.Time.Before(tt.query.From) && event.Time.Before(tt.query.To) {
+					in = append(in, event)
+				}
+			}
+
+			report := Compute(storage.CountClicks(in, tt.query.Period()), nil, tt.query)
+			require.Len(t, report.Series, len(tt.starts))
+			for i := range tt.starts {
+				assert.True(t, tt.starts[i].Equal(report.Series[i].Start), "bucket %d starts at %s", i, report.Series[i].Start)
+				assert.Equal(t, tt.clicks[i], report.Series[i].Clicks, "bucket %d", i)
+			}
+			assert.Equal(t, tt.total, report.TotalClicks)
+		})
+	}
+}
+
+func TestComputeSketches(t *testing.T) {
+	day := time.Date(2026, 3, 2, 0, 0, 0, 0, time.UTC)
+	first, second, bots := hll.New(), hll.New(), hll.New()
+	for i := 0; i < 100; i++ {
+		first.Add(fmt.Sprint(i))
+		second.Add(fmt.Sprint(i + 50))
+		bots.Add(fmt.Sprint("bot", i))
+	}
+	sketches := []storage.DailySketch{
+		{Day: day, Sketch: first},
+		{Day: day.Add(24 * time.Hour), Sketch: second},
+		{Day: day.Add(24 * time.Hour), Bots: true, Sketch: bots},
+	}
+
+	query := Query{From: day, To: day.Add(30 * time.Hour), Bucket: BucketDay}
+	require.NoError(t, query.Validate())
+
+	report := Compute(nil, sketches, query)
+	assert.InDelta(t, 150, report.UniqueVisitors, 3)
+	assert.Equal(t, hll.StandardError, report.UniqueVisitorsError)
+	assert.LessOrEqual(t, report.UniqueVisitorsLow, report.UniqueVisitors)
+	assert.GreaterOrEqual(t, report.UniqueVisitorsHigh, report.UniqueVisitors)
+
+	query.IncludeBots = true
+	report = Compute(nil, sketches, query)
+	assert.InDelta(t, 250, report.UniqueVisitors, 5)
+}
+
+func TestValidate(t *testing.T) {
+	now := time.Now()
+
+	q := Query{From: now, To: now.Add(time.Hour), Bucket: "month"}
+	assert.ErrorIs(t, q.Validate(), ErrBucket)
+
+	q = Query{From: now, To: now, Bucket: BucketDay}
+	assert.ErrorIs(t, q.Validate(), ErrRange)
+
+	q = Query{From: now.Add(-MaxBuckets * time.Hour), To: now.Add(time.Hour), Bucket: BucketHour}
+	assert.ErrorIs(t, q.Validate(), ErrTooManyBins)
+
+	from := time.Date(2026, 3, 2, 10, 20, 0, 0, time.UTC)
+	q = Query{From: from, To: from.Add(2 * time.Hour), Bucket: BucketHour}
+	require.NoError(t, q.Validate())
+	assert.Equal(t, time.Date(2026, 3, 2, 10, 0, 0, 0, time.UTC), q.From)
+	assert.Equal(t, time.Date(2026, 3, 2, 13, 0, 0, 0, time.UTC), q.To)
+}
@@ -0,0 +1,181 @@
+package storage
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	apiError "github.com/irootpro/shorturl/internal/error"
+)
+
+// APIKey lets a programmatic client act as UserID. Only a hash of the
+// secret is stored, the key itself is shown once when it is created.
+type APIKey struct {
+	ID     string `json:"id"`
+	UserID string `json:"user_id,omitempty"`
+	Name   string `json:"name,omitempty"`
+	Hash   string `json:"hash,omitempty"`
+	// Scopes limit what the key may do, no scopes allow everything.
+	Scopes    []string   `json:"scopes,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+func (s *StorageFile) PutAPIKey(key APIKey) error {
+	return s.memory.PutAPIKey(key)
+}
+
+func (s *StorageFile) GetAPIKey(id string) (APIKey, error) {
+	return s.memory.GetAPIKey(id)
+}
+
+func (s *StorageFile) GetAPIKeys(userID string) ([]APIKey, error) {
+	return s.memory.GetAPIKeys(userID)
+}
+
+func (s *StorageFile) DeleteAPIKey(id string) error {
+	return s.memory.DeleteAPIKey(id)
+}
+
+func (s *StorageMemory) PutAPIKey(key APIKey) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, v := range s.apiKeys {
+		if v.ID == key.ID {
+			return fmt.Errorf("api key %s already exists", key.ID)
+		}
+	}
+
+	s.apiKeys = append(s.apiKeys, key)
+	return nil
+}
+
+func (s *StorageMemory) GetAPIKey(id string) (APIKey, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, v := range s.apiKeys {
+		if v.ID == id {
+			return v, nil
+		}
+	}
+
+	return APIKey{}, apiError.ErrAPIKeyNotFound
+}
+
+// GetAPIKeys returns the keys of userID, oldest first.
+func (s *StorageMemory) GetAPIKeys(userID string) ([]APIKey, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	keys := make([]APIKey, 0)
+	for _, v := range s.apiKeys {
+		if v.UserID == userID {
+			keys = append(keys, v)
+		}
+	}
+	sort.SliceStable(keys, func(i, j int) bool {
+		return keys[i].CreatedAt.Before(keys[j].CreatedAt)
+	})
+
+	return keys, nil
+}
+
+func (s *StorageMemory) DeleteAPIKey(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, v := range s.apiKeys {
+		if v.ID == id {
+			s.apiKeys = append(s.apiKeys[:i:i], s.apiKeys[i+1:]...)
+			return nil
+		}
+	}
+
+	return apiError.ErrAPIKeyNotFound
+}
+
+func (s *StorageDB) PutAPIKey(key APIKey) error {
+	scopes, err := marshalColumn(key.Scopes)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.Exec(
+		"INSERT INTO api_keys (id, user_id, name, hash, scopes, created_at, expires_at) VALUES ($1, $2, $3, $4, $5, $6, $7)",
+		key.ID, key.UserID, key.Name, key.Hash, scopes, key.CreatedAt, key.ExpiresAt,
+	)
+	if err != nil {
+		return fmt.Errorf("insert api key: %s", err.Error())
+	}
+
+	return nil
+}
+
+func (s *StorageDB) GetAPIKey(id string) (APIKey, error) {
+	row := s.db.QueryRow("SELECT id, user_id, name, hash, scopes, created_at, expires_at FROM api_keys WHERE id=$1", id)
+	key, err := scanAPIKey(row)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return APIKey{}, apiError.ErrAPIKeyNotFound
+		}
+		return APIKey{}, fmt.Errorf("get api key: %s", err.Error())
+	}
+
+	return key, nil
+}
+
+func (s *StorageDB) GetAPIKeys(userID string) ([]APIKey, error) {
+	rows, err := s.db.Query("SELECT id, user_id, name, hash, scopes, created_at, expires_at FROM api_keys WHERE user_id=$1 ORDER BY created_at", userID)
+	if err != nil {
+		return nil, fmt.Errorf("get api keys: %s", err.Error())
+	}
+	defer rows.Close()
+
+	keys := make([]APIKey, 0)
+	for rows.Next() {
+		key, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, fmt.Errorf("row scan: %s", err.Error())
+		}
+		keys = append(keys, key)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("row scan: %s", err.Error())
+	}
+
+	return keys, nil
+}
+
+func (s *StorageDB) DeleteAPIKey(id string) error {
+	result, err := s.db.Exec("DELETE FROM api_keys WHERE id=$1", id)
+	if err != nil {
+		return fmt.Errorf("delete api key: %s", err.Error())
+	}
+
+	return expectAffected(result, apiError.ErrAPIKeyNotFound)
+}
+
+func scanAPIKey(row rowScanner) (APIKey, error) {
+	var key APIKey
+	var scopes string
+	var expiresAt sql.NullTime
+	err := row.Scan(&key.ID, &key.UserID, &key.Name, &key.Hash, &scopes, &key.CreatedAt, &expiresAt)
+	if err != nil {
+		return key, err
+	}
+
+	if expiresAt.Valid {
+		key.ExpiresAt = &expiresAt.Time
+	}
+
+	if err = unmarshalColumn(scopes, &key.Scopes); err != nil {
+		return key, err
+	}
+
+	return key, nil
+}
@@ -0,0 +1,303 @@
+package storage
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+
+	apiError "github.com/irootpro/shorturl/internal/error"
+)
+
+// Bundle is a "link-in-bio" page served at its own short code and listing
+// several titled URLs.
+type Bundle struct {
+	ID          string       `json:"id"`
+	UserID      string       `json:"user_id,omitempty"`
+	ShortURL    string       `json:"short_url"`
+	Title       string       `json:"title"`
+	Description string       `json:"description,omitempty"`
+	Theme       string       `json:"theme,omitempty"`
+	Items       []BundleItem `json:"items"`
+}
+
+type BundleItem struct {
+	Title  string `json:"title"`
+	URL    string `json:"url"`
+	Clicks int64  `json:"clicks"`
+}
+
+func (s *StorageFile) PutBundle(bundle Bundle) error {
+	return s.memory.PutBundle(bundle)
+}
+
+func (s *StorageFile) GetBundle(id string) (Bundle, error) {
+	return s.memory.GetBundle(id)
+}
+
+func (s *StorageFile) GetBundles(userID string) ([]Bundle, error) {
+	return s.memory.GetBundles(userID)
+}
+
+func (s *StorageFile) ModifyBundle(id string, change func(bundle *Bundle) error) error {
+	return s.memory.ModifyBundle(id, change)
+}
+
+func (s *StorageFile) DeleteBundle(id string) error {
+	return s.memory.DeleteBundle(id)
+}
+
+func (s *StorageFile) IncrementBundleItemClicks(id string, item int) error {
+	return s.memory.IncrementBundleItemClicks(id, item)
+}
+
+func (s *StorageMemory) PutBundle(bundle Bundle) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, v := range s.bundles {
+		if v.ID == bundle.ID {
+			return fmt.Errorf("bundle %s already exists", bundle.ID)
+		}
+	}
+
+	s.bundles = append(s.bundles, bundle)
+	return nil
+}
+
+func (s *StorageMemory) GetBundle(id string) (Bundle, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, v := range s.bundles {
+		if v.ID == id {
+			return v, nil
+		}
+	}
+
+	return Bundle{}, apiError.ErrBundleNotFound
+}
+
+func (s *StorageMemory) GetBundles(userID string) ([]Bundle, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	bundles := make([]Bundle, 0)
+	for _, v := range s.bundles {
+		if v.UserID == userID {
+			bundles = append(bundles, v)
+		}
+	}
+
+	return bundles, nil
+}
+
+// ModifyBundle applies change to the stored bundle under the lock, item
+// clicks counted by concurrent visits are not lost.
+func (s *StorageMemory) ModifyBundle(id string, change func(bundle *Bundle) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, v := range s.bundles {
+		if v.ID != id {
+			continue
+		}
+		// Copy on write, bundles handed out by GetBundle share the old slice.
+		bundle := v
+		bundle.Items = make([]BundleItem, len(v.Items))
+		copy(bundle.Items, v.Items)
+		if err := change(&bundle); err != nil {
+			return err
+		}
+		bundle.ID = v.ID
+		bundle.UserID = v.UserID
+		s.bundles[i] = bundle
+		return nil
+	}
+
+	return apiError.ErrBundleNotFound
+}
+
+func (s *StorageMemory) DeleteBundle(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, v := range s.bundles {
+		if v.ID == id {
+			s.bundles = append(s.bundles[:i:i], s.bundles[i+1:]...)
+			return nil
+		}
+	}
+
+	return apiError.ErrBundleNotFound
+}
+
+func (s *StorageMemory) IncrementBundleItemClicks(id string, item int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, v := range s.bundles {
+		if v.ID != id {
+			continue
+		}
+		if item < 0 || item >= len(v.Items) {
+			return fmt.Errorf("bundle item %d out of range", item)
+		}
+		// Copy on write, bundles handed out by GetBundle share the old slice.
+		items := make([]BundleItem, len(v.Items))
+		copy(items, v.Items)
+		items[item].Clicks++
+		s.bundles[i].Items = items
+		return nil
+	}
+
+	return apiError.ErrBundleNotFound
+}
+
+func (s *StorageDB) PutBundle(bundle Bundle) error {
+	items, err := marshalColumn(bundle.Items)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.Exec(
+		"INSERT INTO bundles (code, user_id, title, description, theme, items) VALUES ($1, $2, $3, $4, $5, $6)",
+		bundle.ID, bundle.UserID, bundle.Title, bundle.Description, bundle.Theme, items,
+	)
+	if err != nil {
+		return fmt.Errorf("insert bundle: %s", err.Error())
+	}
+
+	return nil
+}
+
+func (s *StorageDB) GetBundle(id string) (Bundle, error) {
+	row := s.db.QueryRow("SELECT code, user_id, title, description, theme, items FROM bundles WHERE code=$1", id)
+	bundle, err := scanBundle(row)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Bundle{}, apiError.ErrBundleNotFound
+		}
+		return Bundle{}, fmt.Errorf("get bundle: %s", err.Error())
+	}
+
+	return bundle, nil
+}
+
+func (s *StorageDB) GetBundles(userID string) ([]Bundle, error) {
+	rows, err := s.db.Query("SELECT code, user_id, title, description, theme, items FROM bundles WHERE user_id=$1 ORDER BY code", userID)
+	if err != nil {
+		return nil, fmt.Errorf("get bundles: %s", err.Error())
+	}
+	defer rows.Close()
+
+	bundles := make([]Bundle, 0)
+	for rows.Next() {
+		bundle, err := scanBundle(rows)
+		if err != nil {
+			return nil, fmt.Errorf("row scan: %s", err.Error())
+		}
+		bundles = append(bundles, bundle)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("row scan: %s", err.Error())
+	}
+
+	return bundles, nil
+}
+
+// ModifyBundle locks the row so concurrent visits do not lose their item
+// clicks, see updateJSON.
+func (s *StorageDB) ModifyBundle(id string, change func(bundle *Bundle) error) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("start transaction, %s", err.Error())
+	}
+
+	defer tx.Rollback()
+
+	bundle, err := scanBundle(tx.QueryRow("SELECT code, user_id, title, description, theme, items FROM bundles WHERE code=$1 FOR UPDATE", id))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return apiError.ErrBundleNotFound
+		}
+		return fmt.Errorf("get bundle: %s", err.Error())
+	}
+
+	if err = change(&bundle); err != nil {
+		return err
+	}
+
+	items, err := marshalColumn(bundle.Items)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(
+		"UPDATE bundles SET title=$2, description=$3, theme=$4, items=$5 WHERE code=$1",
+		id, bundle.Title, bundle.Description, bundle.Theme, items,
+	)
+	if err != nil {
+		return fmt.Errorf("update bundle: %s", err.Error())
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("commit, %s", err.Error())
+	}
+
+	return nil
+}
+
+func (s *StorageDB) DeleteBundle(id string) error {
+	result, err := s.db.Exec("DELETE FROM bundles WHERE code=$1", id)
+	if err != nil {
+		return fmt.Errorf("delete bundle: %s", err.Error())
+	}
+
+	return expectAffected(result, apiError.ErrBundleNotFound)
+}
+
+func (s *StorageDB) IncrementBundleItemClicks(id string, item int) error {
+	err := s.updateJSON("bundles", "code", id, "items", func(column string) (string, error) {
+		var items []BundleItem
+		if err := unmarshalColumn(column, &items); err != nil {
+			return "", err
+		}
+		if item < 0 || item >= len(items) {
+			return "", fmt.Errorf("bundle item %d out of range", item)
+		}
+		items[item].Clicks++
+		return marshalColumn(items)
+	})
+	if errors.Is(err, apiError.ErrLinkNotFound) {
+		return apiError.ErrBundleNotFound
+	}
+
+	return err
+}
+
+func scanBundle(row rowScanner) (Bundle, error) {
+	var bundle Bundle
+	var items string
+	err := row.Scan(&bundle.ID, &bundle.UserID, &bundle.Title, &bundle.Description, &bundle.Theme, &items)
+	if err != nil {
+		return bundle, err
+	}
+
+	if err = unmarshalColumn(items, &bundle.Items); err != nil {
+		return bundle, err
+	}
+
+	return bundle, nil
+}
+
+func expectAffected(result sql.Result, notFound error) error {
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("rows affected: %s", err.Error())
+	}
+	if affected == 0 {
+		return notFound
+	}
+	return nil
+}
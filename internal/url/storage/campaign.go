@@ -0,0 +1,345 @@
+package storage
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/lib/pq"
+
+	apiError "github.com/irootpro/shorturl/internal/error"
+)
+
+// Campaign groups links of one user for reporting. Params are added to the
+// destination of member links that do not set them already.
+type Campaign struct {
+	ID          string            `json:"id"`
+	UserID      string            `json:"user_id,omitempty"`
+	Name        string            `json:"name"`
+	Description string            `json:"description,omitempty"`
+	Params      map[string]string `json:"params,omitempty"`
+	// Links are the IDs of the member links ordered by ID. They are read
+	// from the links, PutCampaign and UpdateCampaign ignore them.
+	Links []string `json:"links,omitempty"`
+}
+
+func (s *StorageFile) PutCampaign(campaign Campaign) error {
+	return s.memory.PutCampaign(campaign)
+}
+
+func (s *StorageFile) GetCampaign(id string) (Campaign, error) {
+	return s.memory.GetCampaign(id)
+}
+
+func (s *StorageFile) GetCampaigns(userID string) ([]Campaign, error) {
+	return s.memory.GetCampaigns(userID)
+}
+
+func (s *StorageFile) UpdateCampaign(campaign Campaign) error {
+	return s.memory.UpdateCampaign(campaign)
+}
+
+func (s *StorageFile) DeleteCampaign(id string) error {
+	return s.memory.DeleteCampaign(id)
+}
+
+func (s *StorageFile) SetCampaignLinks(id string, linkIDs []string) error {
+	return s.memory.SetCampaignLinks(id, linkIDs)
+}
+
+func (s *StorageMemory) PutCampaign(campaign Campaign) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, v := range s.campaigns {
+		if v.ID == campaign.ID {
+			return fmt.Errorf("campaign %s already exists", campaign.ID)
+		}
+	}
+
+	campaign.Links = nil
+	s.campaigns = append(s.campaigns, campaign)
+	return nil
+}
+
+func (s *StorageMemory) GetCampaign(id string) (Campaign, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, v := range s.campaigns {
+		if v.ID == id {
+			v.Links = s.campaignLinks(id)
+			return v, nil
+		}
+	}
+
+	return Campaign{}, apiError.ErrCampaignNotFound
+}
+
+func (s *StorageMemory) GetCampaigns(userID string) ([]Campaign, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	campaigns := make([]Campaign, 0)
+	for _, v := range s.campaigns {
+		if v.UserID == userID {
+			v.Links = s.campaignLinks(v.ID)
+			campaigns = append(campaigns, v)
+		}
+	}
+
+	return campaigns, nil
+}
+
+func (s *StorageMemory) UpdateCampaign(campaign Campaign) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, v := range s.campaigns {
+		if v.ID == campaign.ID {
+			campaign.Links = nil
+			s.campaigns[i] = campaign
+			return nil
+		}
+	}
+
+	return apiError.ErrCampaignNotFound
+}
+
+// DeleteCampaign removes the campaign, its links stay without a campaign.
+func (s *StorageMemory) DeleteCampaign(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, v := range s.campaigns {
+		if v.ID == id {
+			s.campaigns = append(s.campaigns[:i:i], s.campaigns[i+1:]...)
+			s.setCampaignLinks(id, nil)
+			return nil
+		}
+	}
+
+	return apiError.ErrCampaignNotFound
+}
+
+// SetCampaignLinks makes linkIDs the members of the campaign. Links leave
+// their previous campaign, former members not in linkIDs leave this one.
+func (s *StorageMemory) SetCampaignLinks(id string, linkIDs []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, v := range s.campaigns {
+		if v.ID == id {
+			s.setCampaignLinks(id, linkIDs)
+			return nil
+		}
+	}
+
+	return apiError.ErrCampaignNotFound
+}
+
+// setCampaignLinks must be called with the write lock held.
+func (s *StorageMemory) setCampaignLinks(id string, linkIDs []string) {
+	members := make(map[string]bool, len(linkIDs))
+	for _, linkID := range linkIDs {
+		members[linkID] = true
+	}
+
+	for i, v := range s.links {
+		if members[v.ID] {
+			s.links[i].CampaignID = id
+		} else if v.CampaignID == id {
+			s.links[i].CampaignID = ""
+		}
+	}
+}
+
+// campaignLinks must be called with the lock held.
+func (s *StorageMemory) campaignLinks(id string) []string {
+	var links []string
+	for _, v := range s.links {
+		if v.CampaignID == id {
+			links = append(links, v.ID)
+		}
+	}
+	sort.Strings(links)
+	return links
+}
+
+func (s *StorageDB) PutCampaign(campaign Campaign) error {
+	params, err := marshalColumn(campaign.Params)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.Exec(
+		"INSERT INTO campaigns (code, user_id, name, description, params) VALUES ($1, $2, $3, $4, $5)",
+		campaign.ID, campaign.UserID, campaign.Name, campaign.Description, params,
+	)
+	if err != nil {
+		return fmt.Errorf("insert campaign: %s", err.Error())
+	}
+
+	return nil
+}
+
+func (s *StorageDB) GetCampaign(id string) (Campaign, error) {
+	row := s.db.QueryRow("SELECT code, user_id, name, description, params FROM campaigns WHERE code=$1", id)
+	campaign, err := scanCampaign(row)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Campaign{}, apiError.ErrCampaignNotFound
+		}
+		return Campaign{}, fmt.Errorf("get campaign: %s", err.Error())
+	}
+
+	if campaign.Links, err = s.campaignLinks(id); err != nil {
+		return Campaign{}, err
+	}
+
+	return campaign, nil
+}
+
+func (s *StorageDB) GetCampaigns(userID string) ([]Campaign, error) {
+	rows, err := s.db.Query("SELECT code, user_id, name, description, params FROM campaigns WHERE user_id=$1 ORDER BY code", userID)
+	if err != nil {
+		return nil, fmt.Errorf("get campaigns: %s", err.Error())
+	}
+	defer rows.Close()
+
+	campaigns := make([]Campaign, 0)
+	for rows.Next() {
+		campaign, err := scanCampaign(rows)
+		if err != nil {
+			return nil, fmt.Errorf("row scan: %s", err.Error())
+		}
+		campaigns = append(campaigns, campaign)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("row scan: %s", err.Error())
+	}
+
+	for i := range campaigns {
+		if campaigns[i].Links, err = s.campaignLinks(campaigns[i].ID); err != nil {
+			return nil, err
+		}
+	}
+
+	return campaigns, nil
+}
+
+func (s *StorageDB) UpdateCampaign(campaign Campaign) error {
+	params, err := marshalColumn(campaign.Params)
+	if err != nil {
+		return err
+	}
+
+	result, err := s.db.Exec(
+		"UPDATE campaigns SET name=$2, description=$3, params=$4 WHERE code=$1",
+		campaign.ID, campaign.Name, campaign.Description, params,
+	)
+	if err != nil {
+		return fmt.Errorf("update campaign: %s", err.Error())
+	}
+
+	return expectAffected(result, apiError.ErrCampaignNotFound)
+}
+
+func (s *StorageDB) DeleteCampaign(id string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("start transaction, %s", err.Error())
+	}
+
+	defer tx.Rollback()
+
+	result, err := tx.Exec("DELETE FROM campaigns WHERE code=$1", id)
+	if err != nil {
+		return fmt.Errorf("delete campaign: %s", err.Error())
+	}
+	if err = expectAffected(result, apiError.ErrCampaignNotFound); err != nil {
+		return err
+	}
+
+	if _, err = tx.Exec("UPDATE links SET campaign_id='' WHERE campaign_id=$1", id); err != nil {
+		return fmt.Errorf("clear campaign links: %s", err.Error())
+	}
+
+	return tx.Commit()
+}
+
+func (s *StorageDB) SetCampaignLinks(id string, linkIDs []string) error {
+	// A nil slice is sent as NULL, and nothing is unequal to NULL.
+	if linkIDs == nil {
+		linkIDs = []string{}
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("start transaction, %s", err.Error())
+	}
+
+	defer tx.Rollback()
+
+	// Locking the campaign keeps DeleteCampaign from running in between.
+	var code string
+	if err = tx.QueryRow("SELECT code FROM campaigns WHERE code=$1 FOR UPDATE", id).Scan(&code); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return apiError.ErrCampaignNotFound
+		}
+		return fmt.Errorf("get campaign: %s", err.Error())
+	}
+
+	if _, err = tx.Exec(
+		"UPDATE links SET campaign_id='' WHERE campaign_id=$1 AND NOT hash_url = ANY($2)",
+		id, pq.Array(linkIDs),
+	); err != nil {
+		return fmt.Errorf("clear campaign links: %s", err.Error())
+	}
+
+	if _, err = tx.Exec("UPDATE links SET campaign_id=$1 WHERE hash_url = ANY($2)", id, pq.Array(linkIDs)); err != nil {
+		return fmt.Errorf("set campaign links: %s", err.Error())
+	}
+
+	return tx.Commit()
+}
+
+func (s *StorageDB) campaignLinks(id string) ([]string, error) {
+	rows, err := s.db.Query("SELECT hash_url FROM links WHERE campaign_id=$1 ORDER BY hash_url", id)
+	if err != nil {
+		return nil, fmt.Errorf("get campaign links: %s", err.Error())
+	}
+	defer rows.Close()
+
+	var links []string
+	for rows.Next() {
+		var link string
+		if err = rows.Scan(&link); err != nil {
+			return nil, fmt.Errorf("row scan: %s", err.Error())
+		}
+		links = append(links, link)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("row scan: %s", err.Error())
+	}
+
+	return links, nil
+}
+
+func scanCampaign(row rowScanner) (Campaign, error) {
+	var campaign Campaign
+	var params string
+	err := row.Scan(&campaign.ID, &campaign.UserID, &campaign.Name, &campaign.Description, &params)
+	if err != nil {
+		return campaign, err
+	}
+
+	if err = unmarshalColumn(params, &campaign.Params); err != nil {
+		return campaign, err
+	}
+
+	return campaign, nil
+}
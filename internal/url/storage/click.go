@@ -0,0 +1,294 @@
+package storage
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// clickPageSize is how many clicks EachClick of the memory storage scans
+// per lock.
+const clickPageSize = 1024
+
+// ClickEvent is one redirect served by GetURL. The client address is only
+// kept as a salted hash, see the privacy package.
+type ClickEvent struct {
+	Time      time.Time `json:"time"`
+	LinkID    string    `json:"link_id"`
+	Referrer  string    `json:"referrer,omitempty"`
+	UserAgent string    `json:"user_agent,omitempty"`
+	IPHash    string    `json:"ip_hash,omitempty"`
+	Country   string    `json:"country,omitempty"`
+	Device    string    `json:"device,omitempty"`
+	Browser   string    `json:"browser,omitempty"`
+	OS        string    `json:"os,omitempty"`
+	// Language is the tag of the language variant the redirect went to,
+	// empty when no variant matched.
+	Language string `json:"language,omitempty"`
+	// Bot marks clicks by crawlers and scripts, stats leave them out unless
+	// asked to include them.
+	Bot bool `json:"bot,omitempty"`
+}
+
+func (s *StorageFile) SaveClicks(ctx context.Context, clicks []ClickEvent) error {
+	return s.memory.SaveClicks(ctx, clicks)
+}
+
+func (s *StorageFile) GetClicks(ctx context.Context, linkID string, from, to time.Time) ([]ClickEvent, error) {
+	return s.memory.GetClicks(ctx, linkID, from, to)
+}
+
+func (s *StorageFile) EachClick(ctx context.Context, linkIDs []string, from, to time.Time, fn func(ClickEvent) error) error {
+	return s.memory.EachClick(ctx, linkIDs, from, to, fn)
+}
+
+func (s *StorageMemory) SaveClicks(ctx context.Context, clicks []ClickEvent) error {
+	clicks = scrubClicks(clicks)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.clicks = insertClicks(s.clicks, clicks)
+	s.addLateClicks(clicks)
+	return s.mergeSketches(clicks)
+}
+
+// GetClicks returns the clicks of a link in [from, to) ordered by time.
+func (s *StorageMemory) GetClicks(ctx context.Context, linkID string, from, to time.Time) ([]ClickEvent, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var clicks []ClickEvent
+	for _, v := range s.clicks {
+		if v.LinkID == linkID && !v.Time.Before(from) && v.Time.Before(to) {
+			clicks = append(clicks, v)
+		}
+	}
+
+	return clicks, nil
+}
+
+// EachClick calls fn for the clicks of linkIDs in [from, to) ordered by
+// time. The lock is only held while a page of clicks is copied, so fn may
+// be slow without holding up SaveClicks.
+func (s *StorageMemory) EachClick(ctx context.Context, linkIDs []string, from, to time.Time, fn func(ClickEvent) error) error {
+	links := make(map[string]bool, len(linkIDs))
+	for _, id := range linkIDs {
+		links[id] = true
+	}
+
+	cursor, skip := from, 0
+	for {
+		page, done := s.clickPage(links, &cursor, &skip, to)
+		for _, v := range page {
+			if err := fn(v); err != nil {
+				return err
+			}
+		}
+		if done {
+			return nil
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+	}
+}
+
+// clickPage scans up to clickPageSize clicks starting at the skip-th click
+// at cursor and moves the cursor past them. Clicks are sorted by time, so the
+// cursor stays valid when clicks are added or deleted in between.
+func (s *StorageMemory) clickPage(links map[string]bool, cursor *time.Time, skip *int, to time.Time) ([]ClickEvent, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	start := s.searchClicks(*cursor) + *skip
+	end := start + clickPageSize
+	if end >= len(s.clicks) {
+		end = len(s.clicks)
+	}
+
+	var page []ClickEvent
+	for i := start; i < end; i++ {
+		v := s.clicks[i]
+		if !v.Time.Before(to) {
+			return page, true
+		}
+		if links[v.LinkID] {
+			page = append(page, v)
+		}
+	}
+
+	if end == len(s.clicks) {
+		return page, true
+	}
+
+	*cursor = s.clicks[end-1].Time
+	*skip = end - s.searchClicks(*cursor)
+	return page, false
+}
+
+// searchClicks returns the index of the first click not before t.
+func (s *StorageMemory) searchClicks(t time.Time) int {
+	return sort.Search(len(s.clicks), func(i int) bool {
+		return !s.clicks[i].Time.Before(t)
+	})
+}
+
+// insertClicks merges clicks into the time ordered slice sorted. Clicks of a
+// batch are nearly always newer than the stored ones, so only a short tail
+// is merged.
+func insertClicks(sorted, clicks []ClickEvent) []ClickEvent {
+	if len(clicks) == 0 {
+		return sorted
+	}
+
+	clicks = append([]ClickEvent(nil), clicks...)
+	sortClicks(clicks)
+
+	pos := sort.Search(len(sorted), func(i int) bool {
+		return clicks[0].Time.Before(sorted[i].Time)
+	})
+	tail := append([]ClickEvent(nil), sorted[pos:]...)
+
+	merged := sorted[:pos]
+	i, j := 0, 0
+	for i < len(tail) || j < len(clicks) {
+		if j == len(clicks) || (i < len(tail) && !clicks[j].Time.Before(tail[i].Time)) {
+			merged = append(merged, tail[i])
+			i++
+		} else {
+			merged = append(merged, clicks[j])
+			j++
+		}
+	}
+
+	return merged
+}
+
+func sortClicks(clicks []ClickEvent) {
+	sort.SliceStable(clicks, func(i, j int) bool {
+		return clicks[i].Time.Before(clicks[j].Time)
+	})
+}
+
+func (s *StorageDB) SaveClicks(ctx context.Context, clicks []ClickEvent) error {
+	clicks = scrubClicks(clicks)
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("start transaction, %s", err.Error())
+	}
+
+	defer tx.Rollback()
+
+	stmt, err := tx.PrepareContext(ctx, "INSERT INTO clicks (link_id, clicked_at, referrer, user_agent, ip_hash, country, device, browser, os, bot, language) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)")
+	if err != nil {
+		return fmt.Errorf("prepare statement, %s", err.Error())
+	}
+
+	defer stmt.Close()
+
+	for _, v := range clicks {
+		if _, err := stmt.ExecContext(ctx, v.LinkID, v.Time, v.Referrer, v.UserAgent, v.IPHash, v.Country, v.Device, v.Browser, v.OS, v.Bot, v.Language); err != nil {
+			return fmt.Errorf("statement exec, %s", err.Error())
+		}
+	}
+
+	if err = s.addLateClicks(ctx, tx, clicks); err != nil {
+		return err
+	}
+
+	if err = s.mergeSketches(ctx, tx, clicks); err != nil {
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("commit, %s", err.Error())
+	}
+
+	return nil
+}
+
+func (s *StorageDB) GetClicks(ctx context.Context, linkID string, from, to time.Time) ([]ClickEvent, error) {
+	rows, err := s.db.QueryContext(ctx,
+		"SELECT link_id, clicked_at, referrer, user_agent, ip_hash, country, device, browser, os, bot, language FROM clicks WHERE link_id=$1 AND clicked_at >= $2 AND clicked_at < $3 ORDER BY clicked_at",
+		linkID, from, to,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("get clicks: %s", err.Error())
+	}
+	defer rows.Close()
+
+	var clicks []ClickEvent
+	for rows.Next() {
+		var v ClickEvent
+		if err = rows.Scan(&v.LinkID, &v.Time, &v.Referrer, &v.UserAgent, &v.IPHash, &v.Country, &v.Device, &v.Browser, &v.OS, &v.Bot, &v.Language); err != nil {
+			return nil, fmt.Errorf("row scan: %s", err.Error())
+		}
+		clicks = append(clicks, v)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("row scan: %s", err.Error())
+	}
+
+	return clicks, nil
+}
+
+// EachClick streams the rows instead of collecting them, an export of any
+// size runs in constant memory.
+func (s *StorageDB) EachClick(ctx context.Context, linkIDs []string, from, to time.Time, fn func(ClickEvent) error) error {
+	rows, err := s.db.QueryContext(ctx,
+		"SELECT link_id, clicked_at, referrer, user_agent, ip_hash, country, device, browser, os, bot, language FROM clicks WHERE link_id = ANY($1) AND clicked_at >= $2 AND clicked_at < $3 ORDER BY clicked_at",
+		pq.Array(linkIDs), from, to,
+	)
+	if err != nil {
+		return fmt.Errorf("get clicks: %s", err.Error())
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var v ClickEvent
+		if err = rows.Scan(&v.LinkID, &v.Time, &v.Referrer, &v.UserAgent, &v.IPHash, &v.Country, &v.Device, &v.Browser, &v.OS, &v.Bot, &v.Language); err != nil {
+			return fmt.Errorf("row scan: %s", err.Error())
+		}
+		if err = fn(v); err != nil {
+			return err
+		}
+	}
+
+	if err = rows.Err(); err != nil {
+		return fmt.Errorf("row scan: %s", err.Error())
+	}
+
+	return nil
+}
+
+// scrubClicks drops every IPHash that is not a SHA-256 hash, so no backend
+// ever stores a client address even if a caller forgot to hash it.
+func scrubClicks(clicks []ClickEvent) []ClickEvent {
+	var scrubbed []ClickEvent
+	for i, v := range clicks {
+		if v.IPHash == "" || isHash(v.IPHash) {
+			continue
+		}
+		if scrubbed == nil {
+			scrubbed = append([]ClickEvent(nil), clicks...)
+		}
+		scrubbed[i].IPHash = ""
+	}
+
+	if scrubbed == nil {
+		return clicks
+	}
+	return scrubbed
+}
+
+func isHash(value string) bool {
+	decoded, err := hex.DecodeString(value)
+	return err == nil && len(decoded) == 32
+}
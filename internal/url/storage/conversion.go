@@ -0,0 +1,143 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+)
+
+const (
+	// ClickIDQuery appends the click ID to the destination URL, for landing
+	// pages on other domains.
+	ClickIDQuery = "query"
+	// ClickIDCookie sets the click ID as the click_id cookie of the short
+	// link domain, where the conversion pixel reads it.
+	ClickIDCookie = "cookie"
+
+	ConversionPixel    = "pixel"
+	ConversionPostback = "postback"
+)
+
+// ConversionTracking issues a click ID on every redirect of a link. Param
+// names the query parameter the ID is appended as.
+type ConversionTracking struct {
+	Mode  string `json:"mode"`
+	Param string `json:"param,omitempty"`
+}
+
+// Conversion is a sign-up or sale reported for a click ID. It is counted
+// on the day of the click, so conversion rates compare the same clicks.
+type Conversion struct {
+	ClickID     string    `json:"click_id"`
+	LinkID      string    `json:"link_id"`
+	ClickedAt   time.Time `json:"clicked_at"`
+	ConvertedAt time.Time `json:"converted_at"`
+	Source      string    `json:"source"`
+}
+
+// ConversionCount is the number of converted clicks of a link made on the
+// UTC day Day.
+type ConversionCount struct {
+	Day         time.Time `json:"day"`
+	Conversions int64     `json:"conversions"`
+}
+
+func (s *StorageFile) SaveConversion(ctx context.Context, conversion Conversion) (bool, error) {
+	return s.memory.SaveConversion(ctx, conversion)
+}
+
+func (s *StorageFile) GetConversionCounts(ctx context.Context, linkID string, from, to time.Time) ([]ConversionCount, error) {
+	return s.memory.GetConversionCounts(ctx, linkID, from, to)
+}
+
+// SaveConversion records the conversion unless its click converted before,
+// it reports whether the conversion was new.
+func (s *StorageMemory) SaveConversion(ctx context.Context, conversion Conversion) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.converted[conversion.ClickID] {
+		return false, nil
+	}
+
+	s.converted[conversion.ClickID] = true
+	s.conversions = append(s.conversions, conversion)
+	return true, nil
+}
+
+// GetConversionCounts counts the conversions of clicks in [from, to) by
+// day of the click, ordered by day.
+func (s *StorageMemory) GetConversionCounts(ctx context.Context, linkID string, from, to time.Time) ([]ConversionCount, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	days := make(map[int64]int64)
+	for _, v := range s.conversions {
+		if v.LinkID == linkID && !v.ClickedAt.Before(from) && v.ClickedAt.Before(to) {
+			days[SketchDay(v.ClickedAt).Unix()]++
+		}
+	}
+
+	counts := make([]ConversionCount, 0, len(days))
+	for day, conversions := range days {
+		counts = append(counts, ConversionCount{Day: time.Unix(day, 0).UTC(), Conversions: conversions})
+	}
+	sort.Slice(counts, func(i, j int) bool {
+		return counts[i].Day.Before(counts[j].Day)
+	})
+
+	return counts, nil
+}
+
+func (s *StorageMemory) loadConversions(conversions []Conversion) {
+	s.conversions = conversions
+	for _, v := range conversions {
+		s.converted[v.ClickID] = true
+	}
+}
+
+func (s *StorageDB) SaveConversion(ctx context.Context, conversion Conversion) (bool, error) {
+	result, err := s.db.ExecContext(ctx,
+		"INSERT INTO conversions (click_id, link_id, clicked_at, converted_at, source) VALUES ($1, $2, $3, $4, $5) ON CONFLICT DO NOTHING",
+		conversion.ClickID, conversion.LinkID, conversion.ClickedAt, conversion.ConvertedAt, conversion.Source,
+	)
+	if err != nil {
+		return false, fmt.Errorf("insert conversion: %s", err.Error())
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("rows affected: %s", err.Error())
+	}
+
+	return affected == 1, nil
+}
+
+func (s *StorageDB) GetConversionCounts(ctx context.Context, linkID string, from, to time.Time) ([]ConversionCount, error) {
+	rows, err := s.db.QueryContext(ctx,
+		"SELECT date_trunc('day', clicked_at AT TIME ZONE 'UTC') AS day, count(*) FROM conversions WHERE link_id=$1 AND clicked_at >= $2 AND clicked_at < $3 GROUP BY day ORDER BY day",
+		linkID, from, to,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("get conversions: %s", err.Error())
+	}
+	defer rows.Close()
+
+	counts := make([]ConversionCount, 0)
+	for rows.Next() {
+		var v ConversionCount
+		if err = rows.Scan(&v.Day, &v.Conversions); err != nil {
+			return nil, fmt.Errorf("row scan: %s", err.Error())
+		}
+		// The day is a timestamp without time zone in UTC.
+		v.Day = time.Date(v.Day.Year(), v.Day.Month(), v.Day.Day(), 0, 0, 0, 0, time.UTC)
+		counts = append(counts, v)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("row scan: %s", err.Error())
+	}
+
+	return counts, nil
+}
@@ -0,0 +1,542 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/url"
+	"sort"
+	"time"
+)
+
+const (
+	PeriodHour = "hour"
+	PeriodDay  = "day"
+)
+
+// DirectReferrer names clicks that came without a Referer header.
+const DirectReferrer = "(direct)"
+
+// ClickCount is the number of clicks of a link in one hour or day that share
+// the same classification. Rollups store raw clicks as hourly and daily
+// counts, so statistics survive the deletion of old clicks.
+type ClickCount struct {
+	LinkID   string    `json:"link_id"`
+	Start    time.Time `json:"start"`
+	Referrer string    `json:"referrer,omitempty"`
+	Country  string    `json:"country,omitempty"`
+	Device   string    `json:"device,omitempty"`
+	Browser  string    `json:"browser,omitempty"`
+	OS       string    `json:"os,omitempty"`
+	Bot      bool      `json:"bot,omitempty"`
+	Clicks   int64     `json:"clicks"`
+}
+
+type countKey struct {
+	linkID   string
+	start    int64
+	referrer string
+	country  string
+	device   string
+	browser  string
+	os       string
+	bot      bool
+}
+
+func (c ClickCount) key() countKey {
+	return countKey{
+		linkID:   c.LinkID,
+		start:    c.Start.Unix(),
+		referrer: c.Referrer,
+		country:  c.Country,
+		device:   c.Device,
+		browser:  c.Browser,
+		os:       c.OS,
+		bot:      c.Bot,
+	}
+}
+
+func (k countKey) count(clicks int64) ClickCount {
+	return ClickCount{
+		LinkID:   k.linkID,
+		Start:    time.Unix(k.start, 0).UTC(),
+		Referrer: k.referrer,
+		Country:  k.country,
+		Device:   k.device,
+		Browser:  k.browser,
+		OS:       k.os,
+		Bot:      k.bot,
+		Clicks:   clicks,
+	}
+}
+
+// PeriodStart returns the start of the UTC hour or day of t.
+func PeriodStart(t time.Time, period string) time.Time {
+	t = t.UTC()
+	if period == PeriodDay {
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	}
+	return t.Truncate(time.Hour)
+}
+
+// ReferrerHost groups referrers by site, full referrer URLs are too
+// scattered to be useful in statistics.
+func ReferrerHost(referrer string) string {
+	if referrer == "" {
+		return DirectReferrer
+	}
+
+	u, err := url.Parse(referrer)
+	if err != nil || u.Host == "" {
+		return referrer
+	}
+
+	return u.Host
+}
+
+// CountClicks groups clicks by period the way rollups store them.
+func CountClicks(clicks []ClickEvent, period string) []ClickCount {
+	counts := make(map[countKey]int64)
+	addClicks(counts, clicks, period)
+	return countsList(counts, "", time.Time{}, time.Time{})
+}
+
+func addClicks(counts map[countKey]int64, clicks []ClickEvent, period string) {
+	for _, v := range clicks {
+		key := ClickCount{
+			LinkID:   v.LinkID,
+			Start:    PeriodStart(v.Time, period),
+			Referrer: ReferrerHost(v.Referrer),
+			Country:  v.Country,
+			Device:   v.Device,
+			Browser:  v.Browser,
+			OS:       v.OS,
+			Bot:      v.Bot,
+		}.key()
+		counts[key]++
+	}
+}
+
+// countsList returns the counts of linkID starting in [from, to) ordered by
+// start, an empty linkID and zero times select everything.
+func countsList(counts map[countKey]int64, linkID string, from, to time.Time) []ClickCount {
+	var result []ClickCount
+	for key, clicks := range counts {
+		if linkID != "" && key.linkID != linkID {
+			continue
+		}
+		if !from.IsZero() && (key.start < from.Unix() || key.start >= to.Unix()) {
+			continue
+		}
+		result = append(result, key.count(clicks))
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].key().less(result[j].key())
+	})
+
+	return result
+}
+
+func (k countKey) less(other countKey) bool {
+	switch {
+	case k.start != other.start:
+		return k.start < other.start
+	case k.linkID != other.linkID:
+		return k.linkID < other.linkID
+	case k.bot != other.bot:
+		return !k.bot
+	case k.referrer != other.referrer:
+		return k.referrer < other.referrer
+	case k.country != other.country:
+		return k.country < other.country
+	case k.device != other.device:
+		return k.device < other.device
+	case k.browser != other.browser:
+		return k.browser < other.browser
+	}
+	return k.os < other.os
+}
+
+// countRanges splits [from, to) into the parts read from daily counts,
+// hourly counts and raw clicks. Everything before the watermark has been
+// rolled up, raw clicks are only read after it. Daily counts are used for
+// whole days when the caller only needs daily resolution.
+type countRanges struct {
+	dailyFrom, dailyTo   time.Time
+	hourlyFrom, hourlyTo time.Time
+	rawFrom, rawTo       time.Time
+}
+
+func splitCountRange(from, to, watermark time.Time, period string) countRanges {
+	var r countRanges
+
+	rolled := to
+	if watermark.Before(to) {
+		rolled = watermark
+	}
+
+	r.dailyFrom, r.dailyTo = from, from
+	if period == PeriodDay && PeriodStart(from, PeriodDay).Equal(from) {
+		if end := PeriodStart(rolled, PeriodDay); end.After(from) {
+			r.dailyTo = end
+		}
+	}
+
+	r.hourlyFrom, r.hourlyTo = r.dailyTo, r.dailyTo
+	if rolled.After(r.dailyTo) {
+		r.hourlyTo = rolled
+	}
+
+	r.rawFrom, r.rawTo = r.hourlyTo, to
+	if r.rawFrom.Before(from) {
+		r.rawFrom = from
+	}
+
+	return r
+}
+
+func (s *StorageFile) Rollup(ctx context.Context, until time.Time) (int64, error) {
+	return s.memory.Rollup(ctx, until)
+}
+
+func (s *StorageFile) DeleteClicks(ctx context.Context, before time.Time) (int64, error) {
+	return s.memory.DeleteClicks(ctx, before)
+}
+
+func (s *StorageFile) GetClickCounts(ctx context.Context, linkID string, from, to time.Time, period string) ([]ClickCount, error) {
+	return s.memory.GetClickCounts(ctx, linkID, from, to, period)
+}
+
+// Rollup adds the raw clicks of complete hours before until to the hourly
+// and daily counts and moves the watermark past them.
+func (s *StorageMemory) Rollup(ctx context.Context, until time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	until = PeriodStart(until, PeriodHour)
+	if !s.watermark.Before(until) {
+		return 0, nil
+	}
+
+	var clicks []ClickEvent
+	for _, v := range s.clicks {
+		if !v.Time.Before(s.watermark) && v.Time.Before(until) {
+			clicks = append(clicks, v)
+		}
+	}
+
+	addClicks(s.hourly, clicks, PeriodHour)
+	addClicks(s.daily, clicks, PeriodDay)
+	s.watermark = until
+
+	return int64(len(clicks)), nil
+}
+
+// DeleteClicks removes raw clicks before the retention cutoff, clicks that
+// have not been rolled up yet are kept.
+func (s *StorageMemory) DeleteClicks(ctx context.Context, before time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.watermark.Before(before) {
+		before = s.watermark
+	}
+
+	kept := make([]ClickEvent, 0, len(s.clicks))
+	for _, v := range s.clicks {
+		if !v.Time.Before(before) {
+			kept = append(kept, v)
+		}
+	}
+
+	deleted := int64(len(s.clicks) - len(kept))
+	s.clicks = kept
+
+	return deleted, nil
+}
+
+// GetClickCounts returns the clicks of a link in [from, to) grouped by hour,
+// or by day where period allows it.
+func (s *StorageMemory) GetClickCounts(ctx context.Context, linkID string, from, to time.Time, period string) ([]ClickCount, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	r := splitCountRange(from, to, s.watermark, period)
+
+	var raw []ClickEvent
+	for _, v := range s.clicks {
+		if v.LinkID == linkID && !v.Time.Before(r.rawFrom) && v.Time.Before(r.rawTo) {
+			raw = append(raw, v)
+		}
+	}
+
+	var result []ClickCount
+	if r.dailyFrom.Before(r.dailyTo) {
+		result = append(result, countsList(s.daily, linkID, r.dailyFrom, r.dailyTo)...)
+	}
+	if r.hourlyFrom.Before(r.hourlyTo) {
+		result = append(result, countsList(s.hourly, linkID, r.hourlyFrom, r.hourlyTo)...)
+	}
+	return append(result, CountClicks(raw, PeriodHour)...), nil
+}
+
+// addLateClicks must be called with the write lock held. Clicks saved after
+// their hour was rolled up go straight into the counts.
+func (s *StorageMemory) addLateClicks(clicks []ClickEvent) {
+	var late []ClickEvent
+	for _, v := range clicks {
+		if v.Time.Before(s.watermark) {
+			late = append(late, v)
+		}
+	}
+
+	addClicks(s.hourly, late, PeriodHour)
+	addClicks(s.daily, late, PeriodDay)
+}
+
+func loadCounts(counts []ClickCount) map[countKey]int64 {
+	result := make(map[countKey]int64, len(counts))
+	for _, v := range counts {
+		result[v.key()] += v.Clicks
+	}
+	return result
+}
+
+const countColumns = "link_id, period_start, referrer, country, device, browser, os, bot, clicks"
+
+// Rollup works through the raw clicks one hour per transaction. The
+// watermark moves in the same transaction as the counts, so a crashed rollup
+// resumes where it stopped and never counts an hour twice.
+func (s *StorageDB) Rollup(ctx context.Context, until time.Time) (int64, error) {
+	until = PeriodStart(until, PeriodHour)
+
+	var total int64
+	for {
+		rolled, done, err := s.rollupHour(ctx, until)
+		if err != nil {
+			return total, err
+		}
+		total += rolled
+		if done {
+			return total, nil
+		}
+	}
+}
+
+func (s *StorageDB) rollupHour(ctx context.Context, until time.Time) (int64, bool, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, false, fmt.Errorf("start transaction, %s", err.Error())
+	}
+
+	defer tx.Rollback()
+
+	// The row lock also keeps SaveClicks from adding late clicks while the
+	// hour is counted.
+	var watermark sql.NullTime
+	if err = tx.QueryRowContext(ctx, "SELECT watermark FROM click_rollup WHERE id=1 FOR UPDATE").Scan(&watermark); err != nil {
+		return 0, false, fmt.Errorf("select watermark: %s", err.Error())
+	}
+	if watermark.Valid && !watermark.Time.Before(until) {
+		return 0, true, nil
+	}
+
+	// Hours without clicks are skipped in one step.
+	var first sql.NullTime
+	if err = tx.QueryRowContext(ctx,
+		"SELECT min(clicked_at) FROM clicks WHERE clicked_at >= $1 AND clicked_at < $2",
+		watermark.Time, until,
+	).Scan(&first); err != nil {
+		return 0, false, fmt.Errorf("select first click: %s", err.Error())
+	}
+
+	end := until
+	if first.Valid {
+		end = PeriodStart(first.Time, PeriodHour).Add(time.Hour)
+	}
+
+	rows, err := tx.QueryContext(ctx,
+		"SELECT link_id, clicked_at, referrer, country, device, browser, os, bot FROM clicks WHERE clicked_at >= $1 AND clicked_at < $2",
+		watermark.Time, end,
+	)
+	if err != nil {
+		return 0, false, fmt.Errorf("select clicks: %s", err.Error())
+	}
+
+	var clicks []ClickEvent
+	for rows.Next() {
+		var v ClickEvent
+		if err = rows.Scan(&v.LinkID, &v.Time, &v.Referrer, &v.Country, &v.Device, &v.Browser, &v.OS, &v.Bot); err != nil {
+			rows.Close()
+			return 0, false, fmt.Errorf("row scan: %s", err.Error())
+		}
+		clicks = append(clicks, v)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, false, fmt.Errorf("row scan: %s", err.Error())
+	}
+
+	if err = addCounts(ctx, tx, clicks); err != nil {
+		return 0, false, err
+	}
+
+	if _, err = tx.ExecContext(ctx, "UPDATE click_rollup SET watermark=$1 WHERE id=1", end); err != nil {
+		return 0, false, fmt.Errorf("update watermark: %s", err.Error())
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, false, fmt.Errorf("commit, %s", err.Error())
+	}
+
+	return int64(len(clicks)), !end.Before(until), nil
+}
+
+func addCounts(ctx context.Context, tx *sql.Tx, clicks []ClickEvent) error {
+	if len(clicks) == 0 {
+		return nil
+	}
+
+	for _, table := range []struct{ name, period string }{{"click_hourly", PeriodHour}, {"click_daily", PeriodDay}} {
+		stmt, err := tx.PrepareContext(ctx, fmt.Sprintf(
+			"INSERT INTO %[1]s (%[2]s) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9) "+
+				"ON CONFLICT (link_id, period_start, referrer, country, device, browser, os, bot) DO UPDATE SET clicks = %[1]s.clicks + EXCLUDED.clicks",
+			table.name, countColumns,
+		))
+		if err != nil {
+			return fmt.Errorf("prepare statement, %s", err.Error())
+		}
+
+		for _, v := range CountClicks(clicks, table.period) {
+			if _, err = stmt.ExecContext(ctx, v.LinkID, v.Start, v.Referrer, v.Country, v.Device, v.Browser, v.OS, v.Bot, v.Clicks); err != nil {
+				stmt.Close()
+				return fmt.Errorf("statement exec, %s", err.Error())
+			}
+		}
+		stmt.Close()
+	}
+
+	return nil
+}
+
+// addLateClicks counts clicks saved after their hour was rolled up. It
+// holds a share lock on the watermark until the transaction ends.
+func (s *StorageDB) addLateClicks(ctx context.Context, tx *sql.Tx, clicks []ClickEvent) error {
+	var watermark sql.NullTime
+	if err := tx.QueryRowContext(ctx, "SELECT watermark FROM click_rollup WHERE id=1 FOR SHARE").Scan(&watermark); err != nil {
+		return fmt.Errorf("select watermark: %s", err.Error())
+	}
+	if !watermark.Valid {
+		return nil
+	}
+
+	var late []ClickEvent
+	for _, v := range clicks {
+		if v.Time.Before(watermark.Time) {
+			late = append(late, v)
+		}
+	}
+
+	return addCounts(ctx, tx, late)
+}
+
+func (s *StorageDB) DeleteClicks(ctx context.Context, before time.Time) (int64, error) {
+	result, err := s.db.ExecContext(ctx,
+		"DELETE FROM clicks WHERE clicked_at < $1 AND clicked_at < (SELECT watermark FROM click_rollup WHERE id=1)",
+		before,
+	)
+	if err != nil {
+		return 0, fmt.Errorf("delete clicks: %s", err.Error())
+	}
+
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("delete clicks: %s", err.Error())
+	}
+
+	return deleted, nil
+}
+
+// GetClickCounts reads the watermark and all three sources in one snapshot.
+func (s *StorageDB) GetClickCounts(ctx context.Context, linkID string, from, to time.Time, period string) ([]ClickCount, error) {
+	tx, err := s.db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return nil, fmt.Errorf("start transaction, %s", err.Error())
+	}
+
+	defer tx.Rollback()
+
+	var watermark sql.NullTime
+	if err = tx.QueryRowContext(ctx, "SELECT watermark FROM click_rollup WHERE id=1").Scan(&watermark); err != nil {
+		return nil, fmt.Errorf("select watermark: %s", err.Error())
+	}
+
+	r := splitCountRange(from, to, watermark.Time, period)
+
+	var result []ClickCount
+	for _, part := range []struct {
+		table    string
+		from, to time.Time
+	}{{"click_daily", r.dailyFrom, r.dailyTo}, {"click_hourly", r.hourlyFrom, r.hourlyTo}} {
+		if !part.from.Before(part.to) {
+			continue
+		}
+		counts, err := queryCounts(ctx, tx, part.table, linkID, part.from, part.to)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, counts...)
+	}
+
+	rows, err := tx.QueryContext(ctx,
+		"SELECT link_id, clicked_at, referrer, country, device, browser, os, bot FROM clicks WHERE link_id=$1 AND clicked_at >= $2 AND clicked_at < $3",
+		linkID, r.rawFrom, r.rawTo,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("get clicks: %s", err.Error())
+	}
+	defer rows.Close()
+
+	var raw []ClickEvent
+	for rows.Next() {
+		var v ClickEvent
+		if err = rows.Scan(&v.LinkID, &v.Time, &v.Referrer, &v.Country, &v.Device, &v.Browser, &v.OS, &v.Bot); err != nil {
+			return nil, fmt.Errorf("row scan: %s", err.Error())
+		}
+		raw = append(raw, v)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("row scan: %s", err.Error())
+	}
+
+	return append(result, CountClicks(raw, PeriodHour)...), nil
+}
+
+func queryCounts(ctx context.Context, tx *sql.Tx, table, linkID string, from, to time.Time) ([]ClickCount, error) {
+	rows, err := tx.QueryContext(ctx,
+		fmt.Sprintf("SELECT %s FROM %s WHERE link_id=$1 AND period_start >= $2 AND period_start < $3 ORDER BY period_start", countColumns, table),
+		linkID, from, to,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("get %s: %s", table, err.Error())
+	}
+	defer rows.Close()
+
+	var counts []ClickCount
+	for rows.Next() {
+		var v ClickCount
+		if err = rows.Scan(&v.LinkID, &v.Start, &v.Referrer, &v.Country, &v.Device, &v.Browser, &v.OS, &v.Bot, &v.Clicks); err != nil {
+			return nil, fmt.Errorf("row scan: %s", err.Error())
+		}
+		v.Start = v.Start.UTC()
+		counts = append(counts, v)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("row scan: %s", err.Error())
+	}
+
+	return counts, nil
+}
@@ -0,0 +1,235 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/irootpro/shorturl/internal/url/hll"
+)
+
+// DailySketch counts the unique visitors of a link on one UTC day. Sketches
+// are kept up to date by SaveClicks, unique counts over longer ranges merge
+// them. Bot clicks are counted in separate sketches.
+type DailySketch struct {
+	LinkID string      `json:"link_id"`
+	Day    time.Time   `json:"day"`
+	Bots   bool        `json:"bots,omitempty"`
+	Sketch *hll.Sketch `json:"sketch"`
+}
+
+type sketchKey struct {
+	linkID string
+	day    int64
+	bots   bool
+}
+
+// VisitorID identifies the client of a click for unique counts, clicks
+// without a client address have none.
+func (e ClickEvent) VisitorID() string {
+	if e.IPHash == "" {
+		return ""
+	}
+	return e.IPHash + "|" + e.UserAgent
+}
+
+// SketchDay returns the start of the UTC day sketches of t are kept under.
+func SketchDay(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+// sketchClicks builds a sketch per link and day from clicks, the keys are
+// sorted so database rows are always locked in the same order.
+func sketchClicks(clicks []ClickEvent) ([]sketchKey, map[sketchKey]*hll.Sketch) {
+	sketches := make(map[sketchKey]*hll.Sketch)
+	var keys []sketchKey
+	for _, v := range clicks {
+		visitor := v.VisitorID()
+		if visitor == "" {
+			continue
+		}
+		key := sketchKey{linkID: v.LinkID, day: SketchDay(v.Time).Unix(), bots: v.Bot}
+		sketch, ok := sketches[key]
+		if !ok {
+			sketch = hll.New()
+			sketches[key] = sketch
+			keys = append(keys, key)
+		}
+		sketch.Add(visitor)
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].linkID != keys[j].linkID {
+			return keys[i].linkID < keys[j].linkID
+		}
+		if keys[i].day != keys[j].day {
+			return keys[i].day < keys[j].day
+		}
+		return !keys[i].bots && keys[j].bots
+	})
+
+	return keys, sketches
+}
+
+func (s *StorageFile) GetSketches(ctx context.Context, linkID string, from, to time.Time) ([]DailySketch, error) {
+	return s.memory.GetSketches(ctx, linkID, from, to)
+}
+
+// mergeSketches must be called with the write lock held. Sketches are kept
+// encoded, most of them are small in the sparse encoding.
+func (s *StorageMemory) mergeSketches(clicks []ClickEvent) error {
+	keys, sketches := sketchClicks(clicks)
+	for _, key := range keys {
+		sketch := sketches[key]
+		if data, ok := s.sketches[key]; ok {
+			previous := &hll.Sketch{}
+			if err := previous.UnmarshalBinary(data); err != nil {
+				return fmt.Errorf("decode sketch: %s", err.Error())
+			}
+			sketch.Merge(previous)
+		}
+
+		data, err := sketch.MarshalBinary()
+		if err != nil {
+			return fmt.Errorf("encode sketch: %s", err.Error())
+		}
+		s.sketches[key] = data
+	}
+
+	return nil
+}
+
+// GetSketches returns the sketches of the days overlapping [from, to).
+func (s *StorageMemory) GetSketches(ctx context.Context, linkID string, from, to time.Time) ([]DailySketch, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var result []DailySketch
+	for key, data := range s.sketches {
+		day := time.Unix(key.day, 0).UTC()
+		if key.linkID != linkID || day.Before(SketchDay(from)) || !day.Before(to) {
+			continue
+		}
+		sketch := &hll.Sketch{}
+		if err := sketch.UnmarshalBinary(data); err != nil {
+			return nil, fmt.Errorf("decode sketch: %s", err.Error())
+		}
+		result = append(result, DailySketch{LinkID: linkID, Day: day, Bots: key.bots, Sketch: sketch})
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		if !result[i].Day.Equal(result[j].Day) {
+			return result[i].Day.Before(result[j].Day)
+		}
+		return !result[i].Bots && result[j].Bots
+	})
+
+	return result, nil
+}
+
+func (s *StorageMemory) snapshotSketches() []DailySketch {
+	result := make([]DailySketch, 0, len(s.sketches))
+	for key, data := range s.sketches {
+		sketch := &hll.Sketch{}
+		if err := sketch.UnmarshalBinary(data); err != nil {
+			continue
+		}
+		result = append(result, DailySketch{LinkID: key.linkID, Day: time.Unix(key.day, 0).UTC(), Bots: key.bots, Sketch: sketch})
+	}
+	return result
+}
+
+func (s *StorageMemory) loadSketches(sketches []DailySketch) error {
+	for _, v := range sketches {
+		if v.Sketch == nil {
+			continue
+		}
+		data, err := v.Sketch.MarshalBinary()
+		if err != nil {
+			return fmt.Errorf("encode sketch: %s", err.Error())
+		}
+		s.sketches[sketchKey{linkID: v.LinkID, day: SketchDay(v.Day).Unix(), bots: v.Bots}] = data
+	}
+	return nil
+}
+
+func (s *StorageDB) GetSketches(ctx context.Context, linkID string, from, to time.Time) ([]DailySketch, error) {
+	rows, err := s.db.QueryContext(ctx,
+		"SELECT day, bots, sketch FROM click_sketches WHERE link_id=$1 AND day >= $2 AND day < $3 ORDER BY day, bots",
+		linkID, SketchDay(from), to,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("get sketches: %s", err.Error())
+	}
+	defer rows.Close()
+
+	var result []DailySketch
+	for rows.Next() {
+		var data []byte
+		v := DailySketch{LinkID: linkID, Sketch: &hll.Sketch{}}
+		if err = rows.Scan(&v.Day, &v.Bots, &data); err != nil {
+			return nil, fmt.Errorf("row scan: %s", err.Error())
+		}
+		if err = v.Sketch.UnmarshalBinary(data); err != nil {
+			return nil, fmt.Errorf("decode sketch: %s", err.Error())
+		}
+		v.Day = v.Day.UTC()
+		result = append(result, v)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("row scan: %s", err.Error())
+	}
+
+	return result, nil
+}
+
+// mergeSketches updates the sketches in the transaction that saves the
+// clicks, so sketches and raw clicks never disagree.
+func (s *StorageDB) mergeSketches(ctx context.Context, tx *sql.Tx, clicks []ClickEvent) error {
+	keys, sketches := sketchClicks(clicks)
+	for _, key := range keys {
+		sketch := sketches[key]
+		day := time.Unix(key.day, 0).UTC()
+
+		if _, err := tx.ExecContext(ctx,
+			"INSERT INTO click_sketches (link_id, day, bots, sketch) VALUES ($1, $2, $3, '') ON CONFLICT DO NOTHING",
+			key.linkID, day, key.bots,
+		); err != nil {
+			return fmt.Errorf("insert sketch: %s", err.Error())
+		}
+
+		var data []byte
+		if err := tx.QueryRowContext(ctx,
+			"SELECT sketch FROM click_sketches WHERE link_id=$1 AND day=$2 AND bots=$3 FOR UPDATE",
+			key.linkID, day, key.bots,
+		).Scan(&data); err != nil {
+			return fmt.Errorf("select sketch: %s", err.Error())
+		}
+
+		if len(data) != 0 {
+			previous := &hll.Sketch{}
+			if err := previous.UnmarshalBinary(data); err != nil {
+				return fmt.Errorf("decode sketch: %s", err.Error())
+			}
+			sketch.Merge(previous)
+		}
+
+		data, err := sketch.MarshalBinary()
+		if err != nil {
+			return fmt.Errorf("encode sketch: %s", err.Error())
+		}
+
+		if _, err = tx.ExecContext(ctx,
+			"UPDATE click_sketches SET sketch=$4 WHERE link_id=$1 AND day=$2 AND bots=$3",
+			key.linkID, day, key.bots, data,
+		); err != nil {
+			return fmt.Errorf("update sketch: %s", err.Error())
+		}
+	}
+
+	return nil
+}
@@ -1,6 +1,7 @@
 package storage
 
 import (
+	"bytes"
 	"context"
 	"database/sql"
 	"encoding/json"
@@ -12,6 +13,7 @@ import (
 	"log"
 	"os"
 	"sync"
+	"time"
 
 	_ "github.com/lib/pq"
 )
@@ -21,11 +23,108 @@ type LinkEntity struct {
 	OriginalURL string `json:"original_url"`
 	ShortURL    string `json:"short_url"`
 	IsDeleted   string `json:"is_deleted"`
+	// Interstitial makes GetURL show a preview page instead of redirecting.
+	Interstitial bool `json:"interstitial,omitempty"`
+	// Open Graph data served to link-preview crawlers instead of a redirect.
+	OGTitle       string `json:"og_title,omitempty"`
+	OGDescription string `json:"og_description,omitempty"`
+	OGImage       string `json:"og_image,omitempty"`
+	// Rules are evaluated in order by GetURL, the first match wins.
+	Rules []RoutingRule `json:"rules,omitempty"`
+	// GeoRules are evaluated by client location when no user agent rule matched.
+	GeoRules []GeoRule `json:"geo_rules,omitempty"`
+	// Variants split the remaining traffic by weight, see GetURL.
+	Variants []Variant `json:"variants,omitempty"`
+	// NotBefore and ExpiresAt limit when the link redirects, FallbackURL is
+	// used outside of that window instead of an error page.
+	NotBefore   *time.Time `json:"not_before,omitempty"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+	FallbackURL string     `json:"fallback_url,omitempty"`
+	// MaxClicks limits how many redirects the link serves, zero means no limit.
+	MaxClicks     int64  `json:"max_clicks,omitempty"`
+	ClickCount    int64  `json:"click_count,omitempty"`
+	RemainingUses *int64 `json:"remaining_uses,omitempty"`
+	// Languages are chosen by Accept-Language before weighted variants.
+	Languages []LanguageVariant `json:"languages,omitempty"`
+	// PasswordHash is a bcrypt hash, GetURL asks for the password when set.
+	// It is kept in JSON for the file storage, handlers must not expose it.
+	PasswordHash string `json:"password_hash,omitempty"`
+	// UserID is the token cookie user that created the link, only the owner
+	// may read its statistics.
+	UserID string `json:"user_id,omitempty"`
+	// CampaignID is the campaign the link belongs to, it is only changed by
+	// SetCampaignLinks and DeleteCampaign.
+	CampaignID string `json:"campaign_id,omitempty"`
+	// Conversions issues a click ID on every redirect, see ConversionTracking.
+	Conversions *ConversionTracking `json:"conversions,omitempty"`
+}
+
+// Remaining returns how many redirects a click-limited link has left.
+func (l LinkEntity) Remaining() (int64, bool) {
+	if l.MaxClicks <= 0 {
+		return 0, false
+	}
+	if l.ClickCount >= l.MaxClicks {
+		return 0, true
+	}
+	return l.MaxClicks - l.ClickCount, true
+}
+
+// CheckActive reports whether the link may redirect at now.
+func (l LinkEntity) CheckActive(now time.Time) error {
+	if l.IsDeleted == "expired" || (l.ExpiresAt != nil && !now.Before(*l.ExpiresAt)) {
+		return apiError.ErrLinkExpired
+	}
+
+	if l.NotBefore != nil && now.Before(*l.NotBefore) {
+		return apiError.ErrLinkNotActive
+	}
+
+	return nil
+}
+
+// RoutingRule sends clients whose parsed user agent matches every non-empty
+// field to URL.
+type RoutingRule struct {
+	OS      string `json:"os,omitempty"`
+	Device  string `json:"device,omitempty"`
+	Browser string `json:"browser,omitempty"`
+	URL     string `json:"url"`
+}
+
+// Variant is one weighted destination of an A/B split with its click count.
+type Variant struct {
+	URL    string `json:"url"`
+	Weight int    `json:"weight"`
+	Clicks int64  `json:"clicks"`
+}
+
+// LanguageVariant is the destination for clients preferring Tag (BCP 47).
+type LanguageVariant struct {
+	Tag    string `json:"tag"`
+	URL    string `json:"url"`
+	Clicks int64  `json:"clicks"`
+}
+
+// GeoRule sends clients from Country (ISO 3166-1 alpha-2) or Continent
+// (two-letter code) to URL.
+type GeoRule struct {
+	Country   string `json:"country,omitempty"`
+	Continent string `json:"continent,omitempty"`
+	URL       string `json:"url"`
+}
+
+func (l LinkEntity) HasOpenGraph() bool {
+	return l.OGTitle != "" || l.OGDescription != "" || l.OGImage != ""
 }
 
 type LinkBatch struct {
-	CorrelationID string `json:"correlation_id"`
-	OriginalURL   string `json:"original_url"`
+	CorrelationID string     `json:"correlation_id"`
+	OriginalURL   string     `json:"original_url"`
+	NotBefore     *time.Time `json:"not_before,omitempty"`
+	ExpiresAt     *time.Time `json:"expires_at,omitempty"`
+	FallbackURL   string     `json:"fallback_url,omitempty"`
+	UserID        string     `json:"-"`
 }
 
 type LinkBatchResult struct {
@@ -33,13 +132,91 @@ type LinkBatchResult struct {
 	ShortURL      string `json:"short_url"`
 }
 
+// fileSnapshot is the layout of the storage file, files written before
+// bundles were added hold just the links array.
+type fileSnapshot struct {
+	Links     []LinkEntity  `json:"links"`
+	Bundles   []Bundle      `json:"bundles,omitempty"`
+	Campaigns []Campaign    `json:"campaigns,omitempty"`
+	Clicks    []ClickEvent  `json:"clicks,omitempty"`
+	Sketches  []DailySketch `json:"sketches,omitempty"`
+	Hourly    []ClickCount  `json:"hourly,omitempty"`
+	Daily     []ClickCount  `json:"daily,omitempty"`
+	// Watermark is the end of the clicks rolled up into Hourly and Daily.
+	Watermark   *time.Time   `json:"watermark,omitempty"`
+	Conversions []Conversion `json:"conversions,omitempty"`
+	APIKeys     []APIKey     `json:"api_keys,omitempty"`
+}
+
 type StorageFile struct {
 	file   *os.File
-	memory StorageMemory
+	memory *StorageMemory
 }
 
 type StorageMemory struct {
-	links []LinkEntity
+	mu        sync.RWMutex
+	links     []LinkEntity
+	bundles   []Bundle
+	campaigns []Campaign
+	clicks    []ClickEvent
+	// sketches hold encoded hll sketches of unique visitors per link and day.
+	sketches map[sketchKey][]byte
+	// hourly and daily count clicks before watermark, see Rollup.
+	hourly    map[countKey]int64
+	daily     map[countKey]int64
+	watermark time.Time
+	// conversions are indexed by click ID in converted, each click converts
+	// at most once.
+	conversions []Conversion
+	converted   map[string]bool
+	apiKeys     []APIKey
+}
+
+const linkColumns = "hash_url, original_url, short_url, is_deleted, interstitial, og_title, og_description, og_image, rules, geo_rules, variants, not_before, expires_at, fallback_url, max_clicks, click_count, password_hash, languages, user_id, campaign_id, conversions"
+
+var migrations = []string{
+	"ALTER TABLE links ADD COLUMN IF NOT EXISTS interstitial BOOLEAN NOT NULL DEFAULT FALSE",
+	"ALTER TABLE links ADD COLUMN IF NOT EXISTS og_title TEXT NOT NULL DEFAULT ''",
+	"ALTER TABLE links ADD COLUMN IF NOT EXISTS og_description TEXT NOT NULL DEFAULT ''",
+	"ALTER TABLE links ADD COLUMN IF NOT EXISTS og_image TEXT NOT NULL DEFAULT ''",
+	"ALTER TABLE links ADD COLUMN IF NOT EXISTS rules TEXT NOT NULL DEFAULT ''",
+	"ALTER TABLE links ADD COLUMN IF NOT EXISTS geo_rules TEXT NOT NULL DEFAULT ''",
+	"ALTER TABLE links ADD COLUMN IF NOT EXISTS variants TEXT NOT NULL DEFAULT ''",
+	"ALTER TABLE links ADD COLUMN IF NOT EXISTS not_before TIMESTAMPTZ",
+	"ALTER TABLE links ADD COLUMN IF NOT EXISTS expires_at TIMESTAMPTZ",
+	"ALTER TABLE links ADD COLUMN IF NOT EXISTS fallback_url TEXT NOT NULL DEFAULT ''",
+	"ALTER TABLE links ADD COLUMN IF NOT EXISTS max_clicks BIGINT NOT NULL DEFAULT 0",
+	"ALTER TABLE links ADD COLUMN IF NOT EXISTS click_count BIGINT NOT NULL DEFAULT 0",
+	"ALTER TABLE links ADD COLUMN IF NOT EXISTS password_hash TEXT NOT NULL DEFAULT ''",
+	"ALTER TABLE links ADD COLUMN IF NOT EXISTS languages TEXT NOT NULL DEFAULT ''",
+	"ALTER TABLE links ADD COLUMN IF NOT EXISTS user_id TEXT NOT NULL DEFAULT ''",
+	"CREATE TABLE IF NOT EXISTS clicks (link_id TEXT NOT NULL, clicked_at TIMESTAMPTZ NOT NULL, referrer TEXT NOT NULL DEFAULT '', user_agent TEXT NOT NULL DEFAULT '', ip_hash TEXT NOT NULL DEFAULT '')",
+	"CREATE INDEX IF NOT EXISTS clicks_link_id_clicked_at ON clicks (link_id, clicked_at)",
+	"ALTER TABLE clicks ADD COLUMN IF NOT EXISTS country TEXT NOT NULL DEFAULT ''",
+	"ALTER TABLE clicks ADD COLUMN IF NOT EXISTS device TEXT NOT NULL DEFAULT ''",
+	"CREATE TABLE IF NOT EXISTS click_sketches (link_id TEXT NOT NULL, day TIMESTAMPTZ NOT NULL, bots BOOLEAN NOT NULL DEFAULT FALSE, sketch BYTEA NOT NULL, PRIMARY KEY (link_id, day, bots))",
+	"ALTER TABLE clicks ADD COLUMN IF NOT EXISTS browser TEXT NOT NULL DEFAULT ''",
+	"ALTER TABLE clicks ADD COLUMN IF NOT EXISTS os TEXT NOT NULL DEFAULT ''",
+	"ALTER TABLE clicks ADD COLUMN IF NOT EXISTS bot BOOLEAN NOT NULL DEFAULT FALSE",
+	"ALTER TABLE clicks ADD COLUMN IF NOT EXISTS language TEXT NOT NULL DEFAULT ''",
+	"CREATE TABLE IF NOT EXISTS click_hourly (link_id TEXT NOT NULL, period_start TIMESTAMPTZ NOT NULL, referrer TEXT NOT NULL, country TEXT NOT NULL, device TEXT NOT NULL, browser TEXT NOT NULL, os TEXT NOT NULL, bot BOOLEAN NOT NULL, clicks BIGINT NOT NULL, PRIMARY KEY (link_id, period_start, referrer, country, device, browser, os, bot))",
+	"CREATE TABLE IF NOT EXISTS click_daily (link_id TEXT NOT NULL, period_start TIMESTAMPTZ NOT NULL, referrer TEXT NOT NULL, country TEXT NOT NULL, device TEXT NOT NULL, browser TEXT NOT NULL, os TEXT NOT NULL, bot BOOLEAN NOT NULL, clicks BIGINT NOT NULL, PRIMARY KEY (link_id, period_start, referrer, country, device, browser, os, bot))",
+	"CREATE TABLE IF NOT EXISTS click_rollup (id INTEGER PRIMARY KEY, watermark TIMESTAMPTZ)",
+	"INSERT INTO click_rollup (id) VALUES (1) ON CONFLICT DO NOTHING",
+	"CREATE INDEX IF NOT EXISTS clicks_clicked_at ON clicks (clicked_at)",
+	"CREATE TABLE IF NOT EXISTS bundles (code TEXT PRIMARY KEY, user_id TEXT NOT NULL, title TEXT NOT NULL, description TEXT NOT NULL DEFAULT '', theme TEXT NOT NULL DEFAULT '', items TEXT NOT NULL DEFAULT '')",
+	"CREATE TABLE IF NOT EXISTS campaigns (code TEXT PRIMARY KEY, user_id TEXT NOT NULL, name TEXT NOT NULL, description TEXT NOT NULL DEFAULT '', params TEXT NOT NULL DEFAULT '')",
+	"ALTER TABLE links ADD COLUMN IF NOT EXISTS campaign_id TEXT NOT NULL DEFAULT ''",
+	"CREATE INDEX IF NOT EXISTS links_campaign_id ON links (campaign_id)",
+	"ALTER TABLE links ADD COLUMN IF NOT EXISTS conversions TEXT NOT NULL DEFAULT ''",
+	"CREATE TABLE IF NOT EXISTS conversions (click_id TEXT PRIMARY KEY, link_id TEXT NOT NULL, clicked_at TIMESTAMPTZ NOT NULL, converted_at TIMESTAMPTZ NOT NULL, source TEXT NOT NULL)",
+	"CREATE INDEX IF NOT EXISTS conversions_link_id_clicked_at ON conversions (link_id, clicked_at)",
+	"CREATE TABLE IF NOT EXISTS api_keys (id TEXT PRIMARY KEY, user_id TEXT NOT NULL, name TEXT NOT NULL DEFAULT '', hash TEXT NOT NULL, scopes TEXT NOT NULL DEFAULT '', created_at TIMESTAMPTZ NOT NULL, expires_at TIMESTAMPTZ)",
+	"CREATE INDEX IF NOT EXISTS api_keys_user_id ON api_keys (user_id)",
+}
+
+type rowScanner interface {
+	Scan(dest ...any) error
 }
 
 type StorageDB struct {
@@ -58,24 +235,59 @@ func NewStorageFile(filename string) (*StorageFile, error) {
 		log.Fatal("read from file:", err)
 	}
 
-	var links []LinkEntity
+	var snapshot fileSnapshot
 
-	if len(fileBuff) != 0 {
-		if err = json.Unmarshal(fileBuff, &links); err != nil {
+	if trimmed := bytes.TrimSpace(fileBuff); len(trimmed) != 0 {
+		if trimmed[0] == '[' {
+			err = json.Unmarshal(trimmed, &snapshot.Links)
+		} else {
+			err = json.Unmarshal(trimmed, &snapshot)
+		}
+		if err != nil {
 			return nil, fmt.Errorf("unmarshaling: %s", err.Error())
 		}
 	}
 
+	// Link IDs are not part of the JSON, they are derived from the URL the
+	// same way the handlers generate them.
+	for i, link := range snapshot.Links {
+		if link.ID == "" {
+			snapshot.Links[i].ID = usecases.GenerateShortLink([]byte(link.OriginalURL))
+		}
+	}
+
 	memory := NewStorageMemory()
+	if snapshot.Links != nil {
+		memory.links = snapshot.Links
+	}
+	memory.bundles = snapshot.Bundles
+	memory.campaigns = snapshot.Campaigns
+	memory.clicks = snapshot.Clicks
+	sortClicks(memory.clicks)
+	if err = memory.loadSketches(snapshot.Sketches); err != nil {
+		return nil, err
+	}
+	memory.hourly = loadCounts(snapshot.Hourly)
+	memory.daily = loadCounts(snapshot.Daily)
+	memory.loadConversions(snapshot.Conversions)
+	memory.apiKeys = snapshot.APIKeys
+	if snapshot.Watermark != nil {
+		memory.watermark = *snapshot.Watermark
+	}
+
 	return &StorageFile{
 		file:   file,
-		memory: *memory,
+		memory: memory,
 	}, nil
 }
 
 func NewStorageMemory() *StorageMemory {
 	return &StorageMemory{
-		links: []LinkEntity{},
+		links:     []LinkEntity{},
+		sketches:  make(map[sketchKey][]byte),
+		hourly:    make(map[countKey]int64),
+		daily:     make(map[countKey]int64),
+		converted: make(map[string]bool),
 	}
 }
 
@@ -92,14 +304,19 @@ func NewStorageDB(dsn string) *StorageDB {
 		log.Fatalf("create database: %s", err.Error())
 	}
 
+	for _, migration := range migrations {
+		if _, err = db.Exec(migration); err != nil {
+			log.Fatalf("migrate database: %s", err.Error())
+		}
+	}
+
 	return &StorageDB{
 		db: db,
 	}
 }
 
 func (s *StorageFile) Put(newLink LinkEntity) error {
-	s.memory.links = append(s.memory.links, newLink)
-	return nil
+	return s.memory.Put(newLink)
 }
 
 func (s *StorageMemory) Batch(ctx context.Context, links []LinkBatch, baseURL string) ([]LinkBatchResult, error) {
@@ -111,6 +328,9 @@ func (s *StorageFile) Batch(ctx context.Context, links []LinkBatch, baseURL stri
 }
 
 func (s *StorageFile) Get(id string) (string, error) {
+	s.memory.mu.RLock()
+	defer s.memory.mu.RUnlock()
+
 	for _, v := range s.memory.links {
 		if v.ID == id {
 			return v.OriginalURL, nil
@@ -120,11 +340,35 @@ func (s *StorageFile) Get(id string) (string, error) {
 	return "", errors.New("link not found")
 }
 
+func (s *StorageFile) GetLink(id string) (LinkEntity, error) {
+	return s.memory.GetLink(id)
+}
+
+func (s *StorageFile) ModifyLink(id string, change func(link *LinkEntity) error) error {
+	return s.memory.ModifyLink(id, change)
+}
+
+func (s *StorageFile) IncrementVariantClicks(id string, variant int) error {
+	return s.memory.IncrementVariantClicks(id, variant)
+}
+
+func (s *StorageFile) RemoveExpired(ctx context.Context, now time.Time) (int64, error) {
+	return s.memory.RemoveExpired(ctx, now)
+}
+
+func (s *StorageFile) ConsumeClick(id string) error {
+	return s.memory.ConsumeClick(id)
+}
+
+func (s *StorageFile) IncrementLanguageClicks(id string, tag string) error {
+	return s.memory.IncrementLanguageClicks(id, tag)
+}
+
 func (s *StorageFile) GetAll() ([]LinkEntity, error) {
-	return s.memory.links, nil
+	return s.memory.GetAll()
 }
 
-func (s *StorageFile) RemoveURLs(ctx context.Context, urls []string) error {
+func (s *StorageFile) RemoveURLs(ctx context.Context, userID string, urls []string) error {
 	return nil
 
 }
@@ -132,12 +376,33 @@ func (s *StorageFile) RemoveURLs(ctx context.Context, urls []string) error {
 func (s *StorageFile) Close() error {
 	fmt.Println("Save data to file")
 
-	bytes, err := json.Marshal(s.memory.links)
+	s.memory.mu.RLock()
+	snapshot := fileSnapshot{
+		Links:       s.memory.links,
+		Bundles:     s.memory.bundles,
+		Campaigns:   s.memory.campaigns,
+		Clicks:      s.memory.clicks,
+		Sketches:    s.memory.snapshotSketches(),
+		Hourly:      countsList(s.memory.hourly, "", time.Time{}, time.Time{}),
+		Daily:       countsList(s.memory.daily, "", time.Time{}, time.Time{}),
+		Conversions: s.memory.conversions,
+		APIKeys:     s.memory.apiKeys,
+	}
+	if !s.memory.watermark.IsZero() {
+		watermark := s.memory.watermark
+		snapshot.Watermark = &watermark
+	}
+	data, err := json.Marshal(snapshot)
+	s.memory.mu.RUnlock()
 	if err != nil {
 		return fmt.Errorf("marshaling: %s", err.Error())
 	}
 
-	_, err = s.file.Write(bytes)
+	if err = s.file.Truncate(0); err != nil {
+		return fmt.Errorf("truncate file: %s", err.Error())
+	}
+
+	_, err = s.file.WriteAt(data, 0)
 	if err != nil {
 		return fmt.Errorf("write to file, when close file description: %s ", err.Error())
 	}
@@ -154,11 +419,17 @@ func (s *StorageFile) Ping() error {
 }
 
 func (s *StorageMemory) Put(link LinkEntity) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	s.links = append(s.links, link)
 	return nil
 }
 
 func (s *StorageMemory) Get(id string) (string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
 	for _, v := range s.links {
 		if v.IsDeleted == "deleted" {
 			return "", apiError.ErrDeleteLink
@@ -171,16 +442,162 @@ func (s *StorageMemory) Get(id string) (string, error) {
 	return "", apiError.ErrLinkNotFound
 }
 
+func (s *StorageMemory) GetLink(id string) (LinkEntity, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, v := range s.links {
+		if v.ID != id {
+			continue
+		}
+		if v.IsDeleted == "deleted" {
+			return LinkEntity{}, apiError.ErrDeleteLink
+		}
+		return v, nil
+	}
+
+	return LinkEntity{}, apiError.ErrLinkNotFound
+}
+
+// ModifyLink applies change to the stored link under the lock, counters
+// updated by concurrent redirects are not lost.
+func (s *StorageMemory) ModifyLink(id string, change func(link *LinkEntity) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, v := range s.links {
+		if v.ID != id {
+			continue
+		}
+		if v.IsDeleted == "deleted" {
+			return apiError.ErrDeleteLink
+		}
+		link := v
+		if err := change(&link); err != nil {
+			return err
+		}
+		s.links[i] = updatedLink(v, link)
+		return nil
+	}
+
+	return apiError.ErrLinkNotFound
+}
+
+// updatedLink takes the settings of link over stored. The click count,
+// deletion, owner and campaign are changed by their own methods only,
+// the same columns the DB update leaves alone.
+func updatedLink(stored, link LinkEntity) LinkEntity {
+	link.ID = stored.ID
+	link.ShortURL = stored.ShortURL
+	link.IsDeleted = stored.IsDeleted
+	link.ClickCount = stored.ClickCount
+	link.UserID = stored.UserID
+	link.CampaignID = stored.CampaignID
+	return link
+}
+
+func (s *StorageMemory) IncrementVariantClicks(id string, variant int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, v := range s.links {
+		if v.ID != id {
+			continue
+		}
+		if variant < 0 || variant >= len(v.Variants) {
+			return fmt.Errorf("variant %d out of range", variant)
+		}
+		// Copy on write, links handed out by GetLink share the old slice.
+		variants := make([]Variant, len(v.Variants))
+		copy(variants, v.Variants)
+		variants[variant].Clicks++
+		s.links[i].Variants = variants
+		return nil
+	}
+
+	return apiError.ErrLinkNotFound
+}
+
+func (s *StorageMemory) IncrementLanguageClicks(id string, tag string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, v := range s.links {
+		if v.ID != id {
+			continue
+		}
+		for j := range v.Languages {
+			if v.Languages[j].Tag == tag {
+				languages := make([]LanguageVariant, len(v.Languages))
+				copy(languages, v.Languages)
+				languages[j].Clicks++
+				s.links[i].Languages = languages
+				return nil
+			}
+		}
+		return fmt.Errorf("language %s not found", tag)
+	}
+
+	return apiError.ErrLinkNotFound
+}
+
+// ConsumeClick counts a redirect of a click-limited link and fails with
+// ErrLinkExhausted once the limit is reached.
+func (s *StorageMemory) ConsumeClick(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, v := range s.links {
+		if v.ID != id {
+			continue
+		}
+		if v.MaxClicks > 0 && v.ClickCount >= v.MaxClicks {
+			return apiError.ErrLinkExhausted
+		}
+		s.links[i].ClickCount++
+		return nil
+	}
+
+	return apiError.ErrLinkNotFound
+}
+
+// RemoveExpired tombstones links whose expiry has passed, GetLink keeps
+// returning them so GetURL can still use the fallback URL.
+func (s *StorageMemory) RemoveExpired(ctx context.Context, now time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var removed int64
+	for i, v := range s.links {
+		if v.IsDeleted == "" && v.ExpiresAt != nil && !now.Before(*v.ExpiresAt) {
+			s.links[i].IsDeleted = "expired"
+			removed++
+		}
+	}
+
+	return removed, nil
+}
+
 func (s *StorageMemory) GetAll() ([]LinkEntity, error) {
-	return s.links, nil
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	links := make([]LinkEntity, len(s.links))
+	copy(links, s.links)
+	return links, nil
 }
 
 func (s *StorageMemory) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	s.links = []LinkEntity{}
 	return nil
 }
 
-func (s *StorageMemory) RemoveURLs(ctx context.Context, urls []string) error {
+// RemoveURLs tombstones the links of urls that belong to userID, other
+// users' links are left alone.
+func (s *StorageMemory) RemoveURLs(ctx context.Context, userID string, urls []string) error {
 	if len(urls) == 0 {
 		return nil
 	}
@@ -190,8 +607,11 @@ func (s *StorageMemory) RemoveURLs(ctx context.Context, urls []string) error {
 		m[v] = true
 	}
 
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	for i, v := range s.links {
-		if _, ok := m[v.ID]; ok {
+		if _, ok := m[v.ID]; ok && v.UserID == userID {
 			s.links[i].IsDeleted = "deleted"
 		}
 	}
@@ -204,7 +624,36 @@ func (s *StorageMemory) Ping() error {
 }
 
 func (s *StorageDB) Put(link LinkEntity) error {
-	row, err := s.db.Query("INSERT INTO links VALUES ($1, $2, $3) ", link.ID, link.OriginalURL, link.ShortURL)
+	rules, err := marshalColumn(link.Rules)
+	if err != nil {
+		return err
+	}
+
+	geoRules, err := marshalColumn(link.GeoRules)
+	if err != nil {
+		return err
+	}
+
+	variants, err := marshalColumn(link.Variants)
+	if err != nil {
+		return err
+	}
+
+	languages, err := marshalColumn(link.Languages)
+	if err != nil {
+		return err
+	}
+
+	conversions, err := marshalColumn(link.Conversions)
+	if err != nil {
+		return err
+	}
+
+	row, err := s.db.Query(
+		"INSERT INTO links (hash_url, original_url, short_url, interstitial, og_title, og_description, og_image, rules, geo_rules, variants, not_before, expires_at, fallback_url, max_clicks, password_hash, languages, user_id, conversions) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18)",
+		link.ID, link.OriginalURL, link.ShortURL, link.Interstitial, link.OGTitle, link.OGDescription, link.OGImage, rules, geoRules, variants,
+		link.NotBefore, link.ExpiresAt, link.FallbackURL, link.MaxClicks, link.PasswordHash, languages, link.UserID, conversions,
+	)
 	if err != nil {
 		return &apiError.NotUniqueRecordError{
 			URL: link.OriginalURL,
@@ -238,6 +687,170 @@ func (s *StorageDB) Get(id string) (string, error) {
 	return originalURL, nil
 }
 
+func (s *StorageDB) GetLink(id string) (LinkEntity, error) {
+	row := s.db.QueryRow("SELECT "+linkColumns+" FROM links WHERE hash_url=$1", id)
+	link, err := scanLink(row)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return LinkEntity{}, apiError.ErrLinkNotFound
+		}
+		return LinkEntity{}, fmt.Errorf("get link by id: %s", err.Error())
+	}
+
+	if link.IsDeleted == "deleted" {
+		return LinkEntity{}, apiError.ErrDeleteLink
+	}
+
+	return link, nil
+}
+
+// ModifyLink locks the row so concurrent redirects do not lose their
+// counters, see updateJSON.
+func (s *StorageDB) ModifyLink(id string, change func(link *LinkEntity) error) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("start transaction, %s", err.Error())
+	}
+
+	defer tx.Rollback()
+
+	link, err := scanLink(tx.QueryRow("SELECT "+linkColumns+" FROM links WHERE hash_url=$1 FOR UPDATE", id))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return apiError.ErrLinkNotFound
+		}
+		return fmt.Errorf("get link by id: %s", err.Error())
+	}
+	if link.IsDeleted == "deleted" {
+		return apiError.ErrDeleteLink
+	}
+
+	if err = change(&link); err != nil {
+		return err
+	}
+
+	if err = updateLinkRow(tx, link); err != nil {
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("commit, %s", err.Error())
+	}
+
+	return nil
+}
+
+func updateLinkRow(tx *sql.Tx, link LinkEntity) error {
+	rules, err := marshalColumn(link.Rules)
+	if err != nil {
+		return err
+	}
+
+	geoRules, err := marshalColumn(link.GeoRules)
+	if err != nil {
+		return err
+	}
+
+	variants, err := marshalColumn(link.Variants)
+	if err != nil {
+		return err
+	}
+
+	languages, err := marshalColumn(link.Languages)
+	if err != nil {
+		return err
+	}
+
+	conversions, err := marshalColumn(link.Conversions)
+	if err != nil {
+		return err
+	}
+
+	result, err := tx.Exec(
+		"UPDATE links SET original_url=$2, interstitial=$3, og_title=$4, og_description=$5, og_image=$6, rules=$7, geo_rules=$8, variants=$9, not_before=$10, expires_at=$11, fallback_url=$12, max_clicks=$13, password_hash=$14, languages=$15, conversions=$16 WHERE hash_url=$1",
+		link.ID, link.OriginalURL, link.Interstitial, link.OGTitle, link.OGDescription, link.OGImage, rules, geoRules, variants,
+		link.NotBefore, link.ExpiresAt, link.FallbackURL, link.MaxClicks, link.PasswordHash, languages, conversions,
+	)
+	if err != nil {
+		return fmt.Errorf("update link: %s", err.Error())
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("update link: %s", err.Error())
+	}
+	if affected == 0 {
+		return apiError.ErrLinkNotFound
+	}
+
+	return nil
+}
+
+func (s *StorageDB) IncrementVariantClicks(id string, variant int) error {
+	return s.updateJSON("links", "hash_url", id, "variants", func(column string) (string, error) {
+		var variants []Variant
+		if err := unmarshalColumn(column, &variants); err != nil {
+			return "", err
+		}
+		if variant < 0 || variant >= len(variants) {
+			return "", fmt.Errorf("variant %d out of range", variant)
+		}
+		variants[variant].Clicks++
+		return marshalColumn(variants)
+	})
+}
+
+func (s *StorageDB) IncrementLanguageClicks(id string, tag string) error {
+	return s.updateJSON("links", "hash_url", id, "languages", func(column string) (string, error) {
+		var languages []LanguageVariant
+		if err := unmarshalColumn(column, &languages); err != nil {
+			return "", err
+		}
+		for i := range languages {
+			if languages[i].Tag == tag {
+				languages[i].Clicks++
+				return marshalColumn(languages)
+			}
+		}
+		return "", fmt.Errorf("language %s not found", tag)
+	})
+}
+
+// updateJSON locks the row so concurrent redirects do not overwrite each
+// other's counters kept in a JSON column.
+func (s *StorageDB) updateJSON(table, keyColumn, id, column string, change func(data string) (string, error)) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("start transaction, %s", err.Error())
+	}
+
+	defer tx.Rollback()
+
+	var data string
+	query := fmt.Sprintf("SELECT %s FROM %s WHERE %s=$1 FOR UPDATE", column, table, keyColumn)
+	if err = tx.QueryRow(query, id).Scan(&data); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return apiError.ErrLinkNotFound
+		}
+		return fmt.Errorf("select %s: %s", column, err.Error())
+	}
+
+	if data, err = change(data); err != nil {
+		return err
+	}
+
+	query = fmt.Sprintf("UPDATE %s SET %s=$2 WHERE %s=$1", table, column, keyColumn)
+	if _, err = tx.Exec(query, id, data); err != nil {
+		return fmt.Errorf("update %s: %s", column, err.Error())
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("commit, %s", err.Error())
+	}
+
+	return nil
+}
+
 func (s *StorageDB) Batch(ctx context.Context, links []LinkBatch, baseURL string) ([]LinkBatchResult, error) {
 	result := make([]LinkBatchResult, 0)
 	tx, err := s.db.Begin()
@@ -247,7 +860,7 @@ func (s *StorageDB) Batch(ctx context.Context, links []LinkBatch, baseURL string
 
 	defer tx.Rollback()
 
-	stmt, err := s.db.PrepareContext(ctx, "INSERT INTO links(hash_url, short_url, original_url, correlation_id) VALUES ($1, $2, $3, $4)")
+	stmt, err := s.db.PrepareContext(ctx, "INSERT INTO links(hash_url, short_url, original_url, correlation_id, not_before, expires_at, fallback_url, user_id) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)")
 	if err != nil {
 		return nil, fmt.Errorf("prepare statement, %s", err.Error())
 	}
@@ -256,7 +869,7 @@ func (s *StorageDB) Batch(ctx context.Context, links []LinkBatch, baseURL string
 
 	for _, v := range links {
 		short := usecases.GenerateShortLink([]byte(v.OriginalURL))
-		if _, err := stmt.ExecContext(ctx, short, fmt.Sprintf("%s/%s", baseURL, short), v.OriginalURL, v.CorrelationID); err != nil {
+		if _, err := stmt.ExecContext(ctx, short, fmt.Sprintf("%s/%s", baseURL, short), v.OriginalURL, v.CorrelationID, v.NotBefore, v.ExpiresAt, v.FallbackURL, v.UserID); err != nil {
 			return nil, fmt.Errorf("statement exec, %s", err.Error())
 		}
 
@@ -273,8 +886,44 @@ func (s *StorageDB) Batch(ctx context.Context, links []LinkBatch, baseURL string
 	return result, nil
 }
 
+// ConsumeClick relies on a conditional UPDATE, so concurrent redirects can
+// never push the counter past max_clicks.
+func (s *StorageDB) ConsumeClick(id string) error {
+	result, err := s.db.Exec(
+		"UPDATE links SET click_count = click_count + 1 WHERE hash_url=$1 AND (max_clicks = 0 OR click_count < max_clicks)",
+		id,
+	)
+	if err != nil {
+		return fmt.Errorf("consume click: %s", err.Error())
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("consume click: %s", err.Error())
+	}
+	if affected == 0 {
+		return apiError.ErrLinkExhausted
+	}
+
+	return nil
+}
+
+func (s *StorageDB) RemoveExpired(ctx context.Context, now time.Time) (int64, error) {
+	result, err := s.db.ExecContext(ctx, "UPDATE links SET is_deleted='expired' WHERE is_deleted='' AND expires_at <= $1", now)
+	if err != nil {
+		return 0, fmt.Errorf("remove expired links: %s", err.Error())
+	}
+
+	removed, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("remove expired links: %s", err.Error())
+	}
+
+	return removed, nil
+}
+
 func (s *StorageDB) GetAll() ([]LinkEntity, error) {
-	rows, err := s.db.Query("SELECT * from links")
+	rows, err := s.db.Query("SELECT " + linkColumns + " FROM links")
 	if err != nil {
 		return []LinkEntity{}, fmt.Errorf("get all urls: %s", err.Error())
 	}
@@ -286,8 +935,8 @@ func (s *StorageDB) GetAll() ([]LinkEntity, error) {
 
 	var links []LinkEntity
 	for rows.Next() {
-		var link LinkEntity
-		if err := rows.Scan(&link.ID, &link.OriginalURL, &link.ShortURL); err != nil {
+		link, err := scanLink(rows)
+		if err != nil {
 			return links, fmt.Errorf("row scan: %s", err.Error())
 		}
 		links = append(links, link)
@@ -295,7 +944,7 @@ func (s *StorageDB) GetAll() ([]LinkEntity, error) {
 	return links, nil
 }
 
-func (s *StorageDB) RemoveURLs(ctx context.Context, urls []string) error {
+func (s *StorageDB) RemoveURLs(ctx context.Context, userID string, urls []string) error {
 	tx, err := s.db.Begin()
 	if err != nil {
 		return fmt.Errorf("start transaction, %s", err.Error())
@@ -305,7 +954,7 @@ func (s *StorageDB) RemoveURLs(ctx context.Context, urls []string) error {
 		return errors.New("list of URLs is empty")
 	}
 
-	stmt, err := tx.PrepareContext(ctx, "UPDATE links SET is_deleted='deleted' WHERE hash_url=$1")
+	stmt, err := tx.PrepareContext(ctx, "UPDATE links SET is_deleted='deleted' WHERE hash_url=$1 AND user_id=$2")
 	if err != nil {
 		return fmt.Errorf("prepare statement, %s", err.Error())
 	}
@@ -320,7 +969,7 @@ func (s *StorageDB) RemoveURLs(ctx context.Context, urls []string) error {
 	for i := 0; i < 3; i++ {
 		s.wg.Add(1)
 		go func() error {
-			err = executer(ctx, stmt, tx, urlsChan)
+			err = executer(ctx, stmt, tx, userID, urlsChan)
 			if err != nil {
 				s.wg.Done()
 				return err
@@ -365,6 +1014,78 @@ func (s *StorageDB) Ping() error {
 	return nil
 }
 
+func scanLink(row rowScanner) (LinkEntity, error) {
+	var link LinkEntity
+	var rules, geoRules, variants, languages, conversions string
+	var notBefore, expiresAt sql.NullTime
+	err := row.Scan(
+		&link.ID, &link.OriginalURL, &link.ShortURL, &link.IsDeleted, &link.Interstitial,
+		&link.OGTitle, &link.OGDescription, &link.OGImage, &rules, &geoRules, &variants,
+		&notBefore, &expiresAt, &link.FallbackURL, &link.MaxClicks, &link.ClickCount,
+		&link.PasswordHash, &languages, &link.UserID, &link.CampaignID, &conversions,
+	)
+	if err != nil {
+		return link, err
+	}
+
+	if notBefore.Valid {
+		link.NotBefore = &notBefore.Time
+	}
+
+	if expiresAt.Valid {
+		link.ExpiresAt = &expiresAt.Time
+	}
+
+	if err = unmarshalColumn(rules, &link.Rules); err != nil {
+		return link, err
+	}
+
+	if err = unmarshalColumn(geoRules, &link.GeoRules); err != nil {
+		return link, err
+	}
+
+	if err = unmarshalColumn(variants, &link.Variants); err != nil {
+		return link, err
+	}
+
+	if err = unmarshalColumn(languages, &link.Languages); err != nil {
+		return link, err
+	}
+
+	if err = unmarshalColumn(conversions, &link.Conversions); err != nil {
+		return link, err
+	}
+
+	return link, nil
+}
+
+// marshalColumn encodes structured link settings for TEXT columns, empty
+// values are stored as an empty string.
+func marshalColumn(v any) (string, error) {
+	bytes, err := json.Marshal(v)
+	if err != nil {
+		return "", fmt.Errorf("marshaling column: %s", err.Error())
+	}
+
+	if string(bytes) == "null" {
+		return "", nil
+	}
+
+	return string(bytes), nil
+}
+
+func unmarshalColumn(data string, v any) error {
+	if data == "" {
+		return nil
+	}
+
+	if err := json.Unmarshal([]byte(data), v); err != nil {
+		return fmt.Errorf("unmarshaling column: %s", err.Error())
+	}
+
+	return nil
+}
+
 func fanOut(input []string, n int) []chan string {
 	chs := make([]chan string, 0, n)
 	for i, v := range input {
@@ -376,11 +1097,11 @@ func fanOut(input []string, n int) []chan string {
 	return chs
 }
 
-func executer(ctx context.Context, stmt *sql.Stmt, tx *sql.Tx, inputChan <-chan string) error {
+func executer(ctx context.Context, stmt *sql.Stmt, tx *sql.Tx, userID string, inputChan <-chan string) error {
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 	for id := range inputChan {
-		if _, err := stmt.ExecContext(ctx, id); err != nil {
+		if _, err := stmt.ExecContext(ctx, id, userID); err != nil {
 			if err = tx.Rollback(); err != nil {
 				return fmt.Errorf("rollback, %w", err)
 			}
@@ -0,0 +1,323 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	apiError "github.com/irootpro/shorturl/internal/error"
+)
+
+func TestStorageFilePersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "storage.json")
+
+	storageFile, err := NewStorageFile(path)
+	require.NoError(t, err)
+	require.NoError(t, storageFile.Put(LinkEntity{
+		ID:          "aHR0cHM6Ly9nb29nbGUuY29t",
+		OriginalURL: "https://google.com",
+		Conversions: &ConversionTracking{Mode: ClickIDQuery, Param: "click_id"},
+	}))
+	require.NoError(t, storageFile.PutBundle(Bundle{
+		ID:     "bundle",
+		UserID: "user",
+		Title:  "Links",
+		Items:  []BundleItem{{Title: "Google", URL: "https://google.com"}},
+	}))
+	require.NoError(t, storageFile.PutCampaign(Campaign{ID: "campaign", UserID: "user", Name: "Sale", Params: map[string]string{"utm_campaign": "sale"}}))
+	require.NoError(t, storageFile.SetCampaignLinks("campaign", []string{"aHR0cHM6Ly9nb29nbGUuY29t"}))
+	day := time.Date(2026, 3, 2, 0, 0, 0, 0, time.UTC)
+	require.NoError(t, storageFile.SaveClicks(context.Background(), []ClickEvent{
+		{Time: day.Add(time.Hour), LinkID: "aHR0cHM6Ly9nb29nbGUuY29t", IPHash: testIPHash("a")},
+		{Time: day.Add(2 * time.Hour), LinkID: "aHR0cHM6Ly9nb29nbGUuY29t", IPHash: testIPHash("b")},
+		{Time: day.Add(3 * time.Hour), LinkID: "aHR0cHM6Ly9nb29nbGUuY29t", IPHash: testIPHash("a")},
+	}))
+	require.NoError(t, storageFile.PutAPIKey(APIKey{ID: "key", UserID: "user", Hash: "hash", Scopes: []string{"read"}, CreatedAt: day}))
+	conversion := Conversion{ClickID: "click", LinkID: "aHR0cHM6Ly9nb29nbGUuY29t", ClickedAt: day.Add(time.Hour), ConvertedAt: day.Add(30 * time.Hour), Source: ConversionPostback}
+	created, err := storageFile.SaveConversion(context.Background(), conversion)
+	require.NoError(t, err)
+	assert.True(t, created)
+	require.NoError(t, storageFile.Close())
+
+	storageFile, err = NewStorageFile(path)
+	require.NoError(t, err)
+
+	sketches, err := storageFile.GetSketches(context.Background(), "aHR0cHM6Ly9nb29nbGUuY29t", day, day.Add(24*time.Hour))
+	require.NoError(t, err)
+	require.Len(t, sketches, 1)
+	assert.True(t, day.Equal(sketches[0].Day))
+	assert.Equal(t, int64(2), sketches[0].Sketch.Estimate())
+
+	link, err := storageFile.GetLink("aHR0cHM6Ly9nb29nbGUuY29t")
+	require.NoError(t, err)
+	assert.Equal(t, "https://google.com", link.OriginalURL)
+	assert.Equal(t, &ConversionTracking{Mode: ClickIDQuery, Param: "click_id"}, link.Conversions)
+
+	created, err = storageFile.SaveConversion(context.Background(), conversion)
+	require.NoError(t, err)
+	assert.False(t, created, "a click converts once")
+	conversions, err := storageFile.GetConversionCounts(context.Background(), "aHR0cHM6Ly9nb29nbGUuY29t", day, day.Add(24*time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, []ConversionCount{{Day: day, Conversions: 1}}, conversions)
+
+	campaign, err := storageFile.GetCampaign("campaign")
+	require.NoError(t, err)
+	assert.Equal(t, "sale", campaign.Params["utm_campaign"])
+	assert.Equal(t, []string{"aHR0cHM6Ly9nb29nbGUuY29t"}, campaign.Links)
+
+	keys, err := storageFile.GetAPIKeys("user")
+	require.NoError(t, err)
+	require.Len(t, keys, 1)
+	assert.Equal(t, "hash", keys[0].Hash)
+	assert.Equal(t, []string{"read"}, keys[0].Scopes)
+
+	bundles, err := storageFile.GetBundles("user")
+	require.NoError(t, err)
+	require.Len(t, bundles, 1)
+	assert.Equal(t, "Links", bundles[0].Title)
+	require.NoError(t, storageFile.Close())
+}
+
+func TestSaveClicksScrubsAddresses(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "storage.json")
+	storageFile, err := NewStorageFile(path)
+	require.NoError(t, err)
+
+	clicks := []ClickEvent{
+		{Time: time.Now().UTC(), LinkID: "link", IPHash: "203.0.113.7"},
+		{Time: time.Now().UTC(), LinkID: "link", IPHash: "2001:db8::7"},
+		{Time: time.Now().UTC(), LinkID: "link", IPHash: testIPHash("a")},
+	}
+	require.NoError(t, storageFile.SaveClicks(context.Background(), clicks))
+	assert.Equal(t, "203.0.113.7", clicks[0].IPHash, "the caller's slice is left alone")
+	require.NoError(t, storageFile.Close())
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.NotContains(t, string(data), "203.0.113.7")
+	assert.NotContains(t, string(data), "2001:db8::7")
+	assert.Contains(t, string(data), testIPHash("a"))
+}
+
+func TestEachClick(t *testing.T) {
+	ctx := context.Background()
+	storageMemory := NewStorageMemory()
+	start := time.Date(2026, 3, 2, 0, 0, 0, 0, time.UTC)
+
+	// Batches arrive out of order and many clicks share a timestamp, so
+	// pages end in the middle of equal times.
+	for batch := 2; batch >= 0; batch-- {
+		var clicks []ClickEvent
+		for i := 0; i < 1000; i++ {
+			at := start.Add(time.Duration(batch*1000+i/3) * time.Second)
+			clicks = append(clicks, ClickEvent{Time: at, LinkID: []string{"a", "b"}[i%2], Referrer: fmt.Sprint(batch*1000 + i)})
+		}
+		require.NoError(t, storageMemory.SaveClicks(ctx, clicks))
+	}
+
+	var got []ClickEvent
+	require.NoError(t, storageMemory.EachClick(ctx, []string{"a"}, start.Add(10*time.Second), start.Add(2990*time.Second), func(v ClickEvent) error {
+		got = append(got, v)
+		return nil
+	}))
+
+	want, err := storageMemory.GetClicks(ctx, "a", start.Add(10*time.Second), start.Add(2990*time.Second))
+	require.NoError(t, err)
+	assert.Len(t, want, 1485)
+	assert.Equal(t, want, got)
+	for i := 1; i < len(got); i++ {
+		assert.False(t, got[i].Time.Before(got[i-1].Time))
+	}
+
+	stop := fmt.Errorf("stop")
+	calls := 0
+	assert.Equal(t, stop, storageMemory.EachClick(ctx, []string{"a", "b"}, start, start.Add(time.Hour), func(v ClickEvent) error {
+		calls++
+		return stop
+	}))
+	assert.Equal(t, 1, calls)
+}
+
+func TestUpdateKeepsCounters(t *testing.T) {
+	s := NewStorageMemory()
+	require.NoError(t, s.Put(LinkEntity{
+		ID:          "once",
+		OriginalURL: "https://example.com/secret",
+		MaxClicks:   1,
+		Variants:    []Variant{{URL: "https://a.example", Weight: 1}, {URL: "https://b.example", Weight: 1}},
+		UserID:      "user",
+	}))
+
+	stale, err := s.GetLink("once")
+	require.NoError(t, err)
+	require.NoError(t, s.ConsumeClick("once"))
+
+	require.NoError(t, s.ModifyLink("once", func(link *LinkEntity) error {
+		*link = stale
+		link.Rules = []RoutingRule{{OS: "ios", URL: "https://apps.apple.com/app"}}
+		link.UserID = "someone"
+		return nil
+	}))
+	assert.ErrorIs(t, s.ConsumeClick("once"), apiError.ErrLinkExhausted, "a stale copy does not give the click back")
+
+	link, err := s.GetLink("once")
+	require.NoError(t, err)
+	assert.Equal(t, "user", link.UserID)
+	assert.Len(t, link.Rules, 1)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, s.IncrementVariantClicks("once", 0))
+		}()
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, s.ModifyLink("once", func(link *LinkEntity) error {
+				link.GeoRules = []GeoRule{{Country: "DE", URL: "https://example.de"}}
+				return nil
+			}))
+		}()
+	}
+	wg.Wait()
+
+	link, err = s.GetLink("once")
+	require.NoError(t, err)
+	assert.Equal(t, int64(100), link.Variants[0].Clicks, "changes do not overwrite concurrent clicks")
+	assert.Len(t, link.GeoRules, 1)
+}
+
+func TestModifyBundleKeepsClicks(t *testing.T) {
+	s := NewStorageMemory()
+	require.NoError(t, s.PutBundle(Bundle{
+		ID:     "bio",
+		UserID: "user",
+		Title:  "Links",
+		Items:  []BundleItem{{Title: "Blog", URL: "https://blog.example"}},
+	}))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, s.IncrementBundleItemClicks("bio", 0))
+		}()
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, s.ModifyBundle("bio", func(bundle *Bundle) error {
+				bundle.Title = "My links"
+				bundle.UserID = "someone"
+				return nil
+			}))
+		}()
+	}
+	wg.Wait()
+
+	bundle, err := s.GetBundle("bio")
+	require.NoError(t, err)
+	assert.Equal(t, int64(100), bundle.Items[0].Clicks, "changes do not overwrite concurrent clicks")
+	assert.Equal(t, "My links", bundle.Title)
+	assert.Equal(t, "user", bundle.UserID)
+
+	assert.ErrorIs(t, s.ModifyBundle("missing", func(*Bundle) error { return nil }), apiError.ErrBundleNotFound)
+}
+
+func TestStorageFileLegacyFormat(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "storage.json")
+	require.NoError(t, os.WriteFile(path, []byte(`[{"original_url":"https://google.com","short_url":"http://localhost:8080/x","is_deleted":""}]`), 0644))
+
+	storageFile, err := NewStorageFile(path)
+	require.NoError(t, err)
+
+	links, err := storageFile.GetAll()
+	require.NoError(t, err)
+	require.Len(t, links, 1)
+	assert.Equal(t, "https://google.com", links[0].OriginalURL)
+	require.NoError(t, storageFile.Close())
+}
+
+func TestRollup(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "storage.json")
+	storageFile, err := NewStorageFile(path)
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	day := time.Date(2026, 3, 2, 0, 0, 0, 0, time.UTC)
+	var clicks []ClickEvent
+	for i := 0; i < 48; i++ {
+		clicks = append(clicks, ClickEvent{
+			Time:     day.Add(time.Duration(i)*time.Hour + 10*time.Minute),
+			LinkID:   "link",
+			Referrer: "https://news.example.org/" + fmt.Sprint(i),
+			Device:   "mobile",
+			Bot:      i%4 == 0,
+		})
+	}
+	require.NoError(t, storageFile.SaveClicks(ctx, clicks))
+
+	from, to := day, day.Add(48*time.Hour)
+	total := func(period string) map[string]int64 {
+		counts, err := storageFile.GetClickCounts(ctx, "link", from, to, period)
+		require.NoError(t, err)
+		totals := make(map[string]int64)
+		for _, v := range counts {
+			totals[fmt.Sprintf("%v %s %s", v.Bot, v.Referrer, v.Device)] += v.Clicks
+			totals["all"] += v.Clicks
+		}
+		return totals
+	}
+
+	before := total(PeriodHour)
+	assert.Equal(t, int64(48), before["all"])
+	assert.Equal(t, int64(36), before["false news.example.org mobile"])
+
+	// Rolling up to the middle of an hour only takes complete hours.
+	rolled, err := storageFile.Rollup(ctx, day.Add(30*time.Hour+30*time.Minute))
+	require.NoError(t, err)
+	assert.Equal(t, int64(30), rolled)
+	assert.Equal(t, before, total(PeriodHour))
+	assert.Equal(t, before, total(PeriodDay))
+
+	rolled, err = storageFile.Rollup(ctx, day.Add(30*time.Hour))
+	require.NoError(t, err)
+	assert.Zero(t, rolled, "a repeated rollup counts nothing twice")
+
+	deleted, err := storageFile.DeleteClicks(ctx, day.Add(72*time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, int64(30), deleted, "clicks after the watermark are kept")
+	assert.Equal(t, before, total(PeriodHour))
+
+	// A click saved after its hour was rolled up is counted once.
+	require.NoError(t, storageFile.SaveClicks(ctx, []ClickEvent{{Time: day.Add(time.Hour), LinkID: "link", Device: "mobile"}}))
+	before[fmt.Sprintf("%v %s %s", false, DirectReferrer, "mobile")]++
+	before["all"]++
+	assert.Equal(t, before, total(PeriodHour))
+	assert.Equal(t, before, total(PeriodDay))
+
+	require.NoError(t, storageFile.Close())
+	storageFile, err = NewStorageFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, before, total(PeriodDay))
+
+	rolled, err = storageFile.Rollup(ctx, day.Add(48*time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, int64(18), rolled)
+	assert.Equal(t, before, total(PeriodHour))
+	require.NoError(t, storageFile.Close())
+}
+
+func testIPHash(visitor string) string {
+	sum := sha256.Sum256([]byte(visitor))
+	return hex.EncodeToString(sum[:])
+}
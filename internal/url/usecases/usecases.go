@@ -1,9 +1,53 @@
 package usecases
 
 import (
+	"crypto/rand"
 	"encoding/base64"
+	"strings"
 )
 
+// previewBots are user agent fragments of crawlers that build link previews
+// in chats and social networks.
+var previewBots = []string{
+	"facebookexternalhit",
+	"facebookcatalog",
+	"twitterbot",
+	"slackbot",
+	"slack-imgproxy",
+	"telegrambot",
+	"whatsapp",
+	"discordbot",
+	"linkedinbot",
+	"skypeuripreview",
+	"vkshare",
+	"redditbot",
+	"applebot",
+	"pinterest",
+	"embedly",
+	"mattermost",
+	"viber",
+}
+
 func GenerateShortLink(originalLink []byte) string {
 	return base64.StdEncoding.EncodeToString(originalLink)
 }
+
+// GenerateCode returns a random URL-safe short code for entities that are
+// not derived from a single URL.
+func GenerateCode() (string, error) {
+	buf := make([]byte, 6)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+func IsPreviewBot(userAgent string) bool {
+	userAgent = strings.ToLower(userAgent)
+	for _, bot := range previewBots {
+		if strings.Contains(userAgent, bot) {
+			return true
+		}
+	}
+	return false
+}
@@ -55,3 +55,38 @@ func TestGenerateShortLink(t *testing.T) {
 		})
 	}
 }
+
+func TestIsPreviewBot(t *testing.T) {
+	tests := []struct {
+		name      string
+		userAgent string
+		want      bool
+	}{
+		{
+			name:      "Telegram",
+			userAgent: "TelegramBot (like TwitterBot)",
+			want:      true,
+		},
+		{
+			name:      "Slack",
+			userAgent: "Slackbot-LinkExpanding 1.0 (+https://api.slack.com/robots)",
+			want:      true,
+		},
+		{
+			name:      "Facebook",
+			userAgent: "facebookexternalhit/1.1 (+http://www.facebook.com/externalhit_uatext.php)",
+			want:      true,
+		},
+		{
+			name:      "Browser",
+			userAgent: "Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/118.0 Safari/537.36",
+			want:      false,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.want, IsPreviewBot(test.userAgent))
+		})
+	}
+}
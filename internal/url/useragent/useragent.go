@@ -0,0 +1,176 @@
+package useragent
+
+import (
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+const (
+	OSiOS      = "ios"
+	OSAndroid  = "android"
+	OSWindows  = "windows"
+	OSMacOS    = "macos"
+	OSChromeOS = "chromeos"
+	OSLinux    = "linux"
+	OSOther    = "other"
+
+	DeviceMobile  = "mobile"
+	DeviceTablet  = "tablet"
+	DeviceDesktop = "desktop"
+
+	BrowserEdge    = "edge"
+	BrowserOpera   = "opera"
+	BrowserSamsung = "samsung"
+	BrowserChrome  = "chrome"
+	BrowserFirefox = "firefox"
+	BrowserSafari  = "safari"
+	BrowserOther   = "other"
+)
+
+//go:embed rules.json
+var defaultRules []byte
+
+type Agent struct {
+	OS      string `json:"os"`
+	Device  string `json:"device"`
+	Browser string `json:"browser"`
+	Bot     bool   `json:"bot,omitempty"`
+}
+
+// Rule matches a user agent that contains any of Any, all of All and none
+// of None, empty lists always match. Matching ignores case.
+type Rule struct {
+	Any   []string `json:"any,omitempty"`
+	All   []string `json:"all,omitempty"`
+	None  []string `json:"none,omitempty"`
+	Value string   `json:"value"`
+}
+
+// Rules are checked in order, the first matching rule of a list wins. The
+// order matters: iPadOS and Android report desktop-like tokens too, and
+// almost every browser claims to be Safari or Chrome.
+type Rules struct {
+	Bots    []Rule `json:"bots"`
+	OS      []Rule `json:"os"`
+	Device  []Rule `json:"device"`
+	Browser []Rule `json:"browser"`
+}
+
+// Classifier classifies User-Agent headers with rules that can be replaced
+// while requests are served.
+type Classifier struct {
+	mu    sync.RWMutex
+	rules Rules
+}
+
+var defaultClassifier = NewClassifier(DefaultRules())
+
+// DefaultRules returns the rules built into the binary.
+func DefaultRules() Rules {
+	rules, err := ParseRules(defaultRules)
+	if err != nil {
+		panic(fmt.Sprintf("built-in user agent rules: %s", err.Error()))
+	}
+	return rules
+}
+
+// LoadRules reads a rules file in the format of the built-in rules.json.
+func LoadRules(path string) (Rules, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Rules{}, fmt.Errorf("read user agent rules: %s", err.Error())
+	}
+	return ParseRules(data)
+}
+
+func ParseRules(data []byte) (Rules, error) {
+	var rules Rules
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return Rules{}, fmt.Errorf("unmarshaling user agent rules: %s", err.Error())
+	}
+
+	for _, list := range [][]Rule{rules.Bots, rules.OS, rules.Device, rules.Browser} {
+		for i := range list {
+			if list[i].Value == "" {
+				return Rules{}, errors.New("user agent rule without value")
+			}
+			list[i].Any = lower(list[i].Any)
+			list[i].All = lower(list[i].All)
+			list[i].None = lower(list[i].None)
+		}
+	}
+
+	return rules, nil
+}
+
+func NewClassifier(rules Rules) *Classifier {
+	return &Classifier{rules: rules}
+}
+
+// SetRules replaces the rules used by later calls of Classify.
+func (c *Classifier) SetRules(rules Rules) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.rules = rules
+}
+
+func (c *Classifier) Classify(userAgent string) Agent {
+	ua := strings.ToLower(userAgent)
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return Agent{
+		OS:      match(c.rules.OS, ua),
+		Device:  match(c.rules.Device, ua),
+		Browser: match(c.rules.Browser, ua),
+		Bot:     match(c.rules.Bots, ua) != "",
+	}
+}
+
+// Parse classifies a User-Agent header with the built-in rules.
+func Parse(userAgent string) Agent {
+	return defaultClassifier.Classify(userAgent)
+}
+
+func match(rules []Rule, ua string) string {
+	for _, rule := range rules {
+		if (len(rule.Any) == 0 || containsAny(ua, rule.Any...)) &&
+			containsAll(ua, rule.All...) &&
+			!containsAny(ua, rule.None...) {
+			return rule.Value
+		}
+	}
+	return ""
+}
+
+func containsAny(s string, substrings ...string) bool {
+	for _, substr := range substrings {
+		if strings.Contains(s, substr) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsAll(s string, substrings ...string) bool {
+	for _, substr := range substrings {
+		if !strings.Contains(s, substr) {
+			return false
+		}
+	}
+	return true
+}
+
+func lower(values []string) []string {
+	for i := range values {
+		values[i] = strings.ToLower(values[i])
+	}
+	return values
+}
@@ -0,0 +1,101 @@
+package useragent
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name      string
+		userAgent string
+		want      Agent
+	}{
+		{
+			name:      "iPhone Safari",
+			userAgent: "Mozilla/5.0 (iPhone; CPU iPhone OS 17_0 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.0 Mobile/15E148 Safari/604.1",
+			want:      Agent{OS: OSiOS, Device: DeviceMobile, Browser: BrowserSafari},
+		},
+		{
+			name:      "iPad Chrome",
+			userAgent: "Mozilla/5.0 (iPad; CPU OS 17_0 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) CriOS/118.0 Mobile/15E148 Safari/604.1",
+			want:      Agent{OS: OSiOS, Device: DeviceTablet, Browser: BrowserChrome},
+		},
+		{
+			name:      "Android phone Chrome",
+			userAgent: "Mozilla/5.0 (Linux; Android 14; Pixel 8) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/118.0 Mobile Safari/537.36",
+			want:      Agent{OS: OSAndroid, Device: DeviceMobile, Browser: BrowserChrome},
+		},
+		{
+			name:      "Android tablet Samsung",
+			userAgent: "Mozilla/5.0 (Linux; Android 13; SM-X700) AppleWebKit/537.36 (KHTML, like Gecko) SamsungBrowser/22.0 Chrome/111.0 Safari/537.36",
+			want:      Agent{OS: OSAndroid, Device: DeviceTablet, Browser: BrowserSamsung},
+		},
+		{
+			name:      "Windows Edge",
+			userAgent: "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/118.0 Safari/537.36 Edg/118.0",
+			want:      Agent{OS: OSWindows, Device: DeviceDesktop, Browser: BrowserEdge},
+		},
+		{
+			name:      "Linux Firefox",
+			userAgent: "Mozilla/5.0 (X11; Linux x86_64; rv:118.0) Gecko/20100101 Firefox/118.0",
+			want:      Agent{OS: OSLinux, Device: DeviceDesktop, Browser: BrowserFirefox},
+		},
+		{
+			name:      "Googlebot smartphone",
+			userAgent: "Mozilla/5.0 (Linux; Android 6.0.1; Nexus 5X Build/MMB29P) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/118.0 Mobile Safari/537.36 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)",
+			want:      Agent{OS: OSAndroid, Device: DeviceMobile, Browser: BrowserChrome, Bot: true},
+		},
+		{
+			name:      "curl",
+			userAgent: "curl/8.4.0",
+			want:      Agent{OS: OSOther, Device: DeviceDesktop, Browser: BrowserOther, Bot: true},
+		},
+		{
+			name:      "Cubot phone is not a bot",
+			userAgent: "Mozilla/5.0 (Linux; Android 10; CUBOT X30) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/118.0 Mobile Safari/537.36",
+			want:      Agent{OS: OSAndroid, Device: DeviceMobile, Browser: BrowserChrome},
+		},
+		{
+			name:      "Empty",
+			userAgent: "",
+			want:      Agent{OS: OSOther, Device: DeviceDesktop, Browser: BrowserOther},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.want, Parse(test.userAgent))
+		})
+	}
+}
+
+func TestClassifierRules(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{
+		"bots": [{"any": ["KioskWatch"], "value": "watcher"}],
+		"os": [{"value": "any"}],
+		"device": [{"all": ["kiosk", "linux"], "value": "kiosk"}, {"value": "desktop"}],
+		"browser": [{"any": ["firefox/"], "value": "firefox"}]
+	}`), 0644))
+
+	rules, err := LoadRules(path)
+	require.NoError(t, err)
+
+	classifier := NewClassifier(DefaultRules())
+	ua := "Mozilla/5.0 (X11; Linux x86_64; kiosk) KioskWatch/1.0"
+	assert.Equal(t, Agent{OS: OSLinux, Device: DeviceDesktop, Browser: BrowserOther}, classifier.Classify(ua))
+
+	classifier.SetRules(rules)
+	assert.Equal(t, Agent{OS: "any", Device: "kiosk", Browser: "", Bot: true}, classifier.Classify(ua))
+
+	_, err = ParseRules([]byte(`{"os": [{"any": ["linux"]}]}`))
+	assert.Error(t, err)
+
+	_, err = LoadRules(filepath.Join(t.TempDir(), "missing.json"))
+	assert.Error(t, err)
+}